@@ -5,7 +5,6 @@ package main
  * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
 
 import (
-	"code.google.com/p/go.net/websocket"
 	flags "github.com/jessevdk/go-flags"
 	"mozilla.org/util"
 	"mozilla.org/wmf"
@@ -22,6 +21,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -31,11 +31,17 @@ var opts struct {
 	Profile    string `long:"profile" optional:true`
 	MemProfile string `long:"memprofile" optional:true`
 	LogLevel   int    `short:"l" long:"loglevel" optional:true`
+	// Schema management
+	Migrate       bool   `long:"migrate" description:"Apply all pending schema migrations and exit"`
+	MigrateTo     string `long:"migrate-to" description:"Migrate the schema up or down to the given version and exit"`
+	MigrateStatus bool   `long:"migrate-status" description:"Show the schema version and exit"`
+	// Sign in as fake users (dev.users). NEVER in production.
+	Dev bool `long:"dev" description:"Development mode: sign in as fake users without verification"`
 }
 
 var (
 	logger  *util.HekaLogger
-	store   *storage.Storage
+	store   storage.Storage
 	metrics *util.Metrics
 )
 
@@ -59,6 +65,52 @@ func getCodeVersion() string {
 	return vers
 }
 
+// Handle the schema migration command line options.
+// Returns true if the program should exit.
+func migrateSchema(store storage.Storage, logger *util.HekaLogger) (exit bool) {
+	current, latest, err := store.SchemaVersion()
+	if err != nil {
+		logger.Error("main", "Could not read schema version",
+			util.Fields{"error": err.Error()})
+		return true
+	}
+	switch {
+	case opts.MigrateStatus:
+		fmt.Printf("Schema version: %d (latest: %d)\n", current, latest)
+		if current < latest {
+			fmt.Printf("%d migration(s) pending. Run with --migrate\n",
+				latest-current)
+		}
+		return true
+	case opts.Migrate || opts.MigrateTo != "":
+		target := -1
+		if opts.MigrateTo != "" {
+			if target, err = strconv.Atoi(opts.MigrateTo); err != nil {
+				logger.Error("main", "Invalid migration version",
+					util.Fields{"version": opts.MigrateTo})
+				return true
+			}
+		}
+		if err = store.Migrate(target); err != nil {
+			logger.Error("main", "Schema migration failed",
+				util.Fields{"error": err.Error()})
+			return true
+		}
+		current, _, _ = store.SchemaVersion()
+		logger.Info("main", "Schema migrated",
+			util.Fields{"version": strconv.Itoa(current)})
+		return true
+	case current < latest:
+		// Refuse to run against an old schema.
+		logger.Error("main", storage.ErrSchemaBehind.Error()+
+			". Run with --migrate",
+			util.Fields{"version": strconv.Itoa(current),
+				"latest": strconv.Itoa(latest)})
+		return true
+	}
+	return false
+}
+
 func main() {
 	flags.ParseArgs(&opts, os.Args)
 
@@ -92,12 +144,10 @@ func main() {
 		}
 	}
 
-	// Partner cert pool contains the various self-signed certs that
-	// partners may require to access their servers (for Proprietary
-	// wake mechanisms like UDP)
-	// This would be where you collect the certs and store them into
-	// the config map as something like:
-	// config["partnerCertPool"] = self.loadCerts()
+	// Partner certs (the CAs and client certs that partners may require
+	// to access their servers, for Proprietary wake mechanisms like UDP)
+	// are read from push.partners by the push client. See
+	// wmf/partners.go
 
 	if opts.Profile != "" {
 		log.Printf("Creating profile %s...\n", opts.Profile)
@@ -131,11 +181,23 @@ func main() {
 	metrics := util.NewMetrics(config.Get(
 		"metrics.prefix",
 		"wmf"), logger, config)
+	store, err = storage.Open(config, logger, metrics)
 	if err != nil {
 		logger.Error("main", "Unable to connect to database. Have you configured it yet?", nil)
 		return
 	}
-	handlers := wmf.NewHandler(config, logger, metrics)
+	defer store.Close()
+	if migrateSchema(store, logger) {
+		return
+	}
+	if opts.Dev {
+		wmf.EnableDevMode(config, logger)
+	}
+	// The store (and its connection pool) is shared by all handlers.
+	handlers := wmf.NewHandler(config, logger, metrics, store)
+	if handlers == nil {
+		return
+	}
 
 	// Signal handler
 	sigChan := make(chan os.Signal)
@@ -156,6 +218,35 @@ func main() {
 		handlers.RestQueue)
 	RESTMux.HandleFunc(fmt.Sprintf("/%s/state/", verRoot),
 		handlers.State)
+	// What became of the commands sent to a device
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/commands/", verRoot),
+		handlers.Commands)
+	// Location history for a device
+	// e.g. http://host/1/history/0123deviceid?since=0&limit=100
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/history/", verRoot),
+		handlers.History)
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/retention/", verRoot),
+		handlers.Retention)
+	// Download a device's track (format=gpx, kml or geojson)
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/export/", verRoot),
+		handlers.Export)
+	// Named zones that report when the device enters or leaves them
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/geofences/", verRoot),
+		handlers.Geofences)
+	// Expiring, read only links to a device's last location
+	// e.g. http://host/1/shared/0123deviceid?bewit=...
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/share/", verRoot),
+		handlers.Share)
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/shared/", verRoot),
+		handlers.Shared)
+	// Rotate or revoke a device's Hawk secret
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/credentials/", verRoot),
+		handlers.Credentials)
+	RESTMux.HandleFunc("/admin/credentials/",
+		handlers.AdminCredentials)
+	// Personal API tokens, sent as "Authorization: Bearer ..."
+	RESTMux.HandleFunc(fmt.Sprintf("/%s/tokens/", verRoot),
+		handlers.Tokens)
 	// Static files (served by nginx in production)
 	if config.GetFlag("use_insecure_static") {
 		RESTMux.HandleFunc("/bower_components/",
@@ -177,6 +268,11 @@ func main() {
 	// set state nonce & check if valid at signin
 	RESTMux.HandleFunc("/signin/",
 		handlers.Signin)
+	if opts.Dev {
+		// pick a fake user to sign in as
+		RESTMux.HandleFunc("/dev/signin/",
+			handlers.DevSignin)
+	}
 	//Signout
 	RESTMux.HandleFunc("/signout/",
 		handlers.Signout)
@@ -184,8 +280,9 @@ func main() {
 	auth := config.Get("fxa.redir_uri", "/oauth/")
 	RESTMux.HandleFunc(auth, handlers.OAuthCallback)
 
+	// e.g. ws://host/1/ws/<token>/0123deviceid (see UserDevices)
 	WSMux.Handle(fmt.Sprintf("/%s/ws/", verRoot),
-		websocket.Handler(handlers.WSSocketHandler))
+		handlers.WSServer())
 	// Handle root calls as webUI
 	// Get a list of registered devices for the currently logged in user
 	RESTMux.HandleFunc(fmt.Sprintf("/%s/devices/", verRoot),
@@ -199,6 +296,11 @@ func main() {
 	RESTMux.HandleFunc("/",
 		handlers.Index)
 
+	// Expire old positions in the background.
+	go handlers.PositionGC()
+	// Retry failed pushes in the background.
+	go handlers.PushRetry()
+
 	logger.Info("main", "startup...",
 		util.Fields{"host": host, "port": port})
 
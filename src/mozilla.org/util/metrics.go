@@ -19,6 +19,7 @@ var metrex sync.Mutex
 type Metrics struct {
 	dict   map[string]int64     // counters
     timer  map[string]float64   // timers
+	gauge  map[string]int64     // gauges
 	prefix string               // prefix for
 	logger *HekaLogger
 	statsd *statsd.Client
@@ -43,6 +44,7 @@ func NewMetrics(prefix string, logger *HekaLogger, config *MzConfig) (self *Metr
 	self = &Metrics{
 		dict:   make(map[string]int64),
         timer:  make(map[string]float64),
+		gauge:  make(map[string]int64),
 		prefix: prefix,
 		logger: logger,
         statsd: statsdc,
@@ -73,6 +75,9 @@ func (self *Metrics) Snapshot() map[string]interface{} {
     for k, v := range self.timer {
         oldMetrics[pfx + "avg." + k] = v
     }
+	for k, v := range self.gauge {
+		oldMetrics[pfx+"gauge."+k] = v
+	}
     oldMetrics[pfx + "server.age"] = time.Now().Unix() - self.born.Unix();
 	return oldMetrics
 }
@@ -135,3 +140,18 @@ func (self *Metrics) Timer(metric string, value int64) {
         self.statsd.Timing(metric, value, 1.0)
     }
 }
+
+// Record the current value of something (e.g. open connections)
+func (self *Metrics) Gauge(metric string, value int64) {
+	defer metrex.Unlock()
+	metrex.Lock()
+	self.gauge[metric] = value
+	if self.logger != nil {
+		self.logger.Debug("metrics", "gauge."+metric,
+			Fields{"value": strconv.FormatInt(value, 10),
+				"type": "gauge"})
+	}
+	if self.statsd != nil {
+		self.statsd.Gauge(metric, value, 1.0)
+	}
+}
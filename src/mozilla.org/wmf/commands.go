@@ -0,0 +1,161 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How long (in seconds) a command of type c may wait for the device
+// to pick it up. cmd.<c>.ttl, falling back to cmd.ttl. (0 for forever)
+func (self *Handler) commandTTL(c string) int64 {
+	def := self.config.Get("cmd.ttl", "86400")
+	ttl, err := strconv.ParseInt(self.config.Get("cmd."+c+".ttl", def), 10, 64)
+	if err != nil {
+		ttl, _ = strconv.ParseInt(def, 10, 64)
+	}
+	return ttl
+}
+
+// Protocol features the server understands.
+var knownCapabilities = []string{storage.CAP_BATCH}
+
+// Collapse the capability list from a registration to the known ones.
+// e.g. ["batch"] => "batch"
+func parseCapabilities(val interface{}) string {
+	var caps []string
+
+	list, ok := val.([]interface{})
+	if !ok {
+		return ""
+	}
+	for _, v := range list {
+		c, ok := v.(string)
+		if !ok {
+			continue
+		}
+		c = strings.ToLower(c)
+		for _, known := range knownCapabilities {
+			if c == known {
+				caps = append(caps, c)
+			}
+		}
+	}
+	return strings.Join(caps, ",")
+}
+
+// The most commands to hand a batch capable device in one reply.
+func (self *Handler) batchMax() int {
+	max, err := strconv.ParseInt(self.config.Get("cmd.batch_max", "10"), 10, 64)
+	if err != nil || max < 1 {
+		max = 10
+	}
+	return int(max)
+}
+
+// Cancel a command that the device has not picked up yet.
+// e.g. DELETE /1/queue/<deviceid>/<commandid>
+func (self *Handler) cancelCommand(resp http.ResponseWriter, req *http.Request) {
+	deviceId, item := getDevItemFromUrl(req.URL)
+	cmdId, err := strconv.ParseInt(item, 10, 64)
+	if err != nil {
+		http.Error(resp, "Bad Request", 400)
+		return
+	}
+	devRec, _ := self.getOwnedDeviceById(resp, req, deviceId)
+	if devRec == nil {
+		return
+	}
+	err = self.store.CancelCommand(devRec.ID, cmdId)
+	switch {
+	case err == storage.ErrUnknownCommand:
+		http.Error(resp, "Not Found", 404)
+		return
+	case err == storage.ErrCommandDelivered:
+		http.Error(resp, "Command already delivered", 409)
+		return
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not cancel command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	self.metrics.Increment("cmd.cancelled")
+	reply, _ := json.Marshal(replyType{"id": cmdId,
+		"state": storage.CMD_CANCELLED})
+	resp.Write(reply)
+}
+
+// Record the device's reply to a delivered command. A reply is either
+// a bare bool or an object with "ok" (and "error" if it failed).
+func (self *Handler) ackCommand(devId, cmdType string, reply interface{}) {
+	var ok bool
+	var detail string
+
+	switch reply.(type) {
+	case bool:
+		ok = reply.(bool)
+	case map[string]interface{}:
+		args := reply.(map[string]interface{})
+		ok = isTrue(args["ok"])
+		if e, has := args["error"]; has {
+			detail = fmt.Sprintf("%v", e)
+		}
+	}
+	state := storage.CMD_ACKNOWLEDGED
+	if !ok {
+		state = storage.CMD_FAILED
+		self.metrics.Increment("cmd.failed." + cmdType)
+	}
+	if err := self.store.AckCommand(devId, cmdType, state, detail); err != nil {
+		self.logger.Warn(self.logCat, "Could not record command reply",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"cmd":      cmdType})
+	}
+}
+
+// Show what happened to the commands sent to a device.
+// e.g. GET /1/commands/<deviceid>?limit=<n>
+func (self *Handler) Commands(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Commands"
+
+	resp.Header().Set("Content-Type", "application/json")
+	devRec, _ := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	commands, err := self.store.GetCommands(devRec.ID,
+		int(queryInt(req, "limit", 50)))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	if commands == nil {
+		commands = []storage.Command{}
+	}
+	for i := range commands {
+		// Don't echo lock codes and messages back out.
+		commands[i].Cmd = ""
+	}
+	reply, _ := json.Marshal(replyType{
+		"deviceid": devRec.ID,
+		"commands": commands})
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	resp.Write(reply)
+}
@@ -0,0 +1,193 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Device credentials.
+   A device's HAWK secret can be rotated or revoked without the device
+   registering again, by its owner or by an admin.
+
+   rotate: a new secret is generated and the device is pushed. The old
+   secret keeps working for hawk.rotate_grace seconds, and every /cmd/
+   reply to a request signed with it (itself signed with the old
+   secret, see Server-Authorization) carries the new one:
+       {"k": {"secret": "<new secret>"}, ...}
+   (appended as an element for batch devices). The first request
+   signed with the new secret ends the grace period.
+
+   revoke: the secrets are removed. The device can no longer call
+   /cmd/, or register again without a fresh assertion.
+
+   POST /1/credentials/<deviceid>      {"action":"rotate"|"revoke"}
+       as the signed in owner.
+   POST /admin/credentials/<deviceid>  {"action":"rotate"|"revoke"}
+       with "Authorization: Bearer <admin.token>".
+   GET on either returns {"deviceid":..., "revoked":bool,
+   "rotating":bool, "grace":<epoch the old secret stops working>}
+*/
+
+// Add the device's new secret to a /cmd/ reply.
+func withNewSecret(output []byte, batch bool, secret string) []byte {
+	key, _ := json.Marshal(replyType{"secret": secret})
+	if batch {
+		var cmds []json.RawMessage
+		json.Unmarshal(output, &cmds)
+		entry, _ := json.Marshal(map[string]json.RawMessage{"k": key})
+		merged, _ := json.Marshal(append(cmds, entry))
+		return merged
+	}
+	cmd := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(output, &cmd); err != nil {
+		return output
+	}
+	cmd["k"] = key
+	merged, _ := json.Marshal(cmd)
+	return merged
+}
+
+// Rotate the device's secret, and push it so that it checks in for
+// the new one.
+func (self *Handler) rotateSecret(devRec *storage.Device) (err error) {
+	grace := configInt(self.config, "hawk.rotate_grace", 86400)
+	if err = self.store.RotateSecret(devRec.ID, GenNonce(16),
+		grace); err != nil {
+		return err
+	}
+	self.metrics.Increment("credentials.rotate")
+	if devRec.PushGone {
+		return nil
+	}
+	if err := SendPush(devRec, self.config, nil); err != nil {
+		// It will still get the secret the next time it checks in.
+		self.logger.Warn(self.logCat, "Could not push rotated secret",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+	}
+	return nil
+}
+
+// Carry out a credentials request for the device on behalf of actor
+// (for the logs).
+func (self *Handler) credentials(resp http.ResponseWriter, req *http.Request, devRec *storage.Device, actor string) {
+	if req.Method == "POST" {
+		buffer, raw, err := parseBody(req.Body)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not parse body",
+				util.Fields{"error": err.Error(),
+					"body": raw})
+			http.Error(resp, "Bad Request", 400)
+			return
+		}
+		action, _ := buffer["action"].(string)
+		switch action {
+		case "rotate":
+			if devRec.Secret == "" {
+				// Nothing to rotate; it has to register again.
+				http.Error(resp, "Conflict", 409)
+				return
+			}
+			err = self.rotateSecret(devRec)
+		case "revoke":
+			if err = self.store.RevokeSecret(devRec.ID); err == nil {
+				self.metrics.Increment("credentials.revoke")
+			}
+		default:
+			http.Error(resp, "Bad Request", 400)
+			return
+		}
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not update credentials",
+				util.Fields{"error": err.Error(),
+					"action":   action,
+					"deviceId": devRec.ID})
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		self.logger.Info(self.logCat, "Device credentials updated",
+			util.Fields{"action": action,
+				"deviceId": devRec.ID,
+				"by":       actor})
+		if devRec, err = self.store.GetDeviceInfo(devRec.ID); err != nil {
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+	} else if req.Method != "GET" {
+		http.Error(resp, "Method Not Allowed", 405)
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+	rotating := devRec.PrevSecret != "" && now < devRec.PrevSecretExpires
+	var grace int64
+	if rotating {
+		grace = devRec.PrevSecretExpires
+	}
+	reply, _ := json.Marshal(replyType{
+		"deviceid": devRec.ID,
+		"revoked":  devRec.Secret == "",
+		"rotating": rotating,
+		"grace":    grace})
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	resp.Write(reply)
+}
+
+// Show, rotate or revoke the credentials of one of the user's devices.
+func (self *Handler) Credentials(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Credentials"
+
+	resp.Header().Set("Content-Type", "application/json")
+	devRec, userId := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	self.credentials(resp, req, devRec, userId)
+}
+
+// Is the request from an admin? (admin.token must be set.)
+func (self *Handler) isAdmin(req *http.Request) bool {
+	token := self.config.Get("admin.token", "")
+	auth := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return hmac.Equal([]byte(strings.TrimPrefix(auth, "Bearer ")),
+		[]byte(token))
+}
+
+// Show, rotate or revoke the credentials of any device.
+func (self *Handler) AdminCredentials(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:AdminCredentials"
+
+	resp.Header().Set("Content-Type", "application/json")
+	if !self.isAdmin(req) {
+		self.logger.Warn(self.logCat, "Unauthorized admin request",
+			util.Fields{"path": req.URL.Path})
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	devRec, err := self.store.GetDeviceInfo(getDevFromUrl(req.URL))
+	if err == storage.ErrUnknownDevice || (err == nil && devRec == nil) {
+		http.Error(resp, "Not Found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	self.credentials(resp, req, devRec, "admin")
+}
@@ -0,0 +1,119 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* Development sign in.
+   When the server is started with --dev (and only then; no config
+   setting turns it on), users and devices sign in as one of the fake
+   users listed in dev.users, without any identity provider:
+
+       web UI   /signin/ shows a page to pick the user from
+       devices  "assert" is the fake user's email
+
+   Every page of the UI carries a banner saying so, and every sign in is
+   logged as a warning.
+*/
+
+var devMode bool
+
+// Sign everyone in with the dev provider. Called by main for --dev.
+func EnableDevMode(config *util.MzConfig, logger *util.HekaLogger) {
+	devMode = true
+	RegisterIdentityProvider("dev", OpenDev)
+	config.Override("auth.provider", "dev")
+	logger.Critical("auth",
+		"!!! DEVELOPMENT MODE: sign in is NOT verified. Never run --dev in production !!!",
+		nil)
+}
+
+type DevProvider struct {
+	logger *util.HekaLogger
+	logCat string
+	users  []string
+}
+
+func OpenDev(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error) {
+	self := &DevProvider{logger: logger, logCat: "auth:dev"}
+	for _, user := range strings.Split(config.Get("dev.users",
+		"user1@example.com,user2@example.com"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			self.users = append(self.users, user)
+		}
+	}
+	return self, nil
+}
+
+// Is the email one of the fake users?
+func (self *DevProvider) identity(email string) (*Identity, error) {
+	for _, user := range self.users {
+		if user == email {
+			self.logger.Warn(self.logCat, "!!! Unverified dev sign in",
+				util.Fields{"email": email})
+			return &Identity{Email: email}, nil
+		}
+	}
+	return nil, ErrAuthorization
+}
+
+func (self *DevProvider) LoginURL(state, nonce, challenge string) (string, error) {
+	return "/dev/signin/?" + url.Values{"state": {state}}.Encode(), nil
+}
+
+// The code is the picked user's email.
+func (self *DevProvider) Exchange(code, verifier, nonce string) (*Identity, error) {
+	return self.identity(code)
+}
+
+func (self *DevProvider) Verify(assertion string) (*Identity, error) {
+	return self.identity(assertion)
+}
+
+var devSigninPage = template.Must(template.New("dev").Parse(`<!doctype html>
+<html>
+  <head><meta charset="utf-8"><title>Development sign in</title></head>
+  <body>
+    <p><strong>Development mode:</strong> sign in is not verified.</p>
+    <ul>
+    {{range .Users}}
+      <li><a href="{{$.Callback}}?state={{$.State}}&amp;code={{.}}">{{.}}</a></li>
+    {{end}}
+    </ul>
+  </body>
+</html>
+`))
+
+// Let the tester pick a fake user to sign in as.
+func (self *Handler) DevSignin(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:DevSignin"
+
+	dev, ok := self.idp.(*DevProvider)
+	if !devMode || !ok {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := devSigninPage.Execute(resp, struct {
+		Callback string
+		State    string
+		Users    []string
+	}{
+		self.config.Get("fxa.redir_uri", "/oauth/"),
+		req.FormValue("state"),
+		dev.users,
+	})
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not show sign in page",
+			util.Fields{"error": err.Error()})
+	}
+}
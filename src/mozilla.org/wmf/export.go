@@ -0,0 +1,188 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* Track export.
+   Positions are written out oldest first, one at a time, rather than
+   building the whole document in memory.
+*/
+
+type trackWriter interface {
+	Header(w io.Writer, name string)
+	Position(w io.Writer, pos storage.Position, first bool)
+	Footer(w io.Writer)
+}
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	writer      trackWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"gpx":     {"application/gpx+xml", "gpx", gpxWriter{}},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", kmlWriter{}},
+	"geojson": {"application/geo+json", "geojson", geoJsonWriter{}},
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func isoTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// GPX 1.1
+type gpxWriter struct{}
+
+func (gpxWriter) Header(w io.Writer, name string) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<gpx version=\"1.1\" creator=\"FindMyDevice\" xmlns=\"http://www.topografix.com/GPX/1/1\">\n"+
+		"<trk><name>%s</name><trkseg>\n", xmlEscape(name))
+}
+
+func (gpxWriter) Position(w io.Writer, pos storage.Position, first bool) {
+	fmt.Fprintf(w, "<trkpt lat=\"%f\" lon=\"%f\"><ele>%f</ele><time>%s</time>",
+		pos.Latitude, pos.Longitude, pos.Altitude, isoTime(pos.Time))
+	if pos.Provider != "" {
+		fmt.Fprintf(w, "<src>%s</src>", xmlEscape(pos.Provider))
+	}
+	fmt.Fprint(w, "</trkpt>\n")
+}
+
+func (gpxWriter) Footer(w io.Writer) {
+	fmt.Fprint(w, "</trkseg></trk>\n</gpx>\n")
+}
+
+// KML 2.2
+type kmlWriter struct{}
+
+func (kmlWriter) Header(w io.Writer, name string) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n"+
+		"<Document><name>%s</name>\n", xmlEscape(name))
+}
+
+func (kmlWriter) Position(w io.Writer, pos storage.Position, first bool) {
+	// KML coordinates are longitude first.
+	fmt.Fprintf(w, "<Placemark><TimeStamp><when>%s</when></TimeStamp>"+
+		"<Point><coordinates>%f,%f,%f</coordinates></Point></Placemark>\n",
+		isoTime(pos.Time), pos.Longitude, pos.Latitude, pos.Altitude)
+}
+
+func (kmlWriter) Footer(w io.Writer) {
+	fmt.Fprint(w, "</Document>\n</kml>\n")
+}
+
+// GeoJSON (RFC 7946) FeatureCollection of Points
+type geoJsonWriter struct{}
+
+func (geoJsonWriter) Header(w io.Writer, name string) {
+	js, _ := json.Marshal(name)
+	fmt.Fprintf(w, "{\"type\":\"FeatureCollection\",\"name\":%s,\"features\":[\n", js)
+}
+
+func (geoJsonWriter) Position(w io.Writer, pos storage.Position, first bool) {
+	feature, _ := json.Marshal(replyType{
+		"type": "Feature",
+		"geometry": replyType{
+			"type": "Point",
+			// GeoJSON coordinates are longitude first.
+			"coordinates": []float64{pos.Longitude, pos.Latitude, pos.Altitude},
+		},
+		"properties": replyType{
+			"time":     isoTime(pos.Time),
+			"accuracy": pos.Accuracy,
+			"speed":    pos.Speed,
+			"heading":  pos.Heading,
+			"battery":  pos.Battery,
+			"provider": pos.Provider,
+		},
+	})
+	if !first {
+		w.Write([]byte(",\n"))
+	}
+	w.Write(feature)
+}
+
+func (geoJsonWriter) Footer(w io.Writer) {
+	fmt.Fprint(w, "\n]}\n")
+}
+
+// Pick the export format from the "format" query value, or failing that,
+// the Accept header. Defaults to GeoJSON.
+func exportFormatFor(req *http.Request) (format exportFormat, ok bool) {
+	if name := strings.ToLower(req.FormValue("format")); name != "" {
+		format, ok = exportFormats[name]
+		return format, ok
+	}
+	accept := strings.ToLower(req.Header.Get("Accept"))
+	switch {
+	case strings.Contains(accept, "gpx"):
+		return exportFormats["gpx"], true
+	case strings.Contains(accept, "kml"):
+		return exportFormats["kml"], true
+	}
+	return exportFormats["geojson"], true
+}
+
+// Download the stored track for a device.
+// e.g. GET /1/export/<deviceid>?format=gpx&since=<epoch>&until=<epoch>
+func (self *Handler) Export(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Export"
+
+	devRec, _ := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	format, ok := exportFormatFor(req)
+	if !ok {
+		http.Error(resp, "Unknown format", 400)
+		return
+	}
+	positions, err := self.store.GetPositionHistory(devRec.ID,
+		queryInt(req, "since", 0),
+		queryInt(req, "until", 0),
+		0)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get position history",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+
+	resp.Header().Set("Content-Type", format.contentType)
+	resp.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s.%s\"", devRec.ID,
+			format.extension))
+	out := bufio.NewWriter(resp)
+	format.writer.Header(out, devRec.Name)
+	// positions are newest first.
+	for i := len(positions) - 1; i >= 0; i-- {
+		format.writer.Position(out, positions[i], i == len(positions)-1)
+	}
+	format.writer.Footer(out)
+	out.Flush()
+	self.metrics.Increment("page.export." + format.extension)
+}
@@ -0,0 +1,230 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Default Firefox Accounts servers (see fxa.token, fxa.content.endpoint)
+const (
+	OAUTH_ENDPOINT   = "https://oauth.accounts.firefox.com"
+	CONTENT_ENDPOINT = "https://accounts.firefox.com"
+)
+
+func init() {
+	RegisterIdentityProvider("fxa", OpenFxA)
+}
+
+// Firefox Accounts, via its OAuth and profile servers.
+type FxAProvider struct {
+	assertionBase
+}
+
+func OpenFxA(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error) {
+	return &FxAProvider{assertionBase{config: config,
+		logger: logger,
+		logCat: "auth:fxa"}}, nil
+}
+
+func (self *FxAProvider) LoginURL(state, nonce, challenge string) (string, error) {
+	return loginTemplate(self.config, "fxa", state)
+}
+
+func (self *FxAProvider) Exchange(code, verifier, nonce string) (*Identity, error) {
+	token, err := self.getAccessToken(code)
+	if err != nil {
+		return nil, err
+	}
+	email, err := self.getUserEmail(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Email: email, AccessToken: token}, nil
+}
+
+func (self *FxAProvider) Verify(assertion string) (*Identity, error) {
+	if err := self.checkChars(assertion); err != nil {
+		return nil, err
+	}
+
+	cli := http.Client{}
+	validatorUrl := self.config.Get("fxa.verifier",
+		OAUTH_ENDPOINT+"/authorization")
+	// fmt.Printf("### Sending to %s\n", validatorUrl)
+	args := make(map[string]string)
+	args["client_id"] = self.config.Get("fxa.client_id", "invalid")
+	args["assertion"] = assertion
+	if self.config.GetFlag("auth.audience_from_assertion") {
+		args["audience"] = self.extractAudience(assertion)
+		self.logger.Info(self.logCat, "Extracted Audience",
+			util.Fields{"audience": args["audience"]})
+	}
+	if self.config.GetFlag("auth.trim_audience") {
+		audUrl, err := url.Parse(args["audience"])
+		if err != nil {
+			self.logger.Warn(self.logCat, "Could not parse Audience",
+				util.Fields{"error": err.Error(),
+					"audience": args["audience"]})
+		} else {
+			args["audience"] = fmt.Sprintf("%s://%s/", audUrl.Scheme,
+				audUrl.Host)
+		}
+	}
+	if args["audience"] == "" {
+		args["audience"] = self.config.Get("fxa.audience",
+			OAUTH_ENDPOINT+"/v1")
+	}
+	// State is a nonce useful for validation callbacks.
+	// Since we're not calling back, it's not necessary to
+	// check if the caller matches the recipient.
+	args["state"], _ = util.GenUUID4()
+
+	argsj, err := json.Marshal(args)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not marshal args",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	if self.config.GetFlag("auth.show_assertion") {
+		fmt.Printf("### Validating Assertion:\n %s\n", argsj)
+	}
+	// Send the assertion to the validator
+	req, err := http.NewRequest("POST", validatorUrl, bytes.NewReader(argsj))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not POST verify assertion",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	res, err := cli.Do(req)
+	if err != nil {
+		self.logger.Error(self.logCat, "FxA verification failed",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	buff, raw, err := parseBody(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if code, ok := buff["code"]; ok && code.(float64) > 299.0 {
+		self.logger.Error(self.logCat, "FxA verification failed auth",
+			util.Fields{"code": strconv.FormatInt(int64(code.(float64)), 10),
+				"error": fmt.Sprintf("%v", buff["error"]),
+				"body":  raw})
+		return nil, ErrAuthorization
+	}
+
+	// the response has either been a redirect or a validated assertion.
+	// fun times, fun times...
+	if idp, ok := buff["idpClaims"]; ok {
+		if email, ok := idp.(map[string]interface{})["fxa-verifiedEmail"]; ok {
+			return &Identity{Email: email.(string)}, nil
+		}
+	}
+	// get the "redirect" url. We're not going to redirect, just get the code.
+	redir, ok := buff["redirect"].(string)
+	if !ok {
+		self.logger.Error(self.logCat, "FxA verification did not return redirect",
+			util.Fields{"body": raw})
+		return nil, ErrOauth
+	}
+	vurl, err := url.Parse(redir)
+	if err != nil {
+		self.logger.Error(self.logCat, "FxA redirect url invalid",
+			util.Fields{"error": err.Error(), "url": redir})
+		return nil, err
+	}
+	code := vurl.Query().Get("code")
+	if len(code) == 0 {
+		self.logger.Error(self.logCat, "FxA code not present",
+			util.Fields{"url": redir})
+		return nil, ErrOauth
+	}
+	//Convert code to access token.
+	return self.Exchange(code, "", "")
+}
+
+// get the OAuth2 Access token
+func (self *FxAProvider) getAccessToken(code string) (accessToken string, err error) {
+	token_url := self.config.Get("fxa.token", OAUTH_ENDPOINT+"/v1/token")
+	vals := make(map[string]string)
+	vals["client_id"] = self.config.Get("fxa.client_id", "invalid")
+	vals["client_secret"] = self.config.Get("fxa.client_secret", "invalid")
+	vals["code"] = code
+	vd, err := json.Marshal(vals)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not marshal vals to json",
+			util.Fields{"error": err.Error()})
+		return "", err
+	}
+	req, err := http.NewRequest("POST", token_url, bytes.NewBuffer(vd))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get oauth token",
+			util.Fields{"code": code, "error": err.Error()})
+		return "", ErrOauth
+	}
+	req.Header.Add("Content-Type", "application/json")
+	cli := http.DefaultClient
+	res, err := cli.Do(req)
+	if err != nil {
+		self.logger.Error(self.logCat, "Access Token Fetch failed",
+			util.Fields{"error": err.Error()})
+		return "", err
+	}
+	reply, raw, err := parseBody(res.Body)
+	if code, ok := reply["code"]; ok && code.(float64) > 299.0 {
+		self.logger.Error(self.logCat, "FxA Access token failure",
+			util.Fields{"code": strconv.FormatFloat(code.(float64), 'f', 1, 64),
+				"body": raw})
+		return "", ErrOauth
+	}
+	token, ok := reply["access_token"].(string)
+	if !ok {
+		self.logger.Error(self.logCat, "OAuth Access token missing from reply",
+			util.Fields{"code": code})
+		return "", ErrOauth
+	}
+	return token, nil
+}
+
+// Get the user's Email from the profile server using the OAuth2 access token
+func (self *FxAProvider) getUserEmail(accessToken string) (email string, err error) {
+	client := http.DefaultClient
+	url := self.config.Get("fxa.content.endpoint", CONTENT_ENDPOINT) + "/email"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not POST to get email",
+			util.Fields{"error": err.Error()})
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get user email",
+			util.Fields{"error": err.Error()})
+		return "", err
+	}
+	buffer, raw, err := parseBody(resp.Body)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not parse body",
+			util.Fields{"error": err.Error()})
+		return "", err
+	}
+	email, ok := buffer["email"].(string)
+	if !ok {
+		self.logger.Error(self.logCat, "Response did not contain email",
+			util.Fields{"body": raw})
+		return "", ErrNoUser
+	}
+	return email, nil
+}
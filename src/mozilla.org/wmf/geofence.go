@@ -0,0 +1,255 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidGeofence = errors.New("Invalid geofence")
+
+// mean earth radius in meters
+const EARTH_RADIUS = 6371000.0
+
+// Great circle distance (in meters) between two points.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*
+			math.Sin(dLon/2)*math.Sin(dLon/2)
+	return EARTH_RADIUS * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Is the point inside the polygon? (ray casting. Zones are small enough
+// that treating lat/lon as planar is fine.)
+func inPolygon(lat, lon float64, points [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		yi, xi := points[i][0], points[i][1]
+		yj, xj := points[j][0], points[j][1]
+		if (yi > lat) != (yj > lat) &&
+			lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Is the location inside the geofence?
+func inGeofence(fence *storage.Geofence, lat, lon float64) bool {
+	switch fence.Kind {
+	case storage.GEOFENCE_CIRCLE:
+		return haversine(fence.Latitude, fence.Longitude, lat, lon) <= fence.Radius
+	case storage.GEOFENCE_POLYGON:
+		return inPolygon(lat, lon, fence.Points)
+	}
+	return false
+}
+
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// Check that a user supplied geofence is usable.
+func validGeofence(fence *storage.Geofence) error {
+	fence.Name = strings.TrimSpace(fence.Name)
+	if fence.Name == "" {
+		return ErrInvalidGeofence
+	}
+	switch fence.Kind {
+	case storage.GEOFENCE_CIRCLE:
+		if fence.Radius <= 0 || !validLatLon(fence.Latitude, fence.Longitude) {
+			return ErrInvalidGeofence
+		}
+		fence.Points = nil
+	case storage.GEOFENCE_POLYGON:
+		if len(fence.Points) < 3 {
+			return ErrInvalidGeofence
+		}
+		for _, p := range fence.Points {
+			if !validLatLon(p[0], p[1]) {
+				return ErrInvalidGeofence
+			}
+		}
+		fence.Latitude, fence.Longitude, fence.Radius = 0, 0, 0
+	default:
+		return ErrInvalidGeofence
+	}
+	return nil
+}
+
+// Compare a new position against the device's geofences, recording and
+// reporting any that were entered or left.
+func (self *Handler) checkGeofences(devId string, location storage.Position) {
+	fences, err := self.store.GetGeofences(devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofences",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return
+	}
+	for i := range fences {
+		fence := &fences[i]
+		inside := inGeofence(fence, location.Latitude, location.Longitude)
+		if inside == fence.Inside {
+			continue
+		}
+		if err = self.store.SetGeofenceState(devId, fence.ID, inside); err != nil {
+			self.logger.Error(self.logCat, "Could not set geofence state",
+				util.Fields{"error": err.Error(),
+					"fenceId": fence.ID})
+			continue
+		}
+		// (the device's own clock is not trusted.)
+		event := storage.GeofenceEvent{
+			DeviceID:  devId,
+			FenceID:   fence.ID,
+			Name:      fence.Name,
+			Event:     storage.GEOFENCE_EXIT,
+			Latitude:  location.Latitude,
+			Longitude: location.Longitude,
+			Time:      time.Now().Unix(),
+		}
+		if inside {
+			event.Event = storage.GEOFENCE_ENTER
+		}
+		if err = self.store.AddGeofenceEvent(event); err != nil {
+			self.logger.Error(self.logCat, "Could not record geofence event",
+				util.Fields{"error": err.Error(),
+					"fenceId": fence.ID})
+		}
+		self.metrics.Increment("geofence." + event.Event)
+		if client, ok := Clients[devId]; ok {
+			js, _ := json.Marshal(replyType{"Geofence": event})
+			client.Write(js)
+		}
+	}
+}
+
+// Manage the geofences for a device.
+// GET    /1/geofences/<deviceid>           list fences and recent events
+// POST   /1/geofences/<deviceid>           create a fence
+// PUT    /1/geofences/<deviceid>?id=<id>   replace a fence
+// DELETE /1/geofences/<deviceid>?id=<id>   remove a fence
+func (self *Handler) Geofences(resp http.ResponseWriter, req *http.Request) {
+	var fence storage.Geofence
+	var reply []byte
+	self.logCat = "handler:Geofences"
+
+	resp.Header().Set("Content-Type", "application/json")
+	devRec, _ := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	fenceId := req.FormValue("id")
+
+	switch req.Method {
+	case "GET":
+		fences, err := self.store.GetGeofences(devRec.ID)
+		if err != nil {
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		events, err := self.store.GetGeofenceEvents(devRec.ID,
+			queryInt(req, "since", 0),
+			int(queryInt(req, "limit", 50)))
+		if err != nil {
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		if fences == nil {
+			fences = []storage.Geofence{}
+		}
+		if events == nil {
+			events = []storage.GeofenceEvent{}
+		}
+		reply, _ = json.Marshal(replyType{
+			"deviceid":  devRec.ID,
+			"geofences": fences,
+			"events":    events})
+	case "POST", "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err == nil {
+			err = json.Unmarshal(body, &fence)
+		}
+		if err == nil {
+			err = validGeofence(&fence)
+		}
+		if err != nil {
+			self.logger.Warn(self.logCat, "Invalid geofence",
+				util.Fields{"error": err.Error(),
+					"body": string(body)})
+			http.Error(resp, "Bad Request", 400)
+			return
+		}
+		fence.DeviceID = devRec.ID
+		fence.ID = ""
+		if req.Method == "PUT" {
+			if fenceId == "" {
+				http.Error(resp, "Bad Request", 400)
+				return
+			}
+			fence.ID = fenceId
+		} else {
+			maxFences, err := strconv.ParseInt(
+				self.config.Get("geofence.max", "20"), 10, 64)
+			if err != nil {
+				maxFences = 20
+			}
+			fences, err := self.store.GetGeofences(devRec.ID)
+			if err != nil {
+				http.Error(resp, "Server Error", 500)
+				return
+			}
+			if int64(len(fences)) >= maxFences {
+				http.Error(resp, "Too many geofences", 400)
+				return
+			}
+		}
+		fence.ID, err = self.store.SetGeofence(fence)
+		switch {
+		case err == storage.ErrUnknownGeofence:
+			http.Error(resp, "Not Found", 404)
+			return
+		case err != nil:
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		fence.Inside = false
+		reply, _ = json.Marshal(fence)
+	case "DELETE":
+		err := self.store.DeleteGeofence(devRec.ID, fenceId)
+		switch {
+		case err == storage.ErrUnknownGeofence:
+			http.Error(resp, "Not Found", 404)
+			return
+		case err != nil:
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		reply = []byte("{}")
+	default:
+		http.Error(resp, "Method Not Allowed", 405)
+		return
+	}
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	resp.Write(reply)
+}
@@ -11,7 +11,7 @@ import (
 	"mozilla.org/util"
 	"mozilla.org/wmf/storage"
 
-	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -37,17 +37,18 @@ type Handler struct {
 	config  *util.MzConfig
 	logger  *util.HekaLogger
 	metrics *util.Metrics
+	store   storage.Storage
 	devId   string
 	logCat  string
 	accepts []string
 	hawk    *Hawk
+	nonces  NonceCache
+	idp     IdentityProvider
 }
 
 const (
 	SESSION_NAME     = "user"
 	SESSION_LOGIN    = "login"
-	OAUTH_ENDPOINT   = "https://oauth.accounts.firefox.com"
-	CONTENT_ENDPOINT = "https://accounts.firefox.com"
 	SESSION_USERID   = "userid"
 	SESSION_EMAIL    = "email"
 	SESSION_TOKEN    = "token"
@@ -72,6 +73,7 @@ type initDataStruct struct {
 	DeviceList  []storage.DeviceList
 	Device      *storage.Device
 	Host        map[string]string
+	DevMode     bool // sign in is not verified (see dev.go)
 }
 
 // Map of clientIDs to socket handlers
@@ -83,6 +85,8 @@ var (
 	ErrAuthorization = errors.New("Needs Authorization")
 	ErrNoUser        = errors.New("No User")
 	ErrOauth         = errors.New("OAuth Error")
+	ErrBadOrigin     = errors.New("Origin not allowed")
+	ErrNoSecret      = errors.New("session.secret is not set")
 )
 
 // package globals
@@ -111,290 +115,6 @@ func rmClient(id string) {
 
 //Handler private functions
 
-// SUPER FAKE DO NOT EVER USE IN PRODUCTION FOR DEBUGGING ONLY!
-// Extract the user info from the assertion WITHOUT VERIFICATIONS
-
-func (self *Handler) extractFromAssertion(assertion string) (userid, email string, err error) {
-	var ErrInvalidAssertion = errors.New("Invalid assertion")
-	bits := strings.Split(assertion, ".")
-	if len(bits) < 2 {
-		self.logger.Error(self.logCat, "Invalid assertion",
-			util.Fields{"assertion": assertion})
-		return "", "", ErrInvalidAssertion
-	}
-	data := bits[1]
-	// pad to byte boundry
-	data = data + "===="[:len(data)%4]
-	decoded, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not decode assertion",
-			util.Fields{"assertion frame": data})
-		return "", "", ErrInvalidAssertion
-	}
-	asrt := make(replyType)
-	err = json.Unmarshal(decoded, &asrt)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not unmarshal",
-			util.Fields{"error": err.Error()})
-		return "", "", err
-	}
-	// Normally, the UserID would be provided from FxA.
-	// since FxA is currently unavailable for desktop, we're going
-	// to need a value here, thus the insecure Id generation.
-	// Obviously:
-	// ******** DO NOT ENABLE auth.disabled FLAG IN PRODUCTION!! ******
-	if e, ok := asrt["fxa-verifiedEmail"]; ok {
-		email = e.(string)
-	} else {
-		email = asrt["principal"].(map[string]interface{})["email"].(string)
-	}
-	userid = self.genHash(email)
-	self.logger.Debug(self.logCat, "Extracted credentials",
-		util.Fields{"userId": userid, "email": email})
-	return userid, email, nil
-}
-
-// Somewhat of a hack, extract the audience from the assertion. This is
-// because some versions of the client do not specify the correct audience
-// and a mis-match causes the assertion to fail.
-func (self *Handler) extractAudience(assertion string) (audience string) {
-	bits := strings.Split(assertion, ".")
-	// Classic? persona has 3 chunks, modified has 5.
-	if len(bits) == 5 {
-		if data, err := base64.StdEncoding.DecodeString(bits[3] + "===="[:len(bits[3])%4]); err == nil {
-			dj := make(replyType)
-			if err = json.Unmarshal(data, &dj); err == nil {
-				if v, ok := dj["audience"]; ok {
-					// fxa
-					return v.(string)
-				} else if v, ok := dj["aud"]; ok {
-					// persona
-					return v.(string)
-				}
-			}
-		}
-	}
-	return ""
-}
-
-// verify a Persona assertion using the config values
-// part of Handler for config & logging reasons
-func (self *Handler) verifyPersonaAssertion(assertion string) (userid, email string, err error) {
-	var ok bool
-	var audience string
-
-	if assLen := len(assertion); assLen != len(strings.Map(assertionFilter, assertion)) {
-		self.logger.Error(self.logCat, "Assertion contains invalid characters.",
-			util.Fields{"assertion": assertion})
-		return "", "", ErrAuthorization
-	}
-
-	// ******** DO NOT ENABLE auth.disabled FLAG IN PRODUCTION!! ******
-	if self.config.GetFlag("auth.disabled") {
-		self.logger.Warn(self.logCat, "!!! Skipping validation...", nil)
-		if len(assertion) == 0 {
-			return "user1", "user@example.com", nil
-		}
-		// Time to UberFake! THIS IS VERY DANGEROUS!
-		self.logger.Warn(self.logCat,
-			"!!! Using Assertion Without Validation",
-			nil)
-		return self.extractFromAssertion(assertion)
-	}
-	// pull the audience out of the assertion, if it's present.
-	if self.config.GetFlag("auth.audience_from_assertion") {
-		audience = self.extractAudience(assertion)
-	}
-	if audience == "" {
-		audience = self.config.Get("persona.audience",
-			"http://localhost:8080")
-	}
-	// Better verify for realz
-	validatorURL := self.config.Get("persona.verifier",
-		"https://verifier.login.persona.org/v2")
-	body, err := json.Marshal(
-		util.Fields{"assertion": assertion,
-			"audience": audience})
-	if err != nil {
-		self.logger.Error(self.logCat,
-			"Could not marshal assertion",
-			util.Fields{"error": err.Error()})
-		return "", "", ErrAuthorization
-	}
-	if self.config.GetFlag("auth.show_assertion") {
-		fmt.Printf("### Validating Assertion:\n %s\n", body)
-	}
-	req, err := http.NewRequest("POST", validatorURL, bytes.NewReader(body))
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not POST assertion",
-			util.Fields{"error": err.Error()})
-		return "", "", err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	cli := http.Client{}
-	res, err := cli.Do(req)
-	if err != nil {
-		self.logger.Error(self.logCat, "Persona verification failed",
-			util.Fields{"error": err.Error()})
-		return "", "", ErrAuthorization
-	}
-
-	// Handle the verifier response
-	buffer, raw, err := parseBody(res.Body)
-	if isOk, ok := buffer["status"]; !ok || isOk != "okay" {
-		var errStr string
-		if err != nil {
-			errStr = err.Error()
-		} else if _, ok = buffer["reason"]; ok {
-			errStr = buffer["reason"].(string)
-		}
-		self.logger.Error(self.logCat, "Persona Auth Failed",
-			util.Fields{"error": errStr,
-				"body": raw})
-		return "", "", ErrAuthorization
-	}
-
-	// extract the email
-	if idp, ok := buffer["idpClaims"]; ok {
-		if fxe, ok := idp.(map[string]interface{})["fxa-verifiedEmail"]; ok {
-			email = fxe.(string)
-			userid = self.genHash(email)
-			return userid, email, nil
-		}
-	}
-
-	if email, ok = buffer["email"].(string); !ok {
-		self.logger.Error(self.logCat, "No email found in assertion",
-			util.Fields{"assertion": fmt.Sprintf("%+v", buffer)})
-		return "", "", ErrAuthorization
-	}
-	// and the userid, generating one if need be.
-	if _, ok = buffer["userid"].(string); !ok {
-		userid = self.genHash(email)
-	}
-	return userid, email, nil
-}
-
-func (self *Handler) verifyFxAAssertion(assertion string) (userid, email string, err error) {
-	if assLen := len(assertion); assLen != len(strings.Map(assertionFilter, assertion)) {
-		self.logger.Error(self.logCat, "Assertion contains invalid characters.",
-			util.Fields{"assertion": assertion})
-		return "", "", ErrAuthorization
-	}
-
-	// ******** DO NOT ENABLE auth.disabled FLAG IN PRODUCTION!! ******
-	if self.config.GetFlag("auth.disabled") {
-		self.logger.Warn(self.logCat, "!!! Skipping validation...", nil)
-		return self.extractFromAssertion(assertion)
-
-	}
-	cli := http.Client{}
-	validatorUrl := self.config.Get("fxa.verifier",
-		"https://oauth.accounts.firefox.com/authorization")
-	// fmt.Printf("### Sending to %s\n", validatorUrl)
-	args := make(map[string]string)
-	args["client_id"] = self.config.Get("fxa.client_id", "invalid")
-	args["assertion"] = assertion
-	if self.config.GetFlag("auth.audience_from_assertion") {
-		args["audience"] = self.extractAudience(assertion)
-		self.logger.Info(self.logCat, "Extracted Audience",
-			util.Fields{"audience": args["audience"]})
-	}
-	if self.config.GetFlag("auth.trim_audience") {
-		audUrl, err := url.Parse(args["audience"])
-		if err != nil {
-			self.logger.Warn(self.logCat, "Could not parse Audience",
-				util.Fields{"error": err.Error(),
-					"audience": args["audience"]})
-		} else {
-			args["audience"] = fmt.Sprintf("%s://%s/", audUrl.Scheme,
-				audUrl.Host)
-		}
-	}
-	if args["audience"] == "" {
-		args["audience"] = self.config.Get("fxa.audience",
-			"https://oauth.accounts.firefox.com/v1")
-	}
-	// State is a nonce useful for validation callbacks.
-	// Since we're not calling back, it's not necessary to
-	// check if the caller matches the recipient.
-	args["state"], _ = util.GenUUID4()
-
-	argsj, err := json.Marshal(args)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not marshal args",
-			util.Fields{"error": err.Error()})
-		return "", "", err
-	}
-	if self.config.GetFlag("auth.show_assertion") {
-		fmt.Printf("### Validating Assertion:\n %s\n", argsj)
-	}
-	// Send the assertion to the validator
-	req, err := http.NewRequest("POST", validatorUrl, bytes.NewReader(argsj))
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not POST verify assertion",
-			util.Fields{"error": err.Error()})
-		return "", "", err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	res, err := cli.Do(req)
-	if err != nil {
-		self.logger.Error(self.logCat, "FxA verification failed",
-			util.Fields{"error": err.Error()})
-		return "", "", err
-	}
-	buff, raw, err := parseBody(res.Body)
-	if err != nil {
-		return "", "", err
-	}
-	if code, ok := buff["code"]; ok && code.(float64) > 299.0 {
-		self.logger.Error(self.logCat, "FxA verification failed auth",
-			util.Fields{"code": strconv.FormatInt(int64(code.(float64)), 10),
-				"error": buff["error"].(string),
-				"body":  raw})
-		return "", "", err
-	}
-
-	// the response has either been a redirect or a validated assertion.
-	// fun times, fun times...
-	if idp, ok := buff["idpClaims"]; ok {
-		if email, ok := idp.(map[string]interface{})["fxa-verifiedEmail"]; ok {
-			return self.genHash(email.(string)), email.(string), nil
-		}
-	}
-	// get the "redirect" url. We're not going to redirect, just get the code.
-	if redir, ok := buff["redirect"]; !ok {
-		fmt.Printf("### Redirect: %s\n", raw)
-		self.logger.Error(self.logCat, "FxA verification did not return redirect",
-			nil)
-		return "", "", err
-	} else {
-		if vurl, err := url.Parse(redir.(string)); err != nil {
-			self.logger.Error(self.logCat, "FxA redirect url invalid",
-				util.Fields{"error": err.Error(), "url": redir.(string)})
-			return "", "", err
-		} else {
-			code := vurl.Query().Get("code")
-			if len(code) == 0 {
-				self.logger.Error(self.logCat, "FxA code not present",
-					util.Fields{"url": redir.(string)})
-				return "", "", ErrOauth
-			}
-			//Convert code to access token.
-			accessToken, err := self.getAccessToken(code)
-			if err != nil {
-				return "", "", ErrOauth
-			}
-			email, err := self.getUserEmail(accessToken)
-			if err != nil {
-				return "", "", ErrOauth
-			}
-			// fmt.Printf("### Verified FxA assertion: %s, %s\n", accessToken, email)
-			return self.genHash(email), email, nil
-		}
-	}
-}
-
 func (self *Handler) clearSession(sess *sessions.Session) (err error) {
 	if sess == nil {
 		return
@@ -413,16 +133,11 @@ func (self *Handler) initData(resp http.ResponseWriter, req *http.Request, sessi
 	data = &initDataStruct{}
 	self.logCat = "handler:initData"
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		return nil, err
-	}
-	defer store.Close()
-
 	// Get this from the config file?
 	data.ProductName = self.config.Get("productname", "Find My Device")
 
 	data.MapKey = self.config.Get("mapbox.key", "")
+	data.DevMode = devMode
 
 	// host information (for websocket callback)
 	data.Host = make(map[string]string)
@@ -437,7 +152,7 @@ func (self *Handler) initData(resp http.ResponseWriter, req *http.Request, sessi
 			sessionInfo.DeviceId = getDevFromUrl(req.URL)
 		}
 		if sessionInfo.DeviceId == "" {
-			data.DeviceList, err = store.GetDevicesForUser(data.UserId)
+			data.DeviceList, err = self.store.GetDevicesForUser(data.UserId)
 			if err != nil {
 				self.logger.Error(self.logCat, "Could not get user devices",
 					util.Fields{"error": err.Error(),
@@ -446,14 +161,20 @@ func (self *Handler) initData(resp http.ResponseWriter, req *http.Request, sessi
 			}
 		}
 		if sessionInfo.DeviceId != "" {
-			data.Device, err = store.GetDeviceInfo(sessionInfo.DeviceId)
+			data.Device, err = self.store.GetDeviceInfo(sessionInfo.DeviceId)
 			if err != nil {
 				self.logger.Error(self.logCat, "Could not get device info",
 					util.Fields{"error": err.Error(),
 						"deviceid": sessionInfo.DeviceId})
 				return nil, err
 			}
-			data.Device.PreviousPositions, err = store.GetPositions(sessionInfo.DeviceId)
+			if data.Device == nil || data.Device.User != data.UserId {
+				self.logger.Error(self.logCat, "Unauthorized device",
+					util.Fields{"deviceid": sessionInfo.DeviceId,
+						"userid": data.UserId})
+				return nil, ErrAuthorization
+			}
+			data.Device.PreviousPositions, err = self.store.GetPositions(sessionInfo.DeviceId)
 			if err != nil {
 				self.logger.Error(self.logCat,
 					"Could not get device's position information",
@@ -473,6 +194,12 @@ func (self *Handler) getUser(resp http.ResponseWriter, req *http.Request) (useri
 
 	var session *sessions.Session
 
+	// Scripts send an API token instead (see tokens.go).
+	if bearer := bearerToken(req); bearer != "" {
+		userid, err = self.getTokenUser(req, bearer)
+		return userid, "", err
+	}
+
 	session, err = sessionStore.Get(req, SESSION_NAME)
 	// fmt.Printf("### Your session is: %+v\n", session.Values)
 	if err != nil {
@@ -515,17 +242,14 @@ func (self *Handler) getUser(resp http.ResponseWriter, req *http.Request) (useri
 	// Nothing in the session,
 	var auth string
 	if auth = req.FormValue("assertion"); auth != "" {
-		if self.config.GetFlag("auth.persona") {
-			userid, email, err = self.verifyPersonaAssertion(auth)
-		} else {
-			userid, email, err = self.verifyFxAAssertion(auth)
+		ident, err := self.idp.Verify(auth)
+		if err != nil {
+			// error logged in verify
+			return "", "", ErrAuthorization
 		}
+		email = ident.Email
 	}
-	if err != nil {
-		// error logged in verify
-		return "", "", ErrAuthorization
-	}
-	if userid == "" && email != "" {
+	if email != "" {
 		userid = self.genHash(email)
 	}
 	self.logger.Info(self.logCat, "::Got User::",
@@ -565,18 +289,68 @@ func (self *Handler) getSessionInfo(resp http.ResponseWriter, req *http.Request,
 	return info, nil
 }
 
-// log the device's position reply
-func (self *Handler) updatePage(devId, cmd string, args map[string]interface{}, logPosition bool) (err error) {
-	var location storage.Position
-	var hasPasscode bool
+// Get the device named in the URL, making sure that it belongs to the
+// logged in user. On failure, the error response has been written, the
+// session cleared and devRec is nil.
+func (self *Handler) getOwnedDevice(resp http.ResponseWriter, req *http.Request) (devRec *storage.Device, userId string) {
+	return self.getOwnedDeviceById(resp, req, getDevFromUrl(req.URL))
+}
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
+// As getOwnedDevice, for a device id taken from elsewhere in the request.
+func (self *Handler) getOwnedDeviceById(resp http.ResponseWriter, req *http.Request, deviceId string) (devRec *storage.Device, userId string) {
+	session, err := sessionStore.Get(req, SESSION_NAME)
 	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
+		self.logger.Error(self.logCat, "Unauthorized access to device",
 			util.Fields{"error": err.Error()})
-		return err
+		http.Error(resp, "Unauthorized", 401)
+		return nil, ""
+	}
+
+	if deviceId == "" {
+		self.logger.Error(self.logCat, "Invalid call (No device id)", nil)
+		http.Error(resp, "Unauthorized", 401)
+		return nil, ""
+	}
+	userId, _, err = self.getUser(resp, req)
+	if userId == "" || err != nil {
+		self.logger.Error(self.logCat, "No userid", nil)
+		self.clearSession(session)
+		session.Options.MaxAge = -1
+		session.Save(req, resp)
+		http.Error(resp, "Unauthorized", 401)
+		return nil, ""
+	}
+
+	devRec, err = self.store.GetDeviceInfo(deviceId)
+	if err != nil || devRec == nil {
+		fields := util.Fields{"deviceId": deviceId}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		self.logger.Error(self.logCat, "Could not get device", fields)
+		self.clearSession(session)
+		session.Options.MaxAge = -1
+		session.Save(req, resp)
+		http.Error(resp, "Unauthorized", 401)
+		return nil, ""
 	}
-	defer store.Close()
+	if devRec.User != userId {
+		self.logger.Error(self.logCat, "Unauthorized device",
+			util.Fields{"devrec": devRec.User,
+				"userid": userId})
+		self.clearSession(session)
+		session.Options.MaxAge = -1
+		session.Save(req, resp)
+		http.Error(resp, "Unauthorized", 401)
+		return nil, ""
+	}
+	return devRec, userId
+}
+
+// log the device's position reply
+func (self *Handler) updatePage(devId, cmd string, args map[string]interface{}, logPosition bool) (err error) {
+	var location storage.Position
+	var hasPasscode bool
 
 	// Only record a location if there is one.
 	// Device reports OK:false on errors
@@ -597,6 +371,17 @@ func (self *Handler) updatePage(devId, cmd string, args map[string]interface{},
 				location.Longitude = arg.(float64)
 			case "al":
 				location.Altitude = arg.(float64)
+			case "ac":
+				location.Accuracy, _ = arg.(float64)
+			case "sp":
+				location.Speed, _ = arg.(float64)
+			case "he":
+				location.Heading, _ = arg.(float64)
+			case "ba":
+				location.Battery, _ = arg.(float64)
+			case "pr":
+				// gps, network, wifi
+				location.Provider, _ = arg.(string)
 			case "ti":
 				location.Time = int64(arg.(float64))
 				if location.Time == 0 {
@@ -605,17 +390,18 @@ func (self *Handler) updatePage(devId, cmd string, args map[string]interface{},
 				// has_lockcode
 			case "ha":
 				hasPasscode = isTrue(arg)
-				if err = store.SetDeviceLock(devId, hasPasscode); err != nil {
+				if err = self.store.SetDeviceLock(devId, hasPasscode); err != nil {
 					return err
 				}
 			}
 		}
 		if logPosition {
-			if err = store.SetDeviceLocation(devId, location); err != nil {
+			if err = self.store.SetDeviceLocation(devId, location); err != nil {
 				return err
 			}
+			self.checkGeofences(devId, location)
 			// because go sql locking.
-			store.GcPosition(devId)
+			self.store.GcPosition(devId)
 		}
 	}
 	location.Cmd = storage.Unstructured{cmd: args}
@@ -644,14 +430,7 @@ func (self *Handler) logReply(devId, cmd string, args replyType) (err error) {
 			return errors.New("Unknown error")
 		}
 		// log the state? (Device is currently cmd-ing)?
-		store, err := storage.Open(self.config, self.logger, self.metrics)
-		if err != nil {
-			self.logger.Error(self.logCat, "Could not open database",
-				util.Fields{"error": err.Error()})
-			return err
-		}
-		defer store.Close()
-		err = store.Touch(devId)
+		err = self.store.Touch(devId)
 	}
 	return err
 }
@@ -675,162 +454,220 @@ func (self *Handler) rangeCheck(s string, min, max int64) int64 {
 }
 
 // Verify the HAWK header value from the client
-func (self *Handler) verifyHawkHeader(req *http.Request, body []byte, devRec *storage.Device) bool {
+// Returns the request's Hawk values and the secret it was signed with,
+// for signing the response.
+func (self *Handler) verifyHawkHeader(resp http.ResponseWriter, req *http.Request, body []byte, devRec *storage.Device) (*Hawk, string, bool) {
 	var err error
 
 	if devRec == nil {
 		self.logger.Error(self.logCat, "Could not validate Hawk header: devRec is nil", nil)
-		return false
+		return nil, "", false
 	}
 
 	if self.config.GetFlag("hawk.disabled") {
-		return true
+		return nil, "", true
+	}
+	secrets := devRec.HawkSecrets(time.Now().UTC().Unix())
+	if len(secrets) == 0 {
+		self.logger.Warn(self.logCat, "Device credentials revoked",
+			util.Fields{"deviceId": devRec.ID})
+		self.metrics.Increment("hawk.revoked")
+		return nil, "", false
 	}
 	// Remote Hawk
 	rhawk := Hawk{logger: self.logger, config: self.config}
 	// Local Hawk
-	lhawk := Hawk{logger: self.logger, config: self.config}
+	var lhawk Hawk
 	// Get the remote signature from the header
 	err = rhawk.ParseAuthHeader(req, self.logger)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not parse Hawk header",
 			util.Fields{"error": err.Error()})
-		return false
+		return nil, "", false
 	}
 
-	// Generate the comparator signature from what we know.
-	lhawk.Nonce = rhawk.Nonce
-	lhawk.Time = rhawk.Time
-	//lhawk.Hash = rhawk.Hash
+	// Does the body match the hash the client signed?
+	if err = rhawk.VerifyPayload(req.Header.Get("Content-Type"),
+		body); err != nil {
+		self.logger.Error(self.logCat, "Invalid Hawk payload hash",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		self.metrics.Increment("hawk.bad_hash")
+		return nil, "", false
+	}
 
-	err = lhawk.GenerateSignature(req, rhawk.Extra, string(body),
-		devRec.Secret)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not verify sig",
-			util.Fields{"error": err.Error()})
-		return false
+	// Generate the comparator signature from what we know, with each
+	// secret the device may be using. (The previous one only while it
+	// is being rotated out.)
+	var secret string
+	for _, candidate := range secrets {
+		lhawk = Hawk{logger: self.logger, config: self.config}
+		lhawk.Nonce = rhawk.Nonce
+		lhawk.Time = rhawk.Time
+		lhawk.Hash = rhawk.Hash
+
+		err = lhawk.GenerateSignature(req, rhawk.Extra, string(body),
+			candidate)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not verify sig",
+				util.Fields{"error": err.Error()})
+			return nil, "", false
+		}
+		// Do they match?
+		if lhawk.Compare(rhawk.Signature) {
+			secret = candidate
+			break
+		}
 	}
-	// Do they match?
-	if !lhawk.Compare(rhawk.Signature) {
+	if secret == "" {
 		self.logger.Error(self.logCat, "Cmd:Invalid Hawk Signature",
 			util.Fields{
 				"expecting": lhawk.Signature,
 				"got":       rhawk.Signature,
 			})
-		return false
+		return nil, "", false
+	}
+	// Is it recent? (hawk.skew of 0 turns this off.)
+	skew := configInt(self.config, "hawk.skew", 60)
+	window := int64(86400)
+	if skew > 0 {
+		if err = rhawk.CheckTime(skew); err != nil {
+			self.logger.Warn(self.logCat, "Stale Hawk timestamp",
+				util.Fields{"ts": rhawk.Time,
+					"deviceId": devRec.ID})
+			self.metrics.Increment("hawk.stale")
+			// Tell the client what time it is.
+			resp.Header().Set("WWW-Authenticate",
+				StaleTimestampHeader(secret))
+			return nil, "", false
+		}
+		// Nonces only need remembering while their timestamp is good.
+		window = 2 * skew
+	}
+	// Has it been seen before? (Keyed on the device the MAC was checked
+	// against: the header's id isn't signed, so a replay could change it.)
+	fresh, err := self.nonces.Use(devRec.ID, rhawk.Nonce, window)
+	if err != nil || !fresh {
+		self.logger.Warn(self.logCat, "Replayed Hawk nonce",
+			util.Fields{"nonce": rhawk.Nonce,
+				"deviceId": devRec.ID})
+		self.metrics.Increment("hawk.replay")
+		return nil, "", false
+	}
+	// A request signed with the new secret ends the rotation.
+	if secret == devRec.Secret && devRec.PrevSecret != "" {
+		if err = self.store.DropPrevSecret(devRec.ID); err == nil {
+			self.logger.Info(self.logCat, "Device secret rotated",
+				util.Fields{"deviceId": devRec.ID})
+			self.metrics.Increment("hawk.rotated")
+		}
 	}
-	return true
+	return &rhawk, secret, true
 }
 
-// A simple signature generator for WS connections
-// Unfortunately, remote IP is not reliable for WS.
-func (self *Handler) genSig(req *http.Request, devId string) (ret string, err error) {
-	session, _ := sessionStore.Get(req, SESSION_NAME)
-	if sess, ok := session.Values["deviceid"]; !ok {
-		return "", errors.New("Invalid")
-	} else {
-		sig := self.genHash(sess.(string) +
-			session.Values["userid"].(string))
-		/*
-		   fmt.Printf("@@@ Remote Addr: %s, %s, %s\n",
-		       req.RemoteAddr,
-		       req.Header.Get("X-Real-IP"),
-		       req.Header.Get("X-Forwarded-For"))
-		*/
-		return sig, nil
+// The user id in the request's session cookie. ("" if not signed in.)
+func (self *Handler) sessionUserId(req *http.Request) string {
+	session, err := sessionStore.Get(req, SESSION_NAME)
+	if err != nil {
+		return ""
 	}
+	if userId, ok := session.Values[SESSION_USERID].(string); ok && userId != "" {
+		return userId
+	}
+	if email, ok := session.Values[SESSION_EMAIL].(string); ok && email != "" {
+		return self.genHash(email)
+	}
+	return ""
 }
 
-// Check the simple WS signature against the second to last item
-func (self *Handler) checkSig(req *http.Request, devId string) (ok bool) {
-
-	return true
-
-	bits := strings.Split(req.URL.Path, "/")
-	// remember, leading "/" counts.
-	gotsig := bits[len(bits)-2]
-	testsig, err := self.genSig(req, devId)
-	if err != nil {
-		return false
+// (Never with an empty key: anyone could forge the tokens.)
+func (self *Handler) wsTokenMac(devId, userId string, expires int64) (string, error) {
+	secret := self.config.Get("session.secret", "")
+	if secret == "" {
+		self.logger.Error(self.logCat, ErrNoSecret.Error(), nil)
+		return "", ErrNoSecret
 	}
-	return testsig == gotsig
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "ws\n%s\n%s\n%d\n", devId, userId, expires)
+	return hex.EncodeToString(mac.Sum(nil)), nil
 }
 
-// get the OAuth2 Access token
-func (self *Handler) getAccessToken(code string) (accessToken string, err error) {
-	token_url := self.config.Get("fxa.token", OAUTH_ENDPOINT+"/v1/token")
-	vals := make(map[string]string)
-	vals["client_id"] = self.config.Get("fxa.client_id", "invalid")
-	vals["client_secret"] = self.config.Get("fxa.client_secret", "invalid")
-	vals["code"] = code
-	vd, err := json.Marshal(vals)
+// Generate the token for a device's socket URL (/<ver>/ws/<token>/<devid>)
+// for the signed in user. It is good for ws.token_ttl seconds:
+// <expires>.<hex HMAC-SHA256 of device, user and expiry>
+// Unfortunately, remote IP is not reliable for WS.
+func (self *Handler) genSig(req *http.Request, devId string) (ret string, err error) {
+	userId := self.sessionUserId(req)
+	if userId == "" {
+		return "", errors.New("Invalid")
+	}
+	expires := time.Now().UTC().Unix() +
+		configInt(self.config, "ws.token_ttl", 300)
+	mac, err := self.wsTokenMac(devId, userId, expires)
 	if err != nil {
-		self.logger.Error(self.logCat, "Could not marshal vals to json",
-			util.Fields{"error": err.Error()})
 		return "", err
 	}
-	// fmt.Printf("### sending to %s\n %s\n", token_url, vd)
-	req, err := http.NewRequest("POST", token_url, bytes.NewBuffer(vd))
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not get oauth token",
-			util.Fields{"code": code, "error": err.Error()})
-		return "", ErrOauth
+	return fmt.Sprintf("%d.%s", expires, mac), nil
+}
+
+// Check the WS token (the second to last item of the path), and that
+// the signed in user owns the device.
+func (self *Handler) checkSig(req *http.Request, devRec *storage.Device) (ok bool) {
+	userId := self.sessionUserId(req)
+	if userId == "" || devRec.User != userId {
+		return false
 	}
-	req.Header.Add("Content-Type", "application/json")
-	cli := http.DefaultClient
-	res, err := cli.Do(req)
-	if err != nil {
-		self.logger.Error(self.logCat, "Access Token Fetch failed",
-			util.Fields{"error": err.Error()})
-		return "", err
+	bits := strings.Split(strings.TrimRight(req.URL.Path, "/"), "/")
+	if len(bits) < 2 {
+		return false
+	}
+	// remember, leading "/" counts.
+	token := strings.SplitN(bits[len(bits)-2], ".", 2)
+	if len(token) != 2 {
+		return false
 	}
-	reply, raw, err := parseBody(res.Body)
-	if code, ok := reply["code"]; ok && code.(float64) > 299.0 {
-		self.logger.Error(self.logCat, "FxA Access token failure",
-			util.Fields{"code": strconv.FormatFloat(code.(float64), 'f', 1, 64),
-				"body": raw})
-		return "", ErrOauth
+	expires, err := strconv.ParseInt(token[0], 10, 64)
+	if err != nil || time.Now().UTC().Unix() > expires {
+		return false
 	}
-	token, ok := reply["access_token"]
-	if !ok {
-		self.logger.Error(self.logCat, "OAuth Access token missing from reply",
-			util.Fields{"code": code})
-		return "", ErrOauth
+	mac, err := self.wsTokenMac(devRec.ID, userId, expires)
+	if err != nil {
+		return false
 	}
-	return token.(string), nil
+	return hmac.Equal([]byte(token[1]), []byte(mac))
 }
 
-// Get the user's Email from the profile server using the OAuth2 access token
-func (self *Handler) getUserEmail(accessToken string) (email string, err error) {
-	client := http.DefaultClient
-	url := self.config.Get("fxa.content.endpoint", CONTENT_ENDPOINT) + "/email"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not POST to get email",
-			util.Fields{"error": err.Error()})
-		return "", err
-	}
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-	// fmt.Printf("### Sending email request to profile server\n%+v\n", req)
-	resp, err := client.Do(req)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not get user email",
-			util.Fields{"error": err.Error()})
-		return "", err
+// The origins that may open sockets: ws.origins (comma separated), or
+// the site at ws_hostname.
+func (self *Handler) wsOrigins() (origins []string) {
+	for _, origin := range strings.Split(self.config.Get("ws.origins", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimRight(origin, "/"))
+		}
 	}
-	buffer, raw, err := parseBody(resp.Body)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not parse body",
-			util.Fields{"error": err.Error()})
-		return "", err
+	if len(origins) == 0 {
+		proto := "https"
+		if self.config.Get("ws_proto", "wss") == "ws" {
+			proto = "http"
+		}
+		origins = append(origins, proto+"://"+
+			self.config.Get("ws_hostname", "localhost"))
 	}
-	if _, ok := buffer["email"]; !ok {
-		self.logger.Error(self.logCat, "Response did not contain email",
-			util.Fields{"body": raw})
-		return "", ErrNoUser
+	return origins
+}
+
+// Refuse socket handshakes from pages on other sites.
+func (self *Handler) checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	for _, allowed := range self.wsOrigins() {
+		if origin != "" && strings.EqualFold(origin, allowed) {
+			return nil
+		}
 	}
-	// fmt.Printf("### Got email! %s\n", buffer["email"].(string))
-	return buffer["email"].(string), nil
+	self.logger.Warn("handler:Socket", "Socket from unknown origin",
+		util.Fields{"origin": origin})
+	self.metrics.Increment("socket.bad_origin")
+	return ErrBadOrigin
 }
 
 // Generate a hash from the string.
@@ -842,14 +679,11 @@ func (self *Handler) genHash(input string) (output string) {
 
 //Handler Public Functions
 
-func NewHandler(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) *Handler {
-	store, err := storage.Open(config, logger, metrics)
-	if err != nil {
-		logger.Error("Handler", "Could not open storage",
-			util.Fields{"error": err.Error()})
+func NewHandler(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics, store storage.Storage) *Handler {
+	if store == nil {
+		logger.Error("Handler", "No storage defined.", nil)
 		return nil
 	}
-	defer store.Close()
 
 	sessionSecret := config.Get("session.secret", "")
 	if sessionSecret == "" {
@@ -877,14 +711,26 @@ func NewHandler(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Me
 		//MaxAge: 3600 * 24,
 	}
 
-	// Initialize the data store once. This creates tables and
-	// applies required changes.
-	store.Init()
+	var err error
+	if pushHTTP, err = NewPushClient(config, metrics); err != nil {
+		logger.Error("Handler", "Could not set up push client",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
+	idp, err := NewIdentityProvider(config, logger, metrics)
+	if err != nil {
+		logger.Error("Handler", "Could not set up identity provider",
+			util.Fields{"error": err.Error()})
+		return nil
+	}
 
 	return &Handler{config: config,
 		logger:  logger,
 		logCat:  "handler",
-		metrics: metrics}
+		metrics: metrics,
+		store:   store,
+		nonces:  NewNonceCache(config, store),
+		idp:     idp}
 }
 
 // Register a new device
@@ -895,10 +741,14 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 	var email string
 	var user string
 	var pushUrl string
+	var pushType string
+	var pushKey string
+	var pushAuth string
 	var deviceid string
 	var devRec *storage.Device
 	var secret string
 	var accepts string
+	var capabilities string
 	var hasPasscode bool
 	var loggedIn bool
 	var err error
@@ -909,15 +759,6 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 	// Do not set a session here. Use HAWK and URL to validate future
 	// calls from the device.
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	defer store.Close()
-
 	buffer, raw, err = parseBody(req.Body)
 	if err != nil {
 		http.Error(resp, "No body", http.StatusBadRequest)
@@ -931,7 +772,7 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 			if len(deviceid) > 32 {
 				deviceid = deviceid[:32]
 			}
-			devRec, err = store.GetDeviceInfo(deviceid)
+			devRec, err = self.store.GetDeviceInfo(deviceid)
 			if err != nil {
 				self.logger.Warn(self.logCat, "Could not get info for deviceid",
 					util.Fields{"deviceid": deviceid,
@@ -939,26 +780,24 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if assertion, ok := buffer["assert"]; ok {
-			if self.config.GetFlag("auth.persona") {
-				userid, email, err = self.verifyPersonaAssertion(assertion.(string))
-			} else {
-				userid, email, err = self.verifyFxAAssertion(assertion.(string))
-			}
-			if err != nil || userid == "" {
+			var ident *Identity
+			if ident, err = self.idp.Verify(assertion.(string)); err != nil || ident.Email == "" {
 				http.Error(resp, "Unauthorized", 401)
 				return
 			}
+			email = ident.Email
+			userid = self.genHash(email)
 			self.logger.Debug(self.logCat, "Got user "+email, nil)
 			loggedIn = true
 		} else {
 			self.logger.Warn(self.logCat, "Missing 'assert' value",
 				util.Fields{"body": raw})
 			// Use HAWK + deviceid to determine if this is a re-registration.
-			if hv := self.verifyHawkHeader(req, []byte(raw), devRec); devRec != nil && hv {
+			if _, _, hv := self.verifyHawkHeader(resp, req, []byte(raw), devRec); devRec != nil && hv {
 				self.logger.Info(self.logCat,
 					"Hawk Verified, getting user info ...\n",
 					nil)
-				if userid, user, err = store.GetUserFromDevice(deviceid); err == nil {
+				if userid, user, err = self.store.GetUserFromDevice(deviceid); err == nil {
 					self.logger.Debug(self.logCat,
 						"Got user info ",
 						util.Fields{"userid": userid,
@@ -983,6 +822,34 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 		} else {
 			pushUrl = val.(string)
 		}
+		pushType = storage.PUSH_SIMPLEPUSH
+		if val, ok := buffer["pushtype"].(string); ok && val != "" {
+			pushType = strings.ToLower(val)
+		}
+		if !validPushType(pushType) {
+			self.logger.Error(self.logCat, "Unknown push type",
+				util.Fields{"pushtype": pushType})
+			http.Error(resp, "Bad Data", 400)
+			return
+		}
+		if err = checkPushUrl(self.config, pushUrl, pushType); err != nil {
+			self.logger.Error(self.logCat, "Unusable push url",
+				util.Fields{"error": err.Error(),
+					"pushUrl": pushUrl})
+			http.Error(resp, "Bad Data", 400)
+			return
+		}
+		// Web Push subscription keys, needed to send a payload.
+		if keys, ok := buffer["pushkeys"].(map[string]interface{}); ok {
+			pushKey, _ = keys["p256dh"].(string)
+			pushAuth, _ = keys["auth"].(string)
+			if err = validPushKeys(pushKey, pushAuth); err != nil {
+				self.logger.Error(self.logCat, "Invalid push keys",
+					util.Fields{"error": err.Error()})
+				http.Error(resp, "Bad Data", 400)
+				return
+			}
+		}
 		//ALWAYS generate a new secret on registration!
 		secret = GenNonce(16)
 		if val, ok := buffer["has_passcode"]; !ok {
@@ -1006,6 +873,9 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 		if len(accepts) == 0 {
 			accepts = "elrth"
 		}
+		if val, ok := buffer["capabilities"]; ok {
+			capabilities = parseCapabilities(val)
+		}
 		if !strings.Contains("h", accepts) {
 			accepts = accepts + "h"
 		}
@@ -1015,15 +885,19 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 		if user == "" {
 			user = strings.SplitN(email, "@", 2)[0]
 		}
-		if devId, err = store.RegisterDevice(
+		if devId, err = self.store.RegisterDevice(
 			userid,
 			storage.Device{
-				ID:          deviceid,
-				Name:        user,
-				Secret:      secret,
-				PushUrl:     pushUrl,
-				HasPasscode: hasPasscode,
-				Accepts:     accepts,
+				ID:           deviceid,
+				Name:         user,
+				Secret:       secret,
+				PushUrl:      pushUrl,
+				PushType:     pushType,
+				PushKey:      pushKey,
+				PushAuth:     pushAuth,
+				HasPasscode:  hasPasscode,
+				Accepts:      accepts,
+				Capabilities: capabilities,
 			}); err != nil {
 			self.logger.Error(self.logCat, "Error Registering device", nil)
 			http.Error(resp, "Bad Request", 400)
@@ -1061,17 +935,11 @@ func (self *Handler) Register(resp http.ResponseWriter, req *http.Request) {
 func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	var err error
 	var l int
+	var reqHawk *Hawk
+	var hawkSecret string
 
 	self.logCat = "handler:Cmd"
 	resp.Header().Set("Content-Type", "application/json")
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	defer store.Close()
 
 	// fmt.Printf("### req.URL: %s", req.URL)
 	deviceId := getDevFromUrl(req.URL)
@@ -1081,7 +949,7 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	devRec, err := store.GetDeviceInfo(deviceId)
+	devRec, err := self.store.GetDeviceInfo(deviceId)
 	if err != nil {
 		switch err {
 		case storage.ErrUnknownDevice:
@@ -1111,7 +979,8 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	}
 	//validate the Hawk header
 	if self.config.GetFlag("hawk.disabled") == false {
-		if !self.verifyHawkHeader(req, body, devRec) {
+		var ok bool
+		if reqHawk, hawkSecret, ok = self.verifyHawkHeader(resp, req, body, devRec); !ok {
 			http.Error(resp, "Unauthorized", 401)
 			return
 		}
@@ -1158,14 +1027,16 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 			// handle the client response
 			switch string(c[0]) {
 			case "l", "r", "m", "e", "h":
-				err = store.Touch(deviceId)
+				err = self.store.Touch(deviceId)
 				self.updatePage(deviceId, c, margs, false)
+				self.ackCommand(deviceId, cs, args)
 			case "t":
 				err = self.updatePage(deviceId, c, margs, true)
+				self.ackCommand(deviceId, cs, args)
 			case "q":
 				// User has quit, nuke what we know.
 				if self.config.GetFlag("cmd.q.allow") {
-					err = store.DeleteDevice(deviceId)
+					err = self.store.DeleteDevice(deviceId)
 				}
 			}
 			if err != nil {
@@ -1184,24 +1055,47 @@ func (self *Handler) Cmd(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	// reply with pending commands
-	//
-	cmd, err := store.GetPending(deviceId)
-	var output = []byte(cmd)
+	// Devices that registered with the "batch" capability get every
+	// pending command (up to cmd.batch_max) as a JSON array, oldest
+	// first. Everyone else gets one command object per poll.
+	batch := devRec.Can(storage.CAP_BATCH)
+	limit := 1
+	if batch {
+		limit = self.batchMax()
+	}
+	commands, err := self.store.GetPending(deviceId, limit)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not send commands",
 			util.Fields{"error": err.Error()})
 		http.Error(resp, "\"Server Error\"", http.StatusServiceUnavailable)
+		return
+	}
+	var output []byte
+	if batch {
+		cmds := make([]string, len(commands))
+		for n, c := range commands {
+			cmds[n] = c.Cmd
+		}
+		output = []byte("[" + strings.Join(cmds, ",") + "]")
+	} else if len(commands) > 0 {
+		output = []byte(commands[0].Cmd)
 	}
 	if output == nil || len(output) < 2 {
 		output = []byte("{}")
 	}
-	hawk := Hawk{config: self.config, logger: self.logger}
-	authHeader := hawk.AsHeader(req, devRec.ID, string(output),
-		"", devRec.Secret)
-	resp.Header().Add("Authorization", authHeader)
-	// total cheat to get the command without parsing the cmd data.
-	if len(cmd) > 2 {
-		self.metrics.Increment("cmd.send." + string(cmd[2]))
+	// A device still signing with its old secret is handed the new
+	// one (see credentials.go).
+	if hawkSecret != "" && hawkSecret != devRec.Secret {
+		output = withNewSecret(output, batch, devRec.Secret)
+	}
+	// Sign the reply to the device's request, with the secret it used.
+	if reqHawk != nil {
+		resp.Header().Set("Server-Authorization",
+			reqHawk.ResponseHeader(resp.Header().Get("Content-Type"),
+				output, "", hawkSecret))
+	}
+	for _, c := range commands {
+		self.metrics.Increment("cmd.send." + c.Type)
 	}
 	if self.config.GetFlag("debug.show_output") {
 		fmt.Printf(">>>%s:%s\n", self.logCat, string(output))
@@ -1299,15 +1193,11 @@ func (self *Handler) Queue(devRec *storage.Device, cmd string, args, rep *replyT
 		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
 	}
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+	var expires int64
+	if ttl := self.commandTTL(c); ttl > 0 {
+		expires = time.Now().Unix() + ttl
 	}
-	defer store.Close()
-
-	err = store.StoreCommand(deviceId, string(fixed))
+	cmdId, err := self.store.StoreCommand(deviceId, c, string(fixed), expires)
 	if err != nil {
 		// Log the error
 		self.logger.Error(self.logCat, "Error storing command",
@@ -1319,14 +1209,38 @@ func (self *Handler) Queue(devRec *storage.Device, cmd string, args, rep *replyT
 	}
 	// trigger the push
 	self.metrics.Increment("cmd.store." + c)
+	if devRec.PushGone {
+		// The device has to re-register before it can be woken again.
+		self.store.SetCommandState(deviceId, cmdId, storage.CMD_QUEUED,
+			"push endpoint gone")
+		return http.StatusGone, errors.New("\"Device push endpoint gone\"")
+	}
 	self.metrics.Increment("push.send")
-	err = SendPush(devRec, self.config)
+	err = SendPush(devRec, self.config, pushPayload(cmdId))
+	if err == ErrPushGone {
+		self.logger.Warn(self.logCat, "Push endpoint gone",
+			util.Fields{"deviceId": deviceId,
+				"pushUrl": devRec.PushUrl})
+		self.metrics.Increment("push.gone")
+		self.store.SetPushGone(deviceId)
+		self.store.SetCommandState(deviceId, cmdId, storage.CMD_QUEUED,
+			"push endpoint gone")
+		return http.StatusGone, errors.New("\"Device push endpoint gone\"")
+	}
+	(*rep)["id"] = cmdId
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not send Push",
 			util.Fields{"error": err.Error(),
 				"pushUrl": devRec.PushUrl})
-		return http.StatusServiceUnavailable, errors.New("\"Server Error\"")
+		// The command is stored; retry the push in the background.
+		// (The device may also pick it up on its next check in.)
+		self.metrics.Increment("push.fail")
+		self.queuePush(deviceId, cmdId, expires, err)
+		(*rep)["state"] = storage.CMD_QUEUED
+		return
 	}
+	// (No-op if the device already checked in and took the command.)
+	self.store.SetCommandState(deviceId, cmdId, storage.CMD_PUSHED, "")
 	return
 }
 
@@ -1341,87 +1255,13 @@ func (self *Handler) RestQueue(resp http.ResponseWriter, req *http.Request) {
 	rep := make(replyType)
 	self.logCat = "handler:Queue"
 
-	session, err := sessionStore.Get(req, SESSION_NAME)
-	if err != nil {
-		self.logger.Error(self.logCat, "Unauthorized access to Cmd",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	defer store.Close()
-
-	deviceId := getDevFromUrl(req.URL)
-	if deviceId == "" {
-		self.logger.Error(self.logCat, "Invalid call (No device id)", nil)
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
-	userId, _, err := self.getUser(resp, req)
-	if userId == "" || err != nil {
-		self.logger.Error(self.logCat, "No userid", nil)
-		self.clearSession(session)
-		session.Options.MaxAge = -1
-		session.Save(req, resp)
-		http.Error(resp, "Unauthorized", 401)
+	if req.Method == "DELETE" {
+		self.cancelCommand(resp, req)
 		return
 	}
 
-	devRec, err := store.GetDeviceInfo(deviceId)
-	// fmt.Printf("### devices: %+v\n", devRec)
-	if err != nil || devRec == nil {
-		fields := util.Fields{"deviceId": deviceId}
-		if err != nil {
-			fields["error"] = err.Error()
-		}
-		if devRec != nil {
-			fields["devRec"] = devRec.ID
-		}
-		self.logger.Error(self.logCat, "Could not get userid", fields)
-		self.clearSession(session)
-		session.Options.MaxAge = -1
-		session.Save(req, resp)
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
-	if devRec.User != userId {
-		self.logger.Error(self.logCat, "Unauthorized device",
-			util.Fields{"devrec": devRec.User,
-				"userid": userId})
-		self.clearSession(session)
-		session.Options.MaxAge = -1
-		session.Save(req, resp)
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
+	devRec, _ := self.getOwnedDevice(resp, req)
 	if devRec == nil {
-		self.logger.Error(self.logCat,
-			"Queue:User requested unknown device",
-			util.Fields{
-				"deviceId": deviceId,
-				"userId":   userId})
-		self.clearSession(session)
-		session.Options.MaxAge = -1
-		session.Save(req, resp)
-		http.Error(resp, "Unauthorized", 401)
-		return
-	}
-	if err != nil {
-		switch err {
-		default:
-			self.logger.Error(self.logCat,
-				"Cmd:Unhandled Error",
-				util.Fields{
-					"error":    err.Error(),
-					"deviceId": deviceId})
-			http.Error(resp, "Unauthorized", 401)
-		}
 		return
 	}
 
@@ -1479,7 +1319,7 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 	type devList struct {
 		ID   string
 		Name string
-		URL  string
+		URL  string `json:",omitempty"` // socket, for the signed in UI
 	}
 
 	var data struct {
@@ -1495,15 +1335,6 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 		//TODO: return error, clear cookie?
 		return
 	}
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat,
-			"Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	defer store.Close()
 
 	sessionInfo, err := self.getSessionInfo(resp, req, session)
 	if err == nil && len(sessionInfo.UserId) > 0 {
@@ -1516,7 +1347,7 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	deviceList, err := store.GetDevicesForUser(data.UserId)
+	deviceList, err := self.store.GetDevicesForUser(data.UserId)
 	if err != nil {
 		self.logger.Error(self.logCat,
 			"Could not get devices for user",
@@ -1529,19 +1360,21 @@ func (self *Handler) UserDevices(resp http.ResponseWriter, req *http.Request) {
 	verRoot := strings.SplitN(self.config.Get("VERSION", "0"), ".", 2)[0]
 
 	for _, d := range deviceList {
-		sig, err := self.genSig(req, d.ID)
-		if err != nil {
-			continue
-		}
-		reply = append(reply, devList{
-			ID:   d.ID,
-			Name: d.Name,
-			URL: fmt.Sprintf("%s://%s/%s/ws/%s/%s",
+		entry := devList{ID: d.ID, Name: d.Name}
+		// Sockets need a session, so API token callers only get the list.
+		if bearerToken(req) == "" {
+			sig, err := self.genSig(req, d.ID)
+			if err != nil {
+				continue
+			}
+			entry.URL = fmt.Sprintf("%s://%s/%s/ws/%s/%s",
 				self.config.Get("ws_proto", "wss"),
 				self.config.Get("ws_hostname", "localhost"),
 				verRoot,
 				sig,
-				d.ID)})
+				d.ID)
+		}
+		reply = append(reply, entry)
 	}
 	breply, err := json.Marshal(map[string][]devList{
 		"devices": reply})
@@ -1673,15 +1506,6 @@ func (self *Handler) State(resp http.ResponseWriter, req *http.Request) {
 
 	resp.Header().Set("Content-Type", "application/json")
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	defer store.Close()
-
 	session, err := sessionStore.Get(req, SESSION_NAME)
 	if err != nil {
 		self.logger.Error(self.logCat, "Could not get session info",
@@ -1689,25 +1513,29 @@ func (self *Handler) State(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, err.Error(), 500)
 	}
 	sessionInfo, err := self.getSessionInfo(resp, req, session)
-	if err != nil && err != ErrNoUser {
+	if err != nil {
 		session.Options.MaxAge = -1
 		session.Save(req, resp)
 		http.Error(resp, err.Error(), 401)
 		return
 	}
-	devInfo, err := store.GetDeviceInfo(sessionInfo.DeviceId)
+	devInfo, err := self.store.GetDeviceInfo(sessionInfo.DeviceId)
 	if err != nil {
 		http.Error(resp, err.Error(), 500)
 		return
 	}
-	// add the user session cookie
-	if sessionInfo != nil {
+	if devInfo == nil || devInfo.User != sessionInfo.UserId {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+	// add the user session cookie (API token users don't get one)
+	if bearerToken(req) == "" {
 		session.Values[SESSION_USERID] = sessionInfo.UserId
 		session.Values[SESSION_DEVICEID] = sessionInfo.DeviceId
 		session.Values[SESSION_EMAIL] = sessionInfo.Email
 		session.Values[SESSION_TOKEN] = sessionInfo.AccessToken
+		session.Save(req, resp)
 	}
-	session.Save(req, resp)
 	// display the device info...
 	reply, err := json.Marshal(devInfo)
 	if err == nil {
@@ -1728,6 +1556,9 @@ func (self *Handler) Status(resp http.ResponseWriter, req *http.Request) {
 		"goroutines": runtime.NumGoroutine(),
 		"version":    self.config.Get("VERSION", "unknown"),
 	}
+	if pushHTTP != nil {
+		reply["push"] = pushHTTP.Status()
+	}
 	rep, _ := json.Marshal(reply)
 	if self.config.GetFlag("debug.show_output") {
 		fmt.Printf(">>>%s:%s\n", self.logCat, string(rep))
@@ -1790,19 +1621,12 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 		nonce = ni.(string)
 	}
 
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		return
-	}
-	defer store.Close()
-
-	if ok, err := store.CheckNonce(nonce); !ok || err != nil {
+	if ok, err := self.store.CheckNonce(nonce); !ok || err != nil {
 		self.logger.Error(self.logCat, "Invalid Nonce", nil)
 		http.Redirect(resp, req, "/", http.StatusFound)
 		return
 	}
+	verifier, _ := loginSession.Values["verifier"].(string)
 	// Nuke the login session cookie
 	loginSession.Options.MaxAge = -1
 	loginSession.Save(req, resp)
@@ -1812,7 +1636,6 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 		// get the "state", and "code"
 		state := req.FormValue("state")
 		code := req.FormValue("code")
-		// TODO: check "state" matches magic code thingy
 		if state == "" {
 			self.logger.Error(self.logCat, "No State", nil)
 			http.Redirect(resp, req, "/", http.StatusFound)
@@ -1829,30 +1652,16 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 			return
 		}
 
-		// fetch the token:
-		// fmt.Printf("### Getting access token\n")
-		token, err := self.getAccessToken(code)
-		if err != nil {
-			self.logger.Error(self.logCat, "Could not get access token",
-				util.Fields{"error": err.Error()})
-			http.Redirect(resp, req, "/", http.StatusFound)
-			return
-		}
-		// fmt.Printf("### store user token %s\n", token)
-		delete(session.Values, SESSION_EMAIL)
-		session.Values[SESSION_TOKEN] = token
-	}
-	if _, ok := session.Values[SESSION_EMAIL]; !ok {
-		// fmt.Printf("### Getting user email from access token\n")
-		email, err := self.getUserEmail(session.Values[SESSION_TOKEN].(string))
+		ident, err := self.idp.Exchange(code, verifier, self.genHash(nonce))
 		if err != nil {
-			self.logger.Error(self.logCat, "Could not get email",
+			self.logger.Error(self.logCat, "Could not sign in",
 				util.Fields{"error": err.Error()})
+			self.metrics.Increment("page.signin.failed")
 			http.Redirect(resp, req, "/", http.StatusFound)
 			return
 		}
-		session.Values[SESSION_EMAIL] = email
-		// fmt.Printf("### Saving session %+v\n", session)
+		session.Values[SESSION_TOKEN] = ident.AccessToken
+		session.Values[SESSION_EMAIL] = ident.Email
 		// awesome. So saving the session apparently doesn't mean it's
 		// readable by subsequent session get calls.
 		session.Save(req, resp)
@@ -1865,27 +1674,21 @@ func (self *Handler) OAuthCallback(resp http.ResponseWriter, req *http.Request)
 // Handle Websocket processing.
 func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
 	self.logCat = "handler:Socket"
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		return
-	}
-	defer store.Close()
 
 	self.devId = getDevFromUrl(ws.Request().URL)
-	if !self.checkSig(ws.Request(), self.devId) {
-		self.logger.Error(self.logCat, "Unauthorized access.",
-			nil)
-		return
-	}
-	devRec, err := store.GetDeviceInfo(self.devId)
+	devRec, err := self.store.GetDeviceInfo(self.devId)
 	if err != nil {
 		self.logger.Error(self.logCat, "Invalid Device for socket",
 			util.Fields{"error": err.Error(),
 				"devId": self.devId})
 		return
 	}
+	if !self.checkSig(ws.Request(), devRec) {
+		self.logger.Error(self.logCat, "Unauthorized access.",
+			util.Fields{"devId": self.devId})
+		self.metrics.Increment("socket.unauthorized")
+		return
+	}
 
 	sock := &WWS{
 		Socket:  ws,
@@ -1934,63 +1737,42 @@ func (self *Handler) WSSocketHandler(ws *websocket.Conn) {
 	rmClient(deviceId)
 }
 
-func (self *Handler) Signin(resp http.ResponseWriter, req *http.Request) {
-	store, err := storage.Open(self.config, self.logger, self.metrics)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open database",
-			util.Fields{"error": err.Error()})
-		http.Error(resp, "Server error", 500)
-		return
+// The socket server, checking the origin of each handshake.
+func (self *Handler) WSServer() websocket.Server {
+	return websocket.Server{
+		Handler:   websocket.Handler(self.WSSocketHandler),
+		Handshake: self.checkOrigin,
 	}
-	defer store.Close()
+}
+
+func (self *Handler) Signin(resp http.ResponseWriter, req *http.Request) {
+	var err error
 
 	session, _ := sessionStore.Get(req, SESSION_LOGIN)
-	if session.Values["nonce"], err = store.GetNonce(); err != nil {
+	if session.Values["nonce"], err = self.store.GetNonce(); err != nil {
 		self.logger.Error(self.logCat,
 			"Could not assign nonce",
 			util.Fields{"error": err.Error()})
 		http.Error(resp, "Server error", 500)
 		return
 	}
-	prefix := "fxa"
-	if self.config.GetFlag("auth.persona") {
-		prefix = "persona"
-	}
-	redirUrlTemplate := self.config.Get(prefix+".login_url",
-		"{{.Host}}?client_id={{.ClientId}}&scope=profile:email&state={{.State}}&action=signin")
-	tmpl, err := template.New("Login").Parse(redirUrlTemplate)
-	if err != nil {
-		self.logger.Error(self.logCat,
-			"Could not handle login template",
-			util.Fields{"error": err.Error(),
-				"template": redirUrlTemplate})
-		http.Error(resp, "Server error", 500)
-		return
-	}
-	// fill the template using an anonymous struct.
-	// (if this works, I'm a bit grossed out by go)
-	var buffer = new(bytes.Buffer)
-
-	err = tmpl.Execute(buffer, struct {
-		Host     string
-		ClientId string
-		State    string
-	}{
-		self.config.Get(prefix+".login", "http://localhost/"),
-		self.config.Get(prefix+".client_id", ""),
-		strings.SplitN(session.Values["nonce"].(string), ".", 2)[0],
-	})
+	// The state and ID token nonce are both bound to the stored
+	// nonce, so the callback can check them against it.
+	nonce := session.Values["nonce"].(string)
+	verifier := pkceVerifier()
+	session.Values["verifier"] = verifier
+	loginUrl, err := self.idp.LoginURL(strings.SplitN(nonce, ".", 2)[0],
+		self.genHash(nonce), pkceChallenge(verifier))
 	if err != nil {
 		self.logger.Error(self.logCat,
-			"Could not fill out template",
-			util.Fields{"error": err.Error(),
-				"template": redirUrlTemplate})
+			"Could not build login url",
+			util.Fields{"error": err.Error()})
 		http.Error(resp, "Server error", 500)
 		return
 	}
 
 	session.Save(req, resp)
-	http.Redirect(resp, req, buffer.String(), http.StatusFound)
+	http.Redirect(resp, req, loginUrl, http.StatusFound)
 	self.metrics.Increment("page.signin.attempt")
 	return
 }
@@ -2016,9 +1798,9 @@ func (self *Handler) Validate(resp http.ResponseWriter, req *http.Request) {
 	// {assert: ... }
 	if buffer, raw, err := parseBody(req.Body); err == nil {
 		if assert, ok := buffer["assert"]; ok {
-			if userid, _, err := self.verifyFxAAssertion(assert.(string)); err == nil {
+			if ident, err := self.idp.Verify(assert.(string)); err == nil {
 				reply["valid"] = true
-				reply["uid"] = userid
+				reply["uid"] = self.genHash(ident.Email)
 			} else {
 				self.logger.Error(self.logCat,
 					"Could not verify assertion",
@@ -21,8 +21,15 @@ import (
 var ErrNoAuth = errors.New("No Authorization Header")
 var ErrNotHawkAuth = errors.New("Not a Hawk Authorization Header")
 var ErrInvalidSignature = errors.New("Header does not match signature")
+var ErrStaleTimestamp = errors.New("Stale timestamp")
+var ErrReplayedNonce = errors.New("Nonce already used")
+var ErrMissingHash = errors.New("Payload hash required")
+var ErrInvalidHash = errors.New("Payload does not match hash")
+var ErrNoBewit = errors.New("No bewit")
+var ErrInvalidBewit = errors.New("Invalid bewit")
+var ErrExpiredBewit = errors.New("Bewit expired")
 
-// minimal HAWK for now (e.g. no bewit because IAGNI)
+// minimal HAWK for now (headers, response signing and bewits)
 type Hawk struct {
 	logger    *util.HekaLogger
 	config    *util.MzConfig
@@ -99,7 +106,7 @@ func (self *Hawk) getHostPort(req *http.Request) (host, port string) {
 		if len(elements) == 2 {
 			port = elements[1]
 		}
-		if self.config.GetFlag("override_port") {
+		if self.config != nil && self.config.GetFlag("override_port") {
 			switch {
 			// because nginx proxies, don't take the :port at face value
 			//case len(elements) > 1:
@@ -114,31 +121,99 @@ func (self *Hawk) getHostPort(req *http.Request) (host, port string) {
 	return host, port
 }
 
+// Content types are compared without parameters or case.
+// e.g. "application/json; charset=UTF-8" => "application/json"
+func normalizeContentType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(
+		strings.Split(contentType, ";")[0]))
+}
+
+// The Hawk hash of a payload of the given content type.
+func PayloadHash(contentType string, body []byte) string {
+	sha := sha256.New()
+	sha.Write([]byte("hawk.1.payload\n" +
+		normalizeContentType(contentType) + "\n"))
+	sha.Write(body)
+	sha.Write([]byte("\n"))
+	return base64.StdEncoding.EncodeToString(sha.Sum(nil))
+}
+
 func (self *Hawk) genHash(req *http.Request, body string) (hash string) {
-	contentType := req.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "text/plain"
-	}
-	// Something is appending the chartype to the content. this can throw off
-	// the hash generator.
-	// Client creates mac using "application/json",
-	// we get "application/json;charset=UTF8" which brings much sadness.
-	contentType = (strings.Split(contentType, ";"))[0]
-	nbody := strings.Replace(body, "\\", "\\\\", -1)
-	nbody = strings.Replace(nbody, "\n", "\\n", -1)
-	marshalStr := fmt.Sprintf("%s\n%s\n%s\n",
-		"hawk.1.payload",
-		contentType,
-		nbody)
-	sha := sha256.Sum256([]byte(marshalStr))
-	hash = base64.StdEncoding.EncodeToString([]byte(sha[:32]))
-	if self.config.GetFlag("hawk.show_hash") {
+	hash = PayloadHash(req.Header.Get("Content-Type"), []byte(body))
+	if self.config != nil && self.config.GetFlag("hawk.show_hash") {
 		self.logger.Debug("hawk", "genHash",
-			util.Fields{"marshalStr": marshalStr,
+			util.Fields{"contentType": req.Header.Get("Content-Type"),
 				"hash": hash})
 	}
 	return hash
+}
+
+// Check the body against the hash the client sent. A request with a
+// body must carry a hash.
+func (self *Hawk) VerifyPayload(contentType string, body []byte) error {
+	if self.Hash == "" {
+		if len(body) == 0 {
+			return nil
+		}
+		return ErrMissingHash
+	}
+	if hmac.Equal([]byte(self.Hash),
+		[]byte(PayloadHash(contentType, body))) {
+		return nil
+	}
+	// Clients built against older servers still send the old hash.
+	if self.config != nil && !self.config.GetFlag("hawk.strict_hash") &&
+		hmac.Equal([]byte(self.Hash),
+			[]byte(legacyPayloadHash(contentType, body))) {
+		if self.logger != nil {
+			self.logger.Warn("hawk", "Legacy payload hash",
+				util.Fields{"contentType": contentType})
+		}
+		return nil
+	}
+	return ErrInvalidHash
+}
 
+// The payload hash this server used to expect: text/plain if there is
+// no content type, and the body with backslashes and newlines escaped.
+// Accepted until hawk.strict_hash is set. (To be dropped in the next
+// release.)
+func legacyPayloadHash(contentType string, body []byte) string {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	contentType = strings.Split(contentType, ";")[0]
+	nbody := strings.Replace(string(body), "\\", "\\\\", -1)
+	nbody = strings.Replace(nbody, "\n", "\\n", -1)
+	sha := sha256.Sum256([]byte("hawk.1.payload\n" + contentType + "\n" +
+		nbody + "\n"))
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
+
+// ext may not break the normalized string.
+func escapeExt(ext string) string {
+	ext = strings.Replace(ext, "\\", "\\\\", -1)
+	return strings.Replace(ext, "\n", "\\n", -1)
+}
+
+// The string that is MACed. kind is "header" or "response".
+func (self *Hawk) normalized(kind, extra string) string {
+	return fmt.Sprintf("hawk.1.%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+		kind,
+		self.Time,
+		self.Nonce,
+		strings.ToUpper(self.Method),
+		self.Path,
+		strings.ToLower(self.Host),
+		self.Port,
+		self.Hash,
+		escapeExt(extra))
+}
+
+func hawkMac(secret, normalized string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(normalized))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
 // Initialize self from request, extra and secret
@@ -165,25 +240,14 @@ func (self *Hawk) GenerateSignature(req *http.Request, extra, body, secret strin
 	if self.Method == "" {
 		self.Method = strings.ToUpper(req.Method)
 	}
-	if self.Hash == "" {
+	// (Requests without a body may leave the hash out.)
+	if self.Hash == "" && len(body) > 0 {
 		self.Hash = self.genHash(req, body)
 	}
 
-	marshalStr := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
-		"hawk.1.header",
-		self.Time,
-		self.Nonce,
-		strings.ToUpper(self.Method),
-		self.Path,
-		strings.ToLower(self.Host),
-		self.Port,
-		self.Hash,
-		extra)
-
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(marshalStr))
-	self.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
-	if self.config.GetFlag("hawk.show_hash") {
+	marshalStr := self.normalized("header", extra)
+	self.Signature = hawkMac(secret, marshalStr)
+	if self.config != nil && self.config.GetFlag("hawk.show_hash") {
 		self.logger.Debug("hawk", "#### Marshal",
 			util.Fields{"marshalStr": marshalStr,
 				"secret": secret,
@@ -199,7 +263,7 @@ func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (e
 	if auth == "" {
 		return ErrNoAuth
 	}
-	if strings.ToLower(auth[:4]) != "hawk" {
+	if len(auth) < 5 || strings.ToLower(auth[:4]) != "hawk" {
 		return ErrNotHawkAuth
 	}
 	elements := strings.Split(auth[5:], ", ")
@@ -224,13 +288,137 @@ func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (e
 			self.Signature = val
 		}
 	}
+	self.Method = strings.ToUpper(req.Method)
 	self.Path = getFullPath(req)
 	self.Host, self.Port = self.getHostPort(req)
 	return err
 }
 
+// Is the request's timestamp within skew seconds of our clock?
+func (self *Hawk) CheckTime(skew int64) error {
+	ts, err := strconv.ParseInt(self.Time, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	diff := time.Now().UTC().Unix() - ts
+	if diff > skew || diff < -skew {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+// MAC of a server timestamp, so that clients can trust it.
+func TimestampMac(ts int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("hawk.1.ts\n%d\n", ts)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// WWW-Authenticate header telling a client with a stale timestamp what
+// time we think it is.
+func StaleTimestampHeader(secret string) string {
+	now := time.Now().UTC().Unix()
+	return fmt.Sprintf("Hawk ts=\"%d\", tsm=\"%s\", error=\"%s\"",
+		now,
+		TimestampMac(now, secret),
+		ErrStaleTimestamp.Error())
+}
+
 // Compare a signature value against the generated Signature.
 func (self *Hawk) Compare(sig string) bool {
-	// This should probably decode to byte array and compare.
-	return strings.TrimRight(sig, "=") == strings.TrimRight(self.Signature, "=")
+	return hmac.Equal([]byte(strings.TrimRight(sig, "=")),
+		[]byte(strings.TrimRight(self.Signature, "=")))
+}
+
+// Return a Server-Authorization header signing the response to the
+// request that self was parsed from.
+func (self *Hawk) ResponseHeader(contentType string, body []byte, extra, secret string) string {
+	resp := *self
+	resp.Hash = PayloadHash(contentType, body)
+	mac := hawkMac(secret, resp.normalized("response", extra))
+	rep := fmt.Sprintf("Hawk mac=\"%s\", hash=\"%s\"", mac, resp.Hash)
+	if extra != "" {
+		rep += fmt.Sprintf(", ext=\"%s\"", extra)
+	}
+	return rep
+}
+
+// get the full path of the request, without its bewit.
+func bewitPath(req *http.Request) string {
+	u := *req.URL
+	var keep []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if !strings.HasPrefix(param, "bewit=") {
+			keep = append(keep, param)
+		}
+	}
+	u.RawQuery = strings.Join(keep, "&")
+	return getFullPath(&http.Request{URL: &u})
+}
+
+// Return a bewit granting GET access to the request's URL until exp
+// (epoch seconds), to be added to it as the "bewit" query value.
+func (self *Hawk) Bewit(req *http.Request, id, secret string, exp int64, ext string) string {
+	if self.Path == "" {
+		self.Path = bewitPath(req)
+	}
+	if self.Host == "" {
+		self.Host, self.Port = self.getHostPort(req)
+	}
+	self.Id = id
+	self.Time = strconv.FormatInt(exp, 10)
+	self.Nonce = ""
+	self.Method = "GET"
+	self.Hash = ""
+	self.Extra = ext
+	self.Signature = hawkMac(secret, self.normalized("bewit", ext))
+	return b64url([]byte(strings.Join(
+		[]string{id, self.Time, self.Signature, ext}, "\\")))
+}
+
+// Initialize self from the request's bewit.
+func (self *Hawk) ParseBewit(req *http.Request) (err error) {
+	bewit := req.URL.Query().Get("bewit")
+	if bewit == "" {
+		return ErrNoBewit
+	}
+	// Bewits only grant reads.
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return ErrInvalidBewit
+	}
+	raw, err := unb64url(bewit)
+	if err != nil {
+		return ErrInvalidBewit
+	}
+	parts := strings.Split(string(raw), "\\")
+	if len(parts) != 4 || parts[0] == "" || parts[1] == "" ||
+		parts[2] == "" {
+		return ErrInvalidBewit
+	}
+	self.Id = parts[0]
+	self.Time = parts[1]
+	self.Signature = parts[2]
+	self.Extra = parts[3]
+	self.Nonce = ""
+	self.Method = "GET"
+	self.Hash = ""
+	self.Path = bewitPath(req)
+	self.Host, self.Port = self.getHostPort(req)
+	return nil
+}
+
+// Check a parsed bewit's expiry and signature.
+func (self *Hawk) CheckBewit(secret string) error {
+	exp, err := strconv.ParseInt(self.Time, 10, 64)
+	if err != nil {
+		return ErrInvalidBewit
+	}
+	if time.Now().UTC().Unix() >= exp {
+		return ErrExpiredBewit
+	}
+	if !hmac.Equal([]byte(self.Signature),
+		[]byte(hawkMac(secret, self.normalized("bewit", self.Extra)))) {
+		return ErrInvalidBewit
+	}
+	return nil
 }
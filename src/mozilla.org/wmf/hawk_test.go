@@ -0,0 +1,320 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Credentials and request from the Hawk specification's examples.
+const (
+	vectorId      = "dh37fgj492je"
+	vectorKey     = "werxhqb98rpaxn39848xrunpaw3489ruxnpa98w4rxn"
+	vectorUrl     = "http://example.com:8000/resource/1?b=1&a=2"
+	vectorTime    = "1353832234"
+	vectorNonce   = "j4h3g2"
+	vectorExt     = "some-app-ext-data"
+	vectorBody    = "Thank you for flying Hawk"
+	vectorHash    = "Yi9LfIIFRtBEPt74PVmbTF/xVAwPn7ub15ePICfgnuY="
+	vectorGetMac  = "6R4rV5iE+NPoym+WwjeHzjAGXUtLNIxmo1vpMofpLAE="
+	vectorPostMac = "aSe1DERmZuRl3pI36/9BdZmnErTw3sNzOOAUlfeKjVw="
+)
+
+func vectorRequest(t *testing.T, method string) *http.Request {
+	req, err := http.NewRequest(method, vectorUrl, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func vectorHawk() *Hawk {
+	return &Hawk{Time: vectorTime, Nonce: vectorNonce}
+}
+
+func TestHawkHeaderVector(t *testing.T) {
+	hawk := vectorHawk()
+	hawk.GenerateSignature(vectorRequest(t, "GET"), vectorExt, "",
+		vectorKey)
+	if hawk.Hash != "" {
+		t.Errorf("hash generated for an empty body: %s", hawk.Hash)
+	}
+	if hawk.Signature != vectorGetMac {
+		t.Errorf("mac: got %s, expected %s", hawk.Signature, vectorGetMac)
+	}
+}
+
+func TestHawkPayloadVector(t *testing.T) {
+	for _, ct := range []string{"text/plain", "Text/Plain; charset=utf-8"} {
+		if hash := PayloadHash(ct, []byte(vectorBody)); hash != vectorHash {
+			t.Errorf("hash for %q: got %s, expected %s", ct, hash,
+				vectorHash)
+		}
+	}
+
+	req := vectorRequest(t, "POST")
+	req.Header.Set("Content-Type", "text/plain")
+	hawk := vectorHawk()
+	hawk.GenerateSignature(req, vectorExt, vectorBody, vectorKey)
+	if hawk.Hash != vectorHash {
+		t.Errorf("hash: got %s, expected %s", hawk.Hash, vectorHash)
+	}
+	if hawk.Signature != vectorPostMac {
+		t.Errorf("mac: got %s, expected %s", hawk.Signature, vectorPostMac)
+	}
+}
+
+func TestHawkParseAndCompare(t *testing.T) {
+	req := vectorRequest(t, "post")
+	req.Header.Set("Authorization", "Hawk id=\""+vectorId+
+		"\", ts=\""+vectorTime+"\", nonce=\""+vectorNonce+
+		"\", hash=\""+vectorHash+"\", ext=\""+vectorExt+
+		"\", mac=\""+vectorPostMac+"\"")
+	rhawk := &Hawk{}
+	if err := rhawk.ParseAuthHeader(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rhawk.Id != vectorId || rhawk.Method != "POST" ||
+		rhawk.Host != "example.com" || rhawk.Port != "8000" {
+		t.Errorf("parsed %+v", rhawk)
+	}
+	lhawk := &Hawk{Time: rhawk.Time, Nonce: rhawk.Nonce, Hash: rhawk.Hash}
+	lhawk.GenerateSignature(req, rhawk.Extra, vectorBody, vectorKey)
+	if !lhawk.Compare(rhawk.Signature) {
+		t.Errorf("signature did not compare: %s", lhawk.Signature)
+	}
+	if lhawk.Compare(vectorGetMac) {
+		t.Error("compared against the wrong signature")
+	}
+}
+
+func TestHawkVerifyPayload(t *testing.T) {
+	hawk := &Hawk{}
+	if err := hawk.VerifyPayload("text/plain", nil); err != nil {
+		t.Errorf("empty body without hash: %s", err)
+	}
+	if err := hawk.VerifyPayload("text/plain",
+		[]byte(vectorBody)); err != ErrMissingHash {
+		t.Errorf("body without hash: got %v", err)
+	}
+	hawk.Hash = vectorHash
+	if err := hawk.VerifyPayload("text/plain; charset=utf-8",
+		[]byte(vectorBody)); err != nil {
+		t.Errorf("matching body: %s", err)
+	}
+	if err := hawk.VerifyPayload("text/plain",
+		[]byte(vectorBody+"!")); err != ErrInvalidHash {
+		t.Errorf("altered body: got %v", err)
+	}
+	if err := hawk.VerifyPayload("application/json",
+		[]byte(vectorBody)); err != ErrInvalidHash {
+		t.Errorf("altered content type: got %v", err)
+	}
+}
+
+// Until hawk.strict_hash is set, the hash older clients send (escaped
+// body, text/plain by default) is still accepted.
+func TestHawkLegacyPayload(t *testing.T) {
+	body := []byte(`{"cmd":"line\nnext"}`)
+	for _, strict := range []bool{false, true} {
+		file, err := ioutil.TempFile("", "hawk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		file.WriteString("hawk.strict_hash=" + strconv.FormatBool(strict) +
+			"\nlogger.filter=0\n")
+		file.Close()
+		config, err := util.ReadMzConfig(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hawk := &Hawk{config: config, logger: util.NewHekaLogger(config),
+			Hash: "X8w4UjdLYgSZbVCT7I3w9tX4TUDwoK7xpkuEdwnSWU4="}
+		if err := hawk.VerifyPayload("", body); (err == nil) == strict {
+			t.Errorf("strict %v: got %v", strict, err)
+		}
+		hawk.Hash = PayloadHash("", body)
+		if err := hawk.VerifyPayload("", body); err != nil {
+			t.Errorf("strict %v: spec hash: %s", strict, err)
+		}
+	}
+}
+
+func TestHawkExtEscaping(t *testing.T) {
+	hawk := vectorHawk()
+	hawk.GenerateSignature(vectorRequest(t, "GET"), "a\nb", "", vectorKey)
+	plain := hawk.Signature
+	hawk.Signature = ""
+	hawk.GenerateSignature(vectorRequest(t, "GET"), "a\\nb", "", vectorKey)
+	if hawk.Signature == plain {
+		t.Error("a newline and an escaped newline signed the same")
+	}
+	if escapeExt("a\\b\nc") != "a\\\\b\\nc" {
+		t.Errorf("escapeExt: got %q", escapeExt("a\\b\nc"))
+	}
+}
+
+func TestHawkResponseHeader(t *testing.T) {
+	hawk := vectorHawk()
+	hawk.Method = "GET"
+	hawk.Path = "/resource/1?b=1&a=2"
+	hawk.Host = "example.com"
+	hawk.Port = "8000"
+	header := hawk.ResponseHeader("text/plain", []byte(vectorBody),
+		"response-specific", vectorKey)
+
+	// Check it the way a client would.
+	check := *hawk
+	check.Hash = vectorHash
+	mac := hawkMac(vectorKey, check.normalized("response",
+		"response-specific"))
+	expected := "Hawk mac=\"" + mac + "\", hash=\"" + vectorHash +
+		"\", ext=\"response-specific\""
+	if header != expected {
+		t.Errorf("got %s, expected %s", header, expected)
+	}
+	if mac == vectorGetMac {
+		t.Error("response mac should differ from the request mac")
+	}
+	if hawk.Hash != "" {
+		t.Error("ResponseHeader changed the request's hash")
+	}
+}
+
+func TestHawkBewitVector(t *testing.T) {
+	const expected = "MTIzNDU2XDEzNTY0MjA3MDdca3NjeHdOUjJ0SnBQMVQxekRMTlBiQjVVaUtJVTl0T1NKWFRVZEc3WDloOD1ceGFuZHlhbmR6"
+	req, _ := http.NewRequest("GET",
+		"https://example.com/somewhere/over/the/rainbow", nil)
+	hawk := &Hawk{Host: "example.com", Port: "443"}
+	bewit := hawk.Bewit(req, "123456", "2983d45yun89q", 1356420707,
+		"xandyandz")
+	if bewit != expected {
+		t.Errorf("got %s, expected %s", bewit, expected)
+	}
+}
+
+func TestHawkBewitRoundTrip(t *testing.T) {
+	exp := time.Now().UTC().Unix() + 60
+	req := vectorRequest(t, "GET")
+	bewit := (&Hawk{}).Bewit(req, vectorId, vectorKey, exp, "location")
+
+	req = vectorRequest(t, "GET")
+	req.URL.RawQuery = "b=1&bewit=" + bewit + "&a=2"
+	rhawk := &Hawk{}
+	if err := rhawk.ParseBewit(req); err != nil {
+		t.Fatal(err)
+	}
+	if rhawk.Id != vectorId || rhawk.Extra != "location" {
+		t.Errorf("parsed %+v", rhawk)
+	}
+	if err := rhawk.CheckBewit(vectorKey); err != nil {
+		t.Errorf("valid bewit: %s", err)
+	}
+	if err := rhawk.CheckBewit("wrong"); err != ErrInvalidBewit {
+		t.Errorf("wrong key: got %v", err)
+	}
+
+	// A bewit is only good for its URL, and only until it expires.
+	req.URL.Path = "/resource/2"
+	rhawk = &Hawk{}
+	rhawk.ParseBewit(req)
+	if err := rhawk.CheckBewit(vectorKey); err != ErrInvalidBewit {
+		t.Errorf("other path: got %v", err)
+	}
+	req = vectorRequest(t, "GET")
+	req.URL.RawQuery = "b=1&a=2&bewit=" +
+		(&Hawk{}).Bewit(req, vectorId, vectorKey, exp-120, "location")
+	rhawk = &Hawk{}
+	rhawk.ParseBewit(req)
+	if err := rhawk.CheckBewit(vectorKey); err != ErrExpiredBewit {
+		t.Errorf("expired: got %v", err)
+	}
+
+	req.Method = "POST"
+	if err := (&Hawk{}).ParseBewit(req); err != ErrInvalidBewit {
+		t.Errorf("POST with a bewit: got %v", err)
+	}
+	if err := (&Hawk{}).ParseBewit(vectorRequest(t,
+		"GET")); err != ErrNoBewit {
+		t.Errorf("no bewit: got %v", err)
+	}
+}
+
+func TestHawkCheckTime(t *testing.T) {
+	now := time.Now().UTC().Unix()
+	for ts, ok := range map[int64]bool{
+		now:       true,
+		now - 30:  true,
+		now + 30:  true,
+		now - 120: false,
+		now + 120: false,
+	} {
+		hawk := &Hawk{Time: strconv.FormatInt(ts, 10)}
+		if err := hawk.CheckTime(60); (err == nil) != ok {
+			t.Errorf("ts %d (now %d): got %v", ts, now, err)
+		}
+	}
+	hawk := &Hawk{Time: "bogus"}
+	if hawk.CheckTime(60) != ErrStaleTimestamp {
+		t.Error("bad timestamp accepted")
+	}
+}
+
+func TestLruNonces(t *testing.T) {
+	cache := storage.NewNonceLRU(2)
+	for _, step := range []struct {
+		id, nonce string
+		fresh     bool
+	}{
+		{"a", "1", true},
+		{"a", "1", false},
+		{"b", "1", true},
+		{"a", "2", true},
+		// "a:1" is pushed out by the size limit.
+		{"a", "1", true},
+		{"a", "2", false},
+	} {
+		fresh, err := cache.Use(step.id, step.nonce, 60)
+		if err != nil || fresh != step.fresh {
+			t.Errorf("%s:%s: got %v, %v", step.id, step.nonce, fresh, err)
+		}
+	}
+}
+
+// The header's id isn't covered by the MAC, so changing it must not
+// get a replayed request past the nonce check.
+func TestHawkReplayNewId(t *testing.T) {
+	handler, _, devId := newTokenTestHandler(t)
+	devRec, err := handler.store.GetDeviceInfo(devId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"has_passcode":false}`
+	req := httptest.NewRequest("POST", "/1/cmd/"+devId, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	hawk := Hawk{}
+	header := hawk.AsHeader(req, devId, body, "", devRec.Secret)
+
+	for _, id := range []string{devId, "someone-else", ""} {
+		req.Header.Set("Authorization", strings.Replace(header,
+			`id="`+devId+`"`, `id="`+id+`"`, 1))
+		_, _, ok := handler.verifyHawkHeader(httptest.NewRecorder(), req,
+			[]byte(body), devRec)
+		if ok != (id == devId) {
+			t.Errorf("id %q: accepted %v", id, ok)
+		}
+	}
+}
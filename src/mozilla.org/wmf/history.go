@@ -0,0 +1,173 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Get an int64 query value, or def if missing or unparsable.
+func queryInt(req *http.Request, key string, def int64) int64 {
+	val := req.FormValue(key)
+	if val == "" {
+		return def
+	}
+	ival, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return def
+	}
+	return ival
+}
+
+// Return the location history for a device.
+// e.g. GET /1/history/<deviceid>?since=<epoch>&until=<epoch>&limit=<n>
+func (self *Handler) History(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:History"
+
+	resp.Header().Set("Content-Type", "application/json")
+	devRec, _ := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+
+	maxLimit, err := strconv.ParseInt(self.config.Get("history.max_limit",
+		"1000"), 10, 64)
+	if err != nil {
+		maxLimit = 1000
+	}
+	limit := queryInt(req, "limit", 100)
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+	positions, err := self.store.GetPositionHistory(devRec.ID,
+		queryInt(req, "since", 0),
+		queryInt(req, "until", 0),
+		int(limit))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get position history",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	if positions == nil {
+		positions = []storage.Position{}
+	}
+	reply, err := json.Marshal(replyType{
+		"deviceid":  devRec.ID,
+		"positions": positions})
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not marshal history",
+			util.Fields{"error": err.Error()})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	self.metrics.Increment("page.history")
+	resp.Write(reply)
+}
+
+// Show or set how long a device's location history is kept.
+// GET returns {"user":secs, "device":secs, "effective":secs}
+// POST takes {"user":secs} and/or {"device":secs} (0 to clear)
+func (self *Handler) Retention(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Retention"
+
+	resp.Header().Set("Content-Type", "application/json")
+	devRec, userId := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		maxRetention, err := strconv.ParseInt(self.config.Get(
+			"history.max_retention", "31536000"), 10, 64)
+		if err != nil {
+			maxRetention = 31536000
+		}
+		buffer, raw, err := parseBody(req.Body)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not parse body",
+				util.Fields{"error": err.Error(),
+					"body": raw})
+			http.Error(resp, "Bad Request", 400)
+			return
+		}
+		for key, val := range buffer {
+			secs, ok := val.(float64)
+			if !ok || secs < 0 {
+				http.Error(resp, "Bad Request", 400)
+				return
+			}
+			if int64(secs) > maxRetention {
+				secs = float64(maxRetention)
+			}
+			switch key {
+			case "user":
+				err = self.store.SetUserRetention(userId, int64(secs))
+			case "device":
+				err = self.store.SetDeviceRetention(devRec.ID, int64(secs))
+			default:
+				continue
+			}
+			if err != nil {
+				self.logger.Error(self.logCat, "Could not set retention",
+					util.Fields{"error": err.Error(),
+						"deviceId": devRec.ID})
+				http.Error(resp, "Server Error", 500)
+				return
+			}
+		}
+		// apply the new settings now.
+		self.store.GcPosition(devRec.ID)
+	}
+
+	user, device, effective, err := self.store.GetRetention(devRec.ID)
+	if err != nil {
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	reply, _ := json.Marshal(replyType{
+		"user":      user,
+		"device":    device,
+		"effective": effective})
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	resp.Write(reply)
+}
+
+// Periodically remove expired positions for every device, according to
+// their retention settings. Runs every db.gc_interval seconds (0 to
+// disable). Call as a goroutine.
+func (self *Handler) PositionGC() {
+	interval, err := strconv.ParseInt(self.config.Get("db.gc_interval",
+		"3600"), 10, 64)
+	if err != nil || interval <= 0 {
+		return
+	}
+	for _ = range time.Tick(time.Duration(interval) * time.Second) {
+		devIds, err := self.store.GetAllDeviceIds()
+		if err != nil {
+			self.logger.Error("gc", "Could not get devices",
+				util.Fields{"error": err.Error()})
+			continue
+		}
+		start := time.Now()
+		for _, devId := range devIds {
+			self.store.GcPosition(devId)
+		}
+		self.metrics.Timer("gc.position", time.Now().Unix()-start.Unix())
+	}
+}
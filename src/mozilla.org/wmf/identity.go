@@ -0,0 +1,156 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"strings"
+)
+
+var ErrUnknownProvider = errors.New("Unknown identity provider")
+
+/* Identity providers.
+   Users sign in to the web UI by being sent to the provider's login
+   page (Signin), which comes back to the OAuth callback with a code to
+   trade for their identity. Devices (and the client's /validate/ call)
+   post an assertion, or ID token, that the provider checks instead.
+
+   auth.provider picks the provider: "fxa" (the default), "persona"
+   (also chosen by auth.persona) or "oidc". See oidc.go for a generic
+   OpenID Connect provider, and dev.go for the --dev provider.
+*/
+
+// A signed in user. Users are known by a hash of their email (see
+// Handler.genHash).
+type Identity struct {
+	Email       string
+	AccessToken string
+}
+
+type IdentityProvider interface {
+	// URL to send the user to, to sign in. state comes back on the
+	// callback, nonce must come back in the provider's ID token (if it
+	// issues one), and challenge is the PKCE (S256) code challenge.
+	LoginURL(state, nonce, challenge string) (string, error)
+	// Trade the callback's code for the user's identity. verifier is
+	// the PKCE code verifier for the challenge passed to LoginURL.
+	Exchange(code, verifier, nonce string) (*Identity, error)
+	// Check an assertion (or ID token) posted by a client.
+	Verify(assertion string) (*Identity, error)
+}
+
+// IdentityOpener creates a new IdentityProvider.
+type IdentityOpener func(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error)
+
+var identityProviders = make(map[string]IdentityOpener)
+
+// Make an identity provider available by name (see auth.provider).
+func RegisterIdentityProvider(name string, opener IdentityOpener) {
+	if opener == nil {
+		panic("wmf: RegisterIdentityProvider opener is nil")
+	}
+	if _, dup := identityProviders[name]; dup {
+		panic("wmf: RegisterIdentityProvider called twice for " + name)
+	}
+	identityProviders[name] = opener
+}
+
+// Open the configured identity provider.
+func NewIdentityProvider(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error) {
+	def := "fxa"
+	if config.GetFlag("auth.persona") {
+		def = "persona"
+	}
+	name := config.Get("auth.provider", def)
+	opener, ok := identityProviders[name]
+	if !ok {
+		logger.Error("auth", "Unknown identity provider",
+			util.Fields{"provider": name})
+		return nil, ErrUnknownProvider
+	}
+	return opener(config, logger, metrics)
+}
+
+// A new PKCE code verifier.
+func pkceVerifier() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return b64url(buf)
+}
+
+// The PKCE code challenge for a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64url(sum[:])
+}
+
+// Fill out the <prefix>.login_url template (Host = <prefix>.login,
+// ClientId = <prefix>.client_id, State = state).
+func loginTemplate(config *util.MzConfig, prefix, state string) (string, error) {
+	tmpl, err := template.New("Login").Parse(config.Get(prefix+".login_url",
+		"{{.Host}}?client_id={{.ClientId}}&scope=profile:email&state={{.State}}&action=signin"))
+	if err != nil {
+		return "", err
+	}
+	var buffer = new(bytes.Buffer)
+	err = tmpl.Execute(buffer, struct {
+		Host     string
+		ClientId string
+		State    string
+	}{
+		config.Get(prefix+".login", "http://localhost/"),
+		config.Get(prefix+".client_id", ""),
+		state,
+	})
+	return buffer.String(), err
+}
+
+// Assertion checks shared by the Persona and FxA providers.
+type assertionBase struct {
+	config *util.MzConfig
+	logger *util.HekaLogger
+	logCat string
+}
+
+// Reject assertions with characters that can't appear in them.
+func (self *assertionBase) checkChars(assertion string) error {
+	if len(assertion) != len(strings.Map(assertionFilter, assertion)) {
+		self.logger.Error(self.logCat, "Assertion contains invalid characters.",
+			util.Fields{"assertion": assertion})
+		return ErrAuthorization
+	}
+	return nil
+}
+
+// Somewhat of a hack, extract the audience from the assertion. This is
+// because some versions of the client do not specify the correct audience
+// and a mis-match causes the assertion to fail.
+func (self *assertionBase) extractAudience(assertion string) (audience string) {
+	bits := strings.Split(assertion, ".")
+	// Classic? persona has 3 chunks, modified has 5.
+	if len(bits) == 5 {
+		if data, err := base64.StdEncoding.DecodeString(bits[3] + "===="[:len(bits[3])%4]); err == nil {
+			dj := make(replyType)
+			if err = json.Unmarshal(data, &dj); err == nil {
+				if v, ok := dj["audience"]; ok {
+					// fxa
+					return v.(string)
+				} else if v, ok := dj["aud"]; ok {
+					// persona
+					return v.(string)
+				}
+			}
+		}
+	}
+	return ""
+}
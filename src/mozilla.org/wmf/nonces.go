@@ -0,0 +1,40 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+)
+
+/* Hawk replay cache.
+   Each Hawk nonce may only be used once per Hawk id while its timestamp
+   could still be accepted. hawk.nonce_cache picks where they are kept:
+   "storage" (the nonce table, shared by every server) or "memory" (a
+   per process LRU of hawk.nonce_cache_size entries, for single server
+   installs).
+*/
+
+type NonceCache interface {
+	// Record the nonce for the Hawk id. Returns false if it was already
+	// used in the last window seconds.
+	Use(id, nonce string, window int64) (fresh bool, err error)
+}
+
+func NewNonceCache(config *util.MzConfig, store storage.Storage) NonceCache {
+	if config.Get("hawk.nonce_cache", "storage") == "memory" {
+		return storage.NewNonceLRU(int(configInt(config,
+			"hawk.nonce_cache_size", 100000)))
+	}
+	return &storeNonces{store: store}
+}
+
+type storeNonces struct {
+	store storage.Storage
+}
+
+func (self *storeNonces) Use(id, nonce string, window int64) (bool, error) {
+	return self.store.UseHawkNonce(id, nonce, window)
+}
@@ -0,0 +1,497 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOIDCConfig    = errors.New("oidc.issuer, oidc.client_id and oidc.redirect_uri must be set")
+	ErrOIDCDiscovery = errors.New("Invalid OpenID Connect discovery document")
+	ErrIDToken       = errors.New("Invalid ID token")
+	ErrUnverified    = errors.New("Email address not verified")
+)
+
+/* OpenID Connect.
+   A generic OpenID Connect provider (auth.provider = oidc), for any IdP
+   that supports discovery and the authorization code flow:
+
+       oidc.issuer         Issuer URL; its discovery document is read
+                           from <issuer>/.well-known/openid-configuration
+       oidc.client_id      Registered client id
+       oidc.client_secret  Registered client secret (unset for public
+                           clients, which rely on PKCE alone)
+       oidc.redirect_uri   Registered callback URL (e.g.
+                           https://host/oauth/, see fxa.redir_uri)
+       oidc.scope          Requested scopes ("openid email")
+       oidc.timeout        Seconds to wait on the IdP (10)
+       oidc.skew           Seconds of clock skew allowed for ID tokens (60)
+
+   ID tokens must be signed with RS256 or ES256 by a key from the IdP's
+   JWKS, which is fetched again (at most once a minute) when a token
+   names a key it does not have. The user is the token's verified email
+   address; the userinfo endpoint is asked if the token has none.
+
+   Signin passes a PKCE challenge and a nonce bound to the login
+   session's state (see Storage.GetNonce), and the callback sends the
+   verifier and checks the nonce in the ID token. Clients may post ID
+   tokens the IdP issued to them for this client_id as assertions.
+*/
+
+// The parts of the discovery document we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// A JSON Web Key (RSA or EC)
+type oidcJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      interface{} `json:"aud"`
+	AuthParty     string      `json:"azp"`
+	Expires       int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+func init() {
+	RegisterIdentityProvider("oidc", OpenOIDC)
+}
+
+type OIDCProvider struct {
+	sync.Mutex
+	config       *util.MzConfig
+	logger       *util.HekaLogger
+	metrics      *util.Metrics
+	logCat       string
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURI  string
+	scope        string
+	skew         int64
+	client       *http.Client
+	discovery    *oidcDiscovery
+	keys         map[string]crypto.PublicKey
+	keysFetched  time.Time
+}
+
+func OpenOIDC(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error) {
+	self := &OIDCProvider{
+		config:       config,
+		logger:       logger,
+		metrics:      metrics,
+		logCat:       "auth:oidc",
+		issuer:       strings.TrimRight(config.Get("oidc.issuer", ""), "/"),
+		clientId:     config.Get("oidc.client_id", ""),
+		clientSecret: config.Get("oidc.client_secret", ""),
+		redirectURI:  config.Get("oidc.redirect_uri", ""),
+		scope:        config.Get("oidc.scope", "openid email"),
+		skew:         configInt(config, "oidc.skew", 60),
+		client: &http.Client{Timeout: time.Duration(
+			configInt(config, "oidc.timeout", 10)) * time.Second},
+	}
+	if self.issuer == "" || self.clientId == "" || self.redirectURI == "" {
+		return nil, ErrOIDCConfig
+	}
+	// The IdP may not be up yet; discovery is retried on first use.
+	if _, err := self.getDiscovery(); err != nil {
+		logger.Warn(self.logCat, "Could not read discovery document",
+			util.Fields{"error": err.Error(),
+				"issuer": self.issuer})
+	}
+	return self, nil
+}
+
+// GET a JSON document from the IdP.
+func (self *OIDCProvider) getJSON(uri string, bearer string, v interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return self.readJSON(resp, v)
+}
+
+func (self *OIDCProvider) readJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d: %s", resp.Request.URL,
+			resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Get (and keep) the issuer's discovery document.
+func (self *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.discovery != nil {
+		return self.discovery, nil
+	}
+	doc := &oidcDiscovery{}
+	if err := self.getJSON(self.issuer+"/.well-known/openid-configuration",
+		"", doc); err != nil {
+		return nil, err
+	}
+	// The document must be for the issuer we were given.
+	if strings.TrimRight(doc.Issuer, "/") != self.issuer ||
+		doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" ||
+		doc.JwksURI == "" {
+		self.logger.Error(self.logCat, "Invalid discovery document",
+			util.Fields{"issuer": doc.Issuer})
+		return nil, ErrOIDCDiscovery
+	}
+	self.discovery = doc
+	return doc, nil
+}
+
+// Read the signing keys from the JWKS.
+func (self *OIDCProvider) fetchKeys(jwksURI string) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []oidcJwk `json:"keys"`
+	}{}
+	if err := self.getJSON(jwksURI, "", &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			self.logger.Warn(self.logCat, "Skipping unusable key",
+				util.Fields{"kid": jwk.Kid,
+					"error": err.Error()})
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (self *oidcJwk) publicKey() (crypto.PublicKey, error) {
+	switch self.Kty {
+	case "RSA":
+		n, err := unb64url(self.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := unb64url(self.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if self.Crv != "P-256" {
+			return nil, errors.New("Unsupported curve " + self.Crv)
+		}
+		x, err := unb64url(self.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := unb64url(self.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	}
+	return nil, errors.New("Unsupported key type " + self.Kty)
+}
+
+// Find the IdP's key for a token, refreshing the keys if it's new.
+func (self *OIDCProvider) getKey(kid string) (crypto.PublicKey, error) {
+	doc, err := self.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	self.Lock()
+	defer self.Unlock()
+	find := func() crypto.PublicKey {
+		if key, ok := self.keys[kid]; ok {
+			return key
+		}
+		// A token may leave out the kid if there is only one key.
+		if kid == "" && len(self.keys) == 1 {
+			for _, key := range self.keys {
+				return key
+			}
+		}
+		return nil
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if time.Since(self.keysFetched) < time.Minute {
+		return nil, ErrIDToken
+	}
+	keys, err := self.fetchKeys(doc.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	self.keys, self.keysFetched = keys, time.Now()
+	self.metrics.Increment("auth.oidc.jwks")
+	if key := find(); key != nil {
+		return key, nil
+	}
+	return nil, ErrIDToken
+}
+
+// Check an ID token's signature and claims. nonce must match the
+// token's, if given.
+func (self *OIDCProvider) verifyIDToken(token, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	raw, err := unb64url(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, ErrIDToken
+	}
+	sig, err := unb64url(parts[2])
+	if err != nil {
+		return nil, ErrIDToken
+	}
+	key, err := self.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" ||
+			rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig) != nil {
+			return nil, ErrIDToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, hashed[:], new(big.Int).SetBytes(sig[:32]),
+				new(big.Int).SetBytes(sig[32:])) {
+			return nil, ErrIDToken
+		}
+	default:
+		return nil, ErrIDToken
+	}
+
+	claims := &oidcClaims{}
+	if raw, err = unb64url(parts[1]); err != nil ||
+		json.Unmarshal(raw, claims) != nil {
+		return nil, ErrIDToken
+	}
+	now := time.Now().UTC().Unix()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != self.issuer:
+	case !claims.hasAudience(self.clientId):
+	case claims.Expires == 0 || now > claims.Expires+self.skew:
+	case claims.IssuedAt > now+self.skew:
+	case nonce != "" && claims.Nonce != nonce:
+	default:
+		return claims, nil
+	}
+	return nil, ErrIDToken
+}
+
+// Is the token for the client? (If it's for several, it must have
+// been issued to the client.)
+func (self *oidcClaims) hasAudience(clientId string) bool {
+	switch aud := self.Audience.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return len(aud) == 1 || self.AuthParty == clientId
+			}
+		}
+	}
+	return false
+}
+
+// Some IdPs send email_verified as a string.
+func (self *oidcClaims) emailVerified() bool {
+	switch v := self.EmailVerified.(type) {
+	case nil:
+		// Not asserted either way; trust the IdP's email.
+		return true
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Get the user's identity from checked claims, asking the userinfo
+// endpoint for the email if the token has none.
+func (self *OIDCProvider) identity(claims *oidcClaims, accessToken string) (*Identity, error) {
+	if claims.Email == "" && accessToken != "" {
+		doc, err := self.getDiscovery()
+		if err != nil {
+			return nil, err
+		}
+		if doc.UserinfoEndpoint != "" {
+			info := &oidcClaims{}
+			if err = self.getJSON(doc.UserinfoEndpoint, accessToken,
+				info); err != nil {
+				return nil, err
+			}
+			// The userinfo must be for the token's user.
+			if info.Subject != claims.Subject {
+				return nil, ErrIDToken
+			}
+			claims.Email, claims.EmailVerified = info.Email,
+				info.EmailVerified
+		}
+	}
+	if claims.Email == "" {
+		self.logger.Error(self.logCat, "No email for user",
+			util.Fields{"sub": claims.Subject})
+		return nil, ErrNoUser
+	}
+	if !claims.emailVerified() {
+		return nil, ErrUnverified
+	}
+	return &Identity{Email: claims.Email, AccessToken: accessToken}, nil
+}
+
+func (self *OIDCProvider) LoginURL(state, nonce, challenge string) (string, error) {
+	doc, err := self.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	args := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {self.clientId},
+		"redirect_uri":          {self.redirectURI},
+		"scope":                 {self.scope},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + args.Encode(), nil
+}
+
+func (self *OIDCProvider) Exchange(code, verifier, nonce string) (*Identity, error) {
+	doc, err := self.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	args := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {self.redirectURI},
+		"client_id":     {self.clientId},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", doc.TokenEndpoint,
+		strings.NewReader(args.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if self.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(self.clientId),
+			url.QueryEscape(self.clientSecret))
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		self.logger.Error(self.logCat, "Token request failed",
+			util.Fields{"error": err.Error()})
+		return nil, ErrOauth
+	}
+	reply := struct {
+		IdToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = self.readJSON(resp, &reply); err != nil {
+		self.logger.Error(self.logCat, "Token request refused",
+			util.Fields{"error": err.Error()})
+		return nil, ErrOauth
+	}
+	claims, err := self.verifyIDToken(reply.IdToken, nonce)
+	if err != nil {
+		self.logger.Error(self.logCat, "Rejected ID token",
+			util.Fields{"error": err.Error()})
+		self.metrics.Increment("auth.oidc.rejected")
+		return nil, err
+	}
+	return self.identity(claims, reply.AccessToken)
+}
+
+// Check an ID token a client got from the IdP for this client id.
+func (self *OIDCProvider) Verify(assertion string) (*Identity, error) {
+	claims, err := self.verifyIDToken(assertion, "")
+	if err != nil {
+		self.logger.Error(self.logCat, "Rejected ID token",
+			util.Fields{"error": err.Error()})
+		self.metrics.Increment("auth.oidc.rejected")
+		return nil, err
+	}
+	return self.identity(claims, "")
+}
@@ -0,0 +1,203 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+const mockClientId = "fmd-test"
+
+// A local IdP that issues RS256 ID tokens for the authorization code
+// "good-code", if the PKCE verifier matches the challenge it was given.
+type mockIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(resp http.ResponseWriter, req *http.Request) {
+			base := idp.server.URL
+			json.NewEncoder(resp).Encode(map[string]string{
+				"issuer":                 base,
+				"authorization_endpoint": base + "/authorize",
+				"token_endpoint":         base + "/token",
+				"jwks_uri":               base + "/jwks"})
+		})
+	mux.HandleFunc("/jwks", func(resp http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   b64url(key.N.Bytes()),
+				"e":   b64url(big.NewInt(int64(key.E)).Bytes())}}})
+	})
+	mux.HandleFunc("/token", func(resp http.ResponseWriter, req *http.Request) {
+		if req.FormValue("code") != "good-code" ||
+			req.FormValue("client_id") != mockClientId ||
+			pkceChallenge(req.FormValue("code_verifier")) != idp.challenge {
+			http.Error(resp, `{"error":"invalid_grant"}`, 400)
+			return
+		}
+		json.NewEncoder(resp).Encode(map[string]string{
+			"access_token": "at",
+			"id_token":     idp.token("RS256", idp.nonce)})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// Sign an ID token with the given claims over the defaults.
+func (self *mockIdP) token(alg, nonce string) string {
+	claims := map[string]interface{}{
+		"iss":   self.server.URL,
+		"sub":   "1234",
+		"aud":   mockClientId,
+		"exp":   time.Now().Unix() + 300,
+		"iat":   time.Now().Unix(),
+		"email": "user@example.com"}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range self.claims {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "k1"})
+	body, _ := json.Marshal(claims)
+	unsigned := b64url(header) + "." + b64url(body)
+	if alg == "none" {
+		return unsigned + "."
+	}
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, self.key, crypto.SHA256, sum[:])
+	return unsigned + "." + b64url(sig)
+}
+
+func openMockOIDC(t *testing.T, idp *mockIdP) *OIDCProvider {
+	file, err := ioutil.TempFile("", "oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("oidc.issuer=" + idp.server.URL + "\n" +
+		"oidc.client_id=" + mockClientId + "\n" +
+		"oidc.redirect_uri=http://localhost/oauth/\n" +
+		"logger.filter=0\n")
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := util.NewHekaLogger(config)
+	provider, err := OpenOIDC(config, logger,
+		util.NewMetrics("test", logger, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.(*OIDCProvider)
+}
+
+func TestOIDCSignin(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := openMockOIDC(t, idp)
+
+	verifier := pkceVerifier()
+	login, err := provider.LoginURL("state1", "nonce1",
+		pkceChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := u.Query()
+	if u.Path != "/authorize" || args.Get("state") != "state1" ||
+		args.Get("nonce") != "nonce1" ||
+		args.Get("code_challenge_method") != "S256" {
+		t.Errorf("login url: %s", login)
+	}
+	idp.challenge, idp.nonce = args.Get("code_challenge"), "nonce1"
+
+	ident, err := provider.Exchange("good-code", verifier, "nonce1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.Email != "user@example.com" || ident.AccessToken != "at" {
+		t.Errorf("identity: %+v", ident)
+	}
+	if _, err := provider.Exchange("good-code", "wrong verifier",
+		"nonce1"); err != ErrOauth {
+		t.Errorf("wrong verifier: got %v", err)
+	}
+	if _, err := provider.Exchange("good-code", verifier,
+		"other nonce"); err != ErrIDToken {
+		t.Errorf("wrong nonce: got %v", err)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := openMockOIDC(t, idp)
+
+	if _, err := provider.Verify(idp.token("RS256", "")); err != nil {
+		t.Errorf("valid token: %s", err)
+	}
+	if _, err := provider.Verify(idp.token("none", "")); err != ErrIDToken {
+		t.Errorf("unsigned token: got %v", err)
+	}
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":      {"exp": time.Now().Unix() - 3600},
+		"other aud":    {"aud": "someone-else"},
+		"other iss":    {"iss": "https://evil.example.com"},
+		"shared aud":   {"aud": []string{mockClientId, "someone-else"}},
+		"future iat":   {"iat": time.Now().Unix() + 3600},
+		"unverified":   {"email_verified": false},
+		"no email":     {"email": ""},
+		"tampered sig": nil,
+	} {
+		idp.claims = claims
+		token := idp.token("RS256", "")
+		if claims == nil {
+			token = token[:len(token)-4] + "AAAA"
+		}
+		if _, err := provider.Verify(token); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	idp.claims = map[string]interface{}{
+		"aud": []string{mockClientId, "someone-else"},
+		"azp": mockClientId}
+	if _, err := provider.Verify(idp.token("RS256", "")); err != nil {
+		t.Errorf("issued to us, for several: %s", err)
+	}
+}
@@ -0,0 +1,188 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+/* Push outbox.
+   A push that fails is put in the outbox rather than failing the
+   command (which is already stored, and will still be picked up the
+   next time the device checks in). A pool of workers retries it with
+   jittered exponential backoff until it goes through, the command is
+   no longer waiting, or push.retry_deadline passes.
+*/
+
+// Seconds a claimed outbox entry is held before another worker may
+// take it. (Longer than a push request can take.)
+const pushLease = 120
+
+// How long to wait before attempt number attempt+1. Doubles from
+// push.retry_base up to push.retry_max seconds, picked at random from
+// the upper half of that so that retries don't bunch up. A longer
+// Retry-After from the push service wins.
+func (self *Handler) pushBackoff(attempt int, err error) int64 {
+	base := configInt(self.config, "push.retry_base", 5)
+	max := configInt(self.config, "push.retry_max", 600)
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay > 1 {
+		delay = delay/2 + rand.Int63n(delay/2+1)
+	}
+	if perr, ok := err.(*PushError); ok {
+		if after := int64(perr.RetryAfter / time.Second); after > delay {
+			delay = after
+		}
+	}
+	return delay
+}
+
+// The payload announcing a command to the device.
+func pushPayload(cmdId int64) []byte {
+	payload, _ := json.Marshal(replyType{"id": cmdId})
+	return payload
+}
+
+// Put a failed push in the outbox. The retries stop at the command's
+// expiry if that comes before push.retry_deadline.
+func (self *Handler) queuePush(devId string, cmdId, expires int64, pushErr error) {
+	now := time.Now().Unix()
+	deadline := now + configInt(self.config, "push.retry_deadline", 3600)
+	if expires > 0 && expires < deadline {
+		deadline = expires
+	}
+	job := storage.PushJob{
+		DeviceID:    devId,
+		CmdID:       cmdId,
+		Attempts:    1,
+		NextAttempt: now + self.pushBackoff(1, pushErr),
+		Deadline:    deadline,
+		LastError:   pushErr.Error(),
+	}
+	detail := "push failed, retrying: " + pushErr.Error()
+	if _, err := self.store.QueuePush(job); err != nil {
+		detail = "push failed: " + pushErr.Error()
+	} else {
+		self.metrics.Increment("push.retry.queued")
+	}
+	self.store.SetCommandState(devId, cmdId, storage.CMD_QUEUED, detail)
+}
+
+// Retry a push from the outbox, and record how it went.
+func (self *Handler) retryPush(job storage.PushJob) {
+	logCat := "push"
+
+	if job.CmdState != storage.CMD_QUEUED {
+		// The device already checked in, or the command was cancelled
+		// or expired.
+		self.store.DeletePush(job.ID)
+		self.metrics.Increment("push.retry.dropped")
+		return
+	}
+	devRec, err := self.store.GetDeviceInfo(job.DeviceID)
+	if err == storage.ErrUnknownDevice {
+		self.store.DeletePush(job.ID)
+		self.metrics.Increment("push.retry.dropped")
+		return
+	}
+	if err != nil {
+		// Leave it for the lease to run out.
+		return
+	}
+	if devRec.PushGone {
+		self.store.SetCommandState(job.DeviceID, job.CmdID,
+			storage.CMD_QUEUED, "push endpoint gone")
+		self.store.DeletePush(job.ID)
+		self.metrics.Increment("push.retry.gone")
+		return
+	}
+
+	attempts := job.Attempts + 1
+	self.metrics.Increment("push.retry.attempt")
+	err = SendPush(devRec, self.config, pushPayload(job.CmdID))
+	switch {
+	case err == nil:
+		self.logger.Info(logCat, "Push retry succeeded",
+			util.Fields{"deviceId": job.DeviceID,
+				"attempts": strconv.Itoa(attempts)})
+		self.store.SetCommandState(job.DeviceID, job.CmdID,
+			storage.CMD_PUSHED, "")
+		self.store.DeletePush(job.ID)
+		self.metrics.Increment("push.retry.ok")
+	case err == ErrPushGone:
+		self.logger.Warn(logCat, "Push endpoint gone",
+			util.Fields{"deviceId": job.DeviceID,
+				"pushUrl": devRec.PushUrl})
+		self.store.SetPushGone(job.DeviceID)
+		self.store.SetCommandState(job.DeviceID, job.CmdID,
+			storage.CMD_QUEUED, "push endpoint gone")
+		self.store.DeletePush(job.ID)
+		self.metrics.Increment("push.retry.gone")
+	default:
+		next := time.Now().Unix() + self.pushBackoff(attempts, err)
+		if next > job.Deadline {
+			self.logger.Warn(logCat, "Giving up on push",
+				util.Fields{"deviceId": job.DeviceID,
+					"attempts": strconv.Itoa(attempts),
+					"error":    err.Error()})
+			self.store.SetCommandState(job.DeviceID, job.CmdID,
+				storage.CMD_FAILED,
+				fmt.Sprintf("push gave up after %d attempts: %s",
+					attempts, err.Error()))
+			self.store.DeletePush(job.ID)
+			self.metrics.Increment("push.retry.gaveup")
+			return
+		}
+		self.store.RetryPush(job.ID, attempts, next, err.Error())
+		self.store.SetCommandState(job.DeviceID, job.CmdID,
+			storage.CMD_QUEUED, "push failed, retrying: "+err.Error())
+	}
+}
+
+// Work through the push outbox. Checks for due retries every
+// push.retry_interval seconds (0 to disable) and hands them to
+// push.workers workers. Call as a goroutine.
+func (self *Handler) PushRetry() {
+	interval := configInt(self.config, "push.retry_interval", 5)
+	if interval <= 0 {
+		return
+	}
+	workers := int(configInt(self.config, "push.workers", 4))
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan storage.PushJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				self.retryPush(job)
+			}
+		}()
+	}
+	for _ = range time.Tick(time.Duration(interval) * time.Second) {
+		due, err := self.store.ClaimPushes(workers*4, pushLease)
+		if err != nil {
+			self.logger.Error("push", "Could not read the push outbox",
+				util.Fields{"error": err.Error()})
+			continue
+		}
+		for _, job := range due {
+			jobs <- job
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/wmf/storage"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPush(t *testing.T) {
+	handler, userId, _ := newTokenTestHandler(t)
+	push := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.WriteHeader(http.StatusInternalServerError)
+		}))
+	defer push.Close()
+	devId, err := handler.store.RegisterDevice(userId, storage.Device{
+		Name:    "tablet",
+		PushUrl: push.URL + "/push"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+
+	for _, test := range []struct {
+		name     string
+		deadline int64
+		state    string
+		detail   string
+	}{
+		{"before the deadline", now + 3600, storage.CMD_QUEUED,
+			"push failed, retrying"},
+		{"past the deadline", now, storage.CMD_FAILED,
+			"push gave up after 2 attempts"},
+	} {
+		cmdId, _ := handler.store.StoreCommand(devId, "r", `{"r":{}}`, 0)
+		job := storage.PushJob{DeviceID: devId, CmdID: cmdId, Attempts: 1,
+			Deadline: test.deadline, CmdState: storage.CMD_QUEUED}
+		if job.ID, err = handler.store.QueuePush(job); err != nil {
+			t.Fatal(err)
+		}
+		handler.retryPush(job)
+		commands, _ := handler.store.GetCommands(devId, 1)
+		if len(commands) != 1 || commands[0].ID != cmdId ||
+			commands[0].State != test.state ||
+			!strings.HasPrefix(commands[0].Detail, test.detail) {
+			t.Errorf("%s: %+v", test.name, commands)
+		}
+	}
+}
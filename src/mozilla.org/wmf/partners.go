@@ -0,0 +1,73 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/* Partner certificates.
+   Some partners run push servers (for proprietary wake mechanisms) that
+   are signed by their own CA, or that want a client certificate. Each
+   such host is listed in push.partners, and its files are given by
+
+       push.partner.<host>.ca    PEM bundle of CAs to trust for the host
+       push.partner.<host>.cert  PEM client certificate
+       push.partner.<host>.key   PEM key for the client certificate
+
+   <host> is the host (with port, if not the default) of the push URL.
+   A partner's CA bundle replaces the system roots for that host only;
+   every other host is verified as usual.
+*/
+
+// Build the TLS settings for each configured partner host.
+func loadPartnerTLS(config *util.MzConfig) (partners map[string]*tls.Config, err error) {
+	partners = make(map[string]*tls.Config)
+	for _, host := range strings.Split(config.Get("push.partners", ""), ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		prefix := "push.partner." + host + "."
+		tlsConfig := &tls.Config{}
+		if caFile := config.Get(prefix+"ca", ""); caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in %s", caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		certFile := config.Get(prefix+"cert", "")
+		keyFile := config.Get(prefix+"key", "")
+		if certFile != "" || keyFile != "" {
+			if certFile == "" || keyFile == "" {
+				return nil, errors.New("Partner " + host +
+					" needs both a cert and a key")
+			}
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if tlsConfig.RootCAs == nil && tlsConfig.Certificates == nil {
+			return nil, errors.New("Partner " + host +
+				" has no ca, cert or key configured")
+		}
+		partners[host] = tlsConfig
+	}
+	return partners, nil
+}
@@ -0,0 +1,115 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func init() {
+	RegisterIdentityProvider("persona", OpenPersona)
+}
+
+// Persona (BrowserID) assertions, checked by the remote verifier.
+type PersonaProvider struct {
+	assertionBase
+}
+
+func OpenPersona(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (IdentityProvider, error) {
+	return &PersonaProvider{assertionBase{config: config,
+		logger: logger,
+		logCat: "auth:persona"}}, nil
+}
+
+func (self *PersonaProvider) LoginURL(state, nonce, challenge string) (string, error) {
+	return loginTemplate(self.config, "persona", state)
+}
+
+// Persona has no code to trade; users sign in with an assertion.
+func (self *PersonaProvider) Exchange(code, verifier, nonce string) (*Identity, error) {
+	return nil, ErrOauth
+}
+
+// verify a Persona assertion using the config values
+func (self *PersonaProvider) Verify(assertion string) (*Identity, error) {
+	var audience string
+
+	if err := self.checkChars(assertion); err != nil {
+		return nil, err
+	}
+
+	// pull the audience out of the assertion, if it's present.
+	if self.config.GetFlag("auth.audience_from_assertion") {
+		audience = self.extractAudience(assertion)
+	}
+	if audience == "" {
+		audience = self.config.Get("persona.audience",
+			"http://localhost:8080")
+	}
+	// Better verify for realz
+	validatorURL := self.config.Get("persona.verifier",
+		"https://verifier.login.persona.org/v2")
+	body, err := json.Marshal(
+		util.Fields{"assertion": assertion,
+			"audience": audience})
+	if err != nil {
+		self.logger.Error(self.logCat,
+			"Could not marshal assertion",
+			util.Fields{"error": err.Error()})
+		return nil, ErrAuthorization
+	}
+	if self.config.GetFlag("auth.show_assertion") {
+		fmt.Printf("### Validating Assertion:\n %s\n", body)
+	}
+	req, err := http.NewRequest("POST", validatorURL, bytes.NewReader(body))
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not POST assertion",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	cli := http.Client{}
+	res, err := cli.Do(req)
+	if err != nil {
+		self.logger.Error(self.logCat, "Persona verification failed",
+			util.Fields{"error": err.Error()})
+		return nil, ErrAuthorization
+	}
+
+	// Handle the verifier response
+	buffer, raw, err := parseBody(res.Body)
+	if isOk, ok := buffer["status"]; !ok || isOk != "okay" {
+		var errStr string
+		if err != nil {
+			errStr = err.Error()
+		} else if _, ok = buffer["reason"]; ok {
+			errStr = buffer["reason"].(string)
+		}
+		self.logger.Error(self.logCat, "Persona Auth Failed",
+			util.Fields{"error": errStr,
+				"body": raw})
+		return nil, ErrAuthorization
+	}
+
+	// extract the email
+	if idp, ok := buffer["idpClaims"]; ok {
+		if fxe, ok := idp.(map[string]interface{})["fxa-verifiedEmail"]; ok {
+			return &Identity{Email: fxe.(string)}, nil
+		}
+	}
+
+	email, ok := buffer["email"].(string)
+	if !ok {
+		self.logger.Error(self.logCat, "No email found in assertion",
+			util.Fields{"assertion": fmt.Sprintf("%+v", buffer)})
+		return nil, ErrAuthorization
+	}
+	return &Identity{Email: email}, nil
+}
@@ -5,45 +5,475 @@ package wmf
  * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
 
 import (
-	"bytes"
-	"crypto/tls"
-	"errors"
 	"mozilla.org/util"
 	"mozilla.org/wmf/storage"
+
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func SendPush(devRec *storage.Device, config *util.MzConfig) error {
-	// wow, so very tempted to make sure this matches the known push server.
-	bbody := []byte{}
-	body := bytes.NewReader(bbody)
-	/* If your server is not trustfully signed, the following will fail.
-	   If partners are unable/unwilling to trustfully sign servers,
-	   it is possible to skip validation by using
-	    &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-	   however that is not advised as a general policy for damn good reasons.
-
-	*/
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-		//NameToCertificate: config["partnerCertPool"],
-		//InsecureSkipVerify: true,
-		},
+var ErrPushGone = errors.New("Push endpoint gone")
+var ErrUnknownPushType = errors.New("Unknown push type")
+var ErrInvalidPushKeys = errors.New("Invalid push keys")
+var ErrInvalidPushUrl = errors.New("Invalid push url")
+var ErrUnknownWakeTransport = errors.New("Unknown wake transport")
+var ErrWakeHostNotAllowed = errors.New("Wake host not allowed")
+
+// A way to wake a device so that it checks in for its commands. (An
+// HTTP push protocol or another wake transport.)
+type PushProvider interface {
+	// Wake the device. payload may be nil, and is dropped by providers
+	// (or devices) that can't carry one.
+	Send(devRec *storage.Device, payload []byte) error
+}
+
+// Builds a provider. client is the shared push HTTP client.
+type PushOpener func(config *util.MzConfig, client *PushClient) (PushProvider, error)
+
+// HTTP push protocols, by the push type the device registered with.
+var pushOpeners = map[string]PushOpener{
+	storage.PUSH_SIMPLEPUSH: newSimplePush,
+	storage.PUSH_WEBPUSH:    newWebPush,
+}
+
+// Other wake transports, by the scheme of the device's push URL.
+// (http and https URLs use the push protocols above.) See wake.go
+var wakeTransports = map[string]PushOpener{
+	"udp":           newUdpWake,
+	"webhook+http":  newWebhookWake,
+	"webhook+https": newWebhookWake,
+}
+
+// The HTTP client shared by the providers. (Set up by NewHandler)
+var pushHTTP *PushClient
+
+// Providers are built once, on first use.
+var pushProviders = struct {
+	sync.Mutex
+	m map[string]PushProvider
+}{m: make(map[string]PushProvider)}
+
+// Add a wake transport for push URLs with the given scheme, so that
+// carriers and partners can plug in their own wake channels.
+// Call before the server starts.
+func RegisterWakeTransport(scheme string, opener PushOpener) {
+	defer pushProviders.Unlock()
+	pushProviders.Lock()
+	wakeTransports[strings.ToLower(scheme)] = opener
+}
+
+func validPushType(pushType string) bool {
+	_, ok := pushOpeners[pushType]
+	return ok
+}
+
+func isHttpScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// Devices pick their own push URLs, so a wake transport only goes to the
+// hosts listed for it in push.<transport>.hosts (e.g. push.udp.hosts or
+// push.webhook.hosts, comma separated, with the port if any).
+func wakeHostAllowed(config *util.MzConfig, scheme, host string) bool {
+	transport := strings.SplitN(scheme, "+", 2)[0]
+	host = strings.ToLower(host)
+	for _, allowed := range strings.Split(config.Get("push."+transport+".hosts",
+		""), ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && allowed == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that there is a way to reach a newly registered push URL.
+func checkPushUrl(config *util.MzConfig, pushUrl, pushType string) error {
+	u, err := url.Parse(pushUrl)
+	if err != nil || u.Host == "" {
+		return ErrInvalidPushUrl
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if isHttpScheme(scheme) {
+		return nil
+	}
+	defer pushProviders.Unlock()
+	pushProviders.Lock()
+	if _, ok := wakeTransports[scheme]; !ok {
+		return ErrUnknownWakeTransport
+	}
+	// Push protocols only make sense over HTTP.
+	if pushType != storage.PUSH_SIMPLEPUSH {
+		return ErrUnknownWakeTransport
+	}
+	if !wakeHostAllowed(config, scheme, u.Host) {
+		return ErrWakeHostNotAllowed
+	}
+	return nil
+}
+
+// Find the provider for the device: its wake transport, or for HTTP
+// push URLs, its push protocol.
+func pushProviderFor(devRec *storage.Device, config *util.MzConfig) (PushProvider, error) {
+	var opener PushOpener
+	var key string
+	var ok bool
+
+	u, err := url.Parse(devRec.PushUrl)
+	if err != nil {
+		return nil, ErrInvalidPushUrl
 	}
+	scheme := strings.ToLower(u.Scheme)
 
+	defer pushProviders.Unlock()
+	pushProviders.Lock()
+	if isHttpScheme(scheme) {
+		key = devRec.PushType
+		if key == "" {
+			key = storage.PUSH_SIMPLEPUSH
+		}
+		if opener, ok = pushOpeners[key]; !ok {
+			return nil, ErrUnknownPushType
+		}
+	} else {
+		key = scheme + ":"
+		if opener, ok = wakeTransports[scheme]; !ok {
+			return nil, ErrUnknownWakeTransport
+		}
+		// The list may have changed since the device registered.
+		if !wakeHostAllowed(config, scheme, u.Host) {
+			return nil, ErrWakeHostNotAllowed
+		}
+	}
+	if provider, ok := pushProviders.m[key]; ok {
+		return provider, nil
+	}
+	if pushHTTP == nil {
+		if pushHTTP, err = NewPushClient(config, nil); err != nil {
+			return nil, err
+		}
+	}
+	provider, err := opener(config, pushHTTP)
+	if err != nil {
+		return nil, err
+	}
+	pushProviders.m[key] = provider
+	return provider, nil
+}
+
+// Wake the device using the transport (or push protocol) it registered
+// with. Returns ErrPushGone if the endpoint is no longer known.
+func SendPush(devRec *storage.Device, config *util.MzConfig, payload []byte) error {
+	provider, err := pushProviderFor(devRec, config)
+	if err != nil {
+		return err
+	}
+	return provider.Send(devRec, payload)
+}
+
+// The push service refused the message. RetryAfter is set if it said
+// when to try again.
+type PushError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (self *PushError) Error() string {
+	return fmt.Sprintf("Push Server Error (%d)", self.StatusCode)
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func retryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Map the push service reply to an error.
+func pushStatus(resp *http.Response, ok ...int) error {
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrPushGone
+	}
+	return &PushError{StatusCode: resp.StatusCode,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+}
+
+// Legacy SimplePush. The endpoint is just poked; no data is carried.
+type simplePush struct {
+	client *PushClient
+}
+
+func newSimplePush(config *util.MzConfig, client *PushClient) (PushProvider, error) {
+	return &simplePush{client: client}, nil
+}
+
+func (self *simplePush) Send(devRec *storage.Device, payload []byte) error {
+	// wow, so very tempted to make sure this matches the known push server.
+	body := bytes.NewReader([]byte{})
 	req, err := http.NewRequest("PUT", devRec.PushUrl, body)
 	if err != nil {
 		return err
 	}
-	cli := http.Client{Transport: tr}
-	resp, err := cli.Do(req)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
 	// Close the body, otherwise Memory leak!
 	defer resp.Body.Close()
+	return pushStatus(resp, http.StatusOK)
+}
+
+/* Web Push (RFC 8030).
+   Messages are signed with the server's VAPID key (RFC 8292) if one is
+   configured, and any payload is encrypted to the device's keys using
+   aes128gcm (RFC 8291). Devices that registered without keys get an
+   empty message.
+*/
+type webPush struct {
+	client  *PushClient
+	key     *ecdsa.PrivateKey
+	subject string
+	ttl     string
+	urgency string
+}
+
+func newWebPush(config *util.MzConfig, client *PushClient) (PushProvider, error) {
+	self := &webPush{
+		client:  client,
+		subject: config.Get("push.vapid_subject", ""),
+		ttl:     config.Get("push.ttl", "86400"),
+		urgency: config.Get("push.urgency", "high"),
+	}
+	if keyFile := config.Get("push.vapid_key", ""); keyFile != "" {
+		key, err := loadVapidKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		self.key = key
+	}
+	return self, nil
+}
+
+// Read the VAPID signing key (PEM, P-256).
+func loadVapidKey(path string) (*ecdsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM data in VAPID key file")
 	}
-	if resp.StatusCode != 200 {
-		return errors.New("Push Server Error")
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pkey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pkey.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errors.New("VAPID key must be a P-256 EC key")
+	}
+	return key, nil
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Clients vary on whether they pad base64url keys.
+func unb64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Check the keys a device registered for Web Push.
+func validPushKeys(p256dh, auth string) error {
+	pub, err := unb64url(p256dh)
+	if err != nil {
+		return ErrInvalidPushKeys
+	}
+	if _, err = ecdh.P256().NewPublicKey(pub); err != nil {
+		return ErrInvalidPushKeys
+	}
+	secret, err := unb64url(auth)
+	if err != nil || len(secret) != 16 {
+		return ErrInvalidPushKeys
 	}
 	return nil
 }
+
+// The VAPID Authorization header value for an endpoint.
+func (self *webPush) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := replyType{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+	}
+	if self.subject != "" {
+		claims["sub"] = self.subject
+	}
+	header, _ := json.Marshal(replyType{"typ": "JWT", "alg": "ES256"})
+	body, _ := json.Marshal(claims)
+	unsigned := b64url(header) + "." + b64url(body)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, self.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are the raw 32 byte r and s.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	pub, err := self.key.PublicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64url(sig),
+		b64url(pub.Bytes())), nil
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// Encrypt a payload to the device's keys as a single aes128gcm record.
+func encryptPayload(payload []byte, p256dh, auth string) ([]byte, error) {
+	uaRaw, err := unb64url(p256dh)
+	if err != nil {
+		return nil, ErrInvalidPushKeys
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaRaw)
+	if err != nil {
+		return nil, ErrInvalidPushKeys
+	}
+	authSecret, err := unb64url(auth)
+	if err != nil {
+		return nil, ErrInvalidPushKeys
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asRaw := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// RFC 8291 section 3.4. (Each HKDF output fits in one block, so
+	// expand is a single HMAC.)
+	prkKey := hmacSha256(authSecret, ecdhSecret)
+	keyInfo := append([]byte("WebPush: info\x00"), uaRaw...)
+	keyInfo = append(keyInfo, asRaw...)
+	ikm := hmacSha256(prkKey, keyInfo, []byte{1})
+	prk := hmacSha256(salt, ikm)
+	cek := hmacSha256(prk, []byte("Content-Encoding: aes128gcm\x00\x01"))[:16]
+	nonce := hmacSha256(prk, []byte("Content-Encoding: nonce\x00\x01"))[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record.
+	record := append(append([]byte{}, payload...), 2)
+	recordSize := uint32(len(record) + gcm.Overhead())
+	if recordSize < 18 {
+		recordSize = 18
+	}
+
+	// RFC 8188 header: salt, record size, key id (our public key)
+	out := bytes.NewBuffer(salt)
+	binary.Write(out, binary.BigEndian, recordSize)
+	out.WriteByte(byte(len(asRaw)))
+	out.Write(asRaw)
+	out.Write(gcm.Seal(nil, nonce, record, nil))
+	return out.Bytes(), nil
+}
+
+func (self *webPush) Send(devRec *storage.Device, payload []byte) error {
+	var body []byte
+	var err error
+
+	if payload != nil && devRec.PushKey != "" && devRec.PushAuth != "" {
+		if body, err = encryptPayload(payload, devRec.PushKey,
+			devRec.PushAuth); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("POST", devRec.PushUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TTL", self.ttl)
+	req.Header.Set("Urgency", self.urgency)
+	if body != nil {
+		req.Header.Set("Content-Encoding", "aes128gcm")
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if self.key != nil {
+		auth, err := self.vapid(devRec.PushUrl)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return pushStatus(resp, http.StatusCreated, http.StatusOK,
+		http.StatusAccepted)
+}
@@ -0,0 +1,251 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPushBusy = errors.New("Too many pushes in flight to push server")
+var ErrCircuitOpen = errors.New("Push server circuit open")
+
+/* Shared HTTP client for talking to push services.
+   Every request has a deadline, each push host gets at most
+   push.max_per_host requests in flight, and a host that keeps failing
+   has its circuit opened: requests fail straight away for
+   push.breaker_cooldown seconds, after which a single probe is let
+   through to see if it has recovered.
+   Devices pick their own push URLs, so only the configured push hosts
+   (push.hosts and push.partners) are tracked one by one. Every other
+   host shares a single "other" bucket.
+*/
+type PushClient struct {
+	sync.Mutex
+	client     *http.Client
+	partners   map[string]*http.Client // by host, see partners.go
+	metrics    *util.Metrics
+	maxPerHost int
+	wait       time.Duration
+	threshold  int
+	cooldown   time.Duration
+	tracked    map[string]bool // hosts with their own bucket
+	hosts      map[string]*pushHost
+}
+
+// The bucket shared by push hosts that aren't configured.
+const PUSH_OTHER_HOSTS = "other"
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+)
+
+// gauge values for the breaker states
+var breakerGauge = map[string]int64{
+	BREAKER_CLOSED:    0,
+	BREAKER_HALF_OPEN: 1,
+	BREAKER_OPEN:      2,
+}
+
+type pushHost struct {
+	slots    chan struct{}
+	state    string
+	failures int // consecutive
+	openedAt time.Time
+	probing  bool
+}
+
+func NewPushClient(config *util.MzConfig, metrics *util.Metrics) (*PushClient, error) {
+	seconds := func(key string, def int64) time.Duration {
+		return time.Duration(configInt(config, key, def)) * time.Second
+	}
+	/* Push servers that are not trustfully signed must be configured as
+	   partners with their own CA (see partners.go). Certificate
+	   validation is never turned off.
+	*/
+	newClient := func(tlsConfig *tls.Config) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				Dial: (&net.Dialer{
+					Timeout:   seconds("push.connect_timeout", 5),
+					KeepAlive: 30 * time.Second,
+				}).Dial,
+				TLSHandshakeTimeout:   seconds("push.connect_timeout", 5),
+				ResponseHeaderTimeout: seconds("push.timeout", 10),
+				TLSClientConfig:       tlsConfig,
+			},
+			Timeout: seconds("push.timeout", 10),
+		}
+	}
+	partnerTLS, err := loadPartnerTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	partners := make(map[string]*http.Client)
+	for host, tlsConfig := range partnerTLS {
+		partners[host] = newClient(tlsConfig)
+	}
+	tracked := make(map[string]bool)
+	for _, host := range strings.Split(config.Get("push.hosts",
+		"updates.push.services.mozilla.com"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			tracked[host] = true
+		}
+	}
+	for host := range partners {
+		tracked[host] = true
+	}
+	maxPerHost := int(configInt(config, "push.max_per_host", 16))
+	if maxPerHost < 1 {
+		maxPerHost = 1
+	}
+	return &PushClient{
+		client:     newClient(&tls.Config{}),
+		partners:   partners,
+		metrics:    metrics,
+		maxPerHost: maxPerHost,
+		wait:       seconds("push.host_wait", 2),
+		threshold:  int(configInt(config, "push.breaker_failures", 5)),
+		cooldown:   seconds("push.breaker_cooldown", 30),
+		tracked:    tracked,
+		hosts:      make(map[string]*pushHost),
+	}, nil
+}
+
+// The bucket a push host's requests count against.
+func (self *PushClient) bucket(host string) string {
+	if host = strings.ToLower(host); self.tracked[host] {
+		return host
+	}
+	return PUSH_OTHER_HOSTS
+}
+
+// (Lock must be held)
+func (self *PushClient) host(name string) *pushHost {
+	h, ok := self.hosts[name]
+	if !ok {
+		h = &pushHost{
+			slots: make(chan struct{}, self.maxPerHost),
+			state: BREAKER_CLOSED,
+		}
+		self.hosts[name] = h
+	}
+	return h
+}
+
+// (Lock must be held)
+func (self *PushClient) setState(name string, h *pushHost, state string) {
+	if h.state == state {
+		return
+	}
+	h.state = state
+	if self.metrics != nil {
+		self.metrics.Gauge("push.breaker."+name, breakerGauge[state])
+		self.metrics.Increment("push.breaker." + state)
+	}
+}
+
+// May a request go to the host? Moves an open circuit to half-open
+// once the cooldown is over, letting one probe through.
+func (self *PushClient) allow(name string) (*pushHost, error) {
+	defer self.Unlock()
+	self.Lock()
+
+	h := self.host(name)
+	switch h.state {
+	case BREAKER_OPEN:
+		if time.Since(h.openedAt) < self.cooldown {
+			return nil, ErrCircuitOpen
+		}
+		self.setState(name, h, BREAKER_HALF_OPEN)
+		h.probing = true
+	case BREAKER_HALF_OPEN:
+		if h.probing {
+			return nil, ErrCircuitOpen
+		}
+		h.probing = true
+	}
+	return h, nil
+}
+
+// Record how a request to the host went.
+func (self *PushClient) record(name string, h *pushHost, failed bool) {
+	defer self.Unlock()
+	self.Lock()
+
+	h.probing = false
+	if !failed {
+		h.failures = 0
+		self.setState(name, h, BREAKER_CLOSED)
+		return
+	}
+	h.failures++
+	if h.state == BREAKER_HALF_OPEN ||
+		(self.threshold > 0 && h.failures >= self.threshold) {
+		h.openedAt = time.Now()
+		self.setState(name, h, BREAKER_OPEN)
+	}
+}
+
+// Send a request to a push service. Fails fast with ErrCircuitOpen if
+// the host is known to be down, or ErrPushBusy if it already has too
+// many requests in flight.
+func (self *PushClient) Do(req *http.Request) (*http.Response, error) {
+	name := self.bucket(req.URL.Host)
+	h, err := self.allow(name)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case h.slots <- struct{}{}:
+	case <-time.After(self.wait):
+		// Busy isn't the host's fault; don't count it against it.
+		self.Lock()
+		h.probing = false
+		self.Unlock()
+		if self.metrics != nil {
+			self.metrics.Increment("push.busy")
+		}
+		return nil, ErrPushBusy
+	}
+	defer func() { <-h.slots }()
+
+	client, ok := self.partners[strings.ToLower(req.URL.Host)]
+	if !ok {
+		client = self.client
+	}
+	resp, err := client.Do(req)
+	// Server errors and timeouts count against the host; a 4xx is
+	// about the message, not the service.
+	self.record(name, h, err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// How many push buckets are in each breaker state. (/status/ is
+// public, so which hosts they are is left to the metrics.)
+func (self *PushClient) Status() map[string]int {
+	defer self.Unlock()
+	self.Lock()
+
+	reply := map[string]int{
+		BREAKER_CLOSED:    0,
+		BREAKER_HALF_OPEN: 0,
+		BREAKER_OPEN:      0,
+	}
+	for _, h := range self.hosts {
+		reply[h.state]++
+	}
+	return reply
+}
@@ -0,0 +1,84 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testPushServer(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.WriteHeader(status)
+		}))
+}
+
+// Only configured push hosts get their own breaker; the rest share one.
+func TestPushClientBuckets(t *testing.T) {
+	known := testPushServer(http.StatusCreated)
+	defer known.Close()
+	failing := testPushServer(http.StatusInternalServerError)
+	defer failing.Close()
+	other := testPushServer(http.StatusCreated)
+	defer other.Close()
+	knownHost, _ := url.Parse(known.URL)
+
+	file, err := ioutil.TempFile("", "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("push.hosts=" + knownHost.Host + "\n" +
+		"push.breaker_failures=2\n" +
+		"logger.filter=0\n")
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewPushClient(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(server *httptest.Server) error {
+		req, _ := http.NewRequest("POST", server.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	send(failing)
+	send(failing)
+	if err = send(other); err != ErrCircuitOpen {
+		t.Errorf("other hosts: got %v, want %v", err, ErrCircuitOpen)
+	}
+	if err = send(known); err != nil {
+		t.Errorf("configured host: %s", err)
+	}
+	if len(client.hosts) != 2 {
+		t.Errorf("tracking %d hosts", len(client.hosts))
+	}
+
+	status := client.Status()
+	if status[BREAKER_OPEN] != 1 || status[BREAKER_CLOSED] != 1 {
+		t.Errorf("status: %v", status)
+	}
+	// /status/ is public; it doesn't name the hosts.
+	reply, _ := json.Marshal(status)
+	if strings.Contains(string(reply), "127.0.0.1") {
+		t.Errorf("status names hosts: %s", reply)
+	}
+}
@@ -0,0 +1,160 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Location links.
+   An owner may hand out a link showing a device's last known location
+   (e.g. to a family member) without sharing their sign in. The link is
+   a Hawk bewit for /<ver>/shared/<deviceid>, signed with the device's
+   secret, so it stops working when it expires, or the device's secret
+   changes (registration, rotation or revocation).
+*/
+
+// Bewit ext for location links, so that bewits minted for anything
+// else can't be used to read the location.
+const BEWIT_LOCATION = "location"
+
+// Mint a link to a device's last known location.
+// POST /1/share/<deviceid> {"ttl":secs} (ttl is optional)
+// returns {"url":..., "expires":<epoch>}
+func (self *Handler) Share(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Share"
+
+	resp.Header().Set("Content-Type", "application/json")
+	if req.Method != "POST" {
+		http.Error(resp, "Method Not Allowed", 405)
+		return
+	}
+	devRec, userId := self.getOwnedDevice(resp, req)
+	if devRec == nil {
+		return
+	}
+	if devRec.Secret == "" {
+		// Revoked; there is nothing to sign the link with.
+		http.Error(resp, "Conflict", 409)
+		return
+	}
+
+	args := struct {
+		TTL int64 `json:"ttl"`
+	}{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &args)
+	}
+	if err != nil || args.TTL < 0 {
+		http.Error(resp, "Bad Request", 400)
+		return
+	}
+	maxTTL := configInt(self.config, "share.max_ttl", 86400)
+	if args.TTL == 0 {
+		args.TTL = configInt(self.config, "share.ttl", 3600)
+	}
+	if args.TTL > maxTTL {
+		args.TTL = maxTTL
+	}
+	expires := time.Now().UTC().Unix() + args.TTL
+
+	verRoot := strings.SplitN(self.config.Get("VERSION", "0"), ".", 2)[0]
+	path := fmt.Sprintf("/%s/shared/%s", verRoot, devRec.ID)
+	// The link is served by the host the owner is talking to.
+	hawk := Hawk{config: self.config, logger: self.logger, Path: path}
+	hawk.Host, hawk.Port = hawk.getHostPort(req)
+	bewit := hawk.Bewit(req, devRec.ID, devRec.Secret, expires,
+		BEWIT_LOCATION)
+	proto := "https"
+	if self.config.Get("ws_proto", "wss") == "ws" {
+		proto = "http"
+	}
+
+	self.logger.Info(self.logCat, "Location link created",
+		util.Fields{"deviceId": devRec.ID,
+			"userId":  userId,
+			"expires": fmt.Sprintf("%d", expires)})
+	reply, _ := json.Marshal(replyType{
+		"url": fmt.Sprintf("%s://%s%s?bewit=%s", proto, req.Host, path,
+			bewit),
+		"expires": expires})
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	self.metrics.Increment("page.share")
+	resp.Write(reply)
+}
+
+// Show the last known location of a device to the holder of a link
+// from Share.
+// GET /1/shared/<deviceid>?bewit=...
+// returns {"deviceid":..., "name":..., "position":{...}|null, "expires":<epoch>}
+func (self *Handler) Shared(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Shared"
+
+	resp.Header().Set("Content-Type", "application/json")
+	hawk := Hawk{config: self.config, logger: self.logger}
+	err := hawk.ParseBewit(req)
+	if err == nil && (hawk.Id != getDevFromUrl(req.URL) ||
+		hawk.Extra != BEWIT_LOCATION) {
+		err = ErrInvalidBewit
+	}
+	var devRec *storage.Device
+	if err == nil {
+		devRec, err = self.store.GetDeviceInfo(hawk.Id)
+		if err != nil || devRec == nil || devRec.Secret == "" {
+			err = ErrInvalidBewit
+		}
+	}
+	if err == nil {
+		err = hawk.CheckBewit(devRec.Secret)
+	}
+	if err != nil {
+		self.logger.Warn(self.logCat, "Rejected location link",
+			util.Fields{"error": err.Error(),
+				"path": req.URL.Path})
+		self.metrics.Increment("hawk.bewit.rejected")
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+
+	var position interface{}
+	positions, err := self.store.GetPositions(devRec.ID)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get position",
+			util.Fields{"error": err.Error(),
+				"deviceId": devRec.ID})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	if len(positions) > 0 {
+		latest := positions[0]
+		// Only the fix itself; not what the device was asked.
+		latest.Cmd = nil
+		position = latest
+	}
+	expires, _ := strconv.ParseInt(hawk.Time, 10, 64)
+	reply, _ := json.Marshal(replyType{
+		"deviceid": devRec.ID,
+		"name":     devRec.Name,
+		"position": position,
+		"expires":  expires})
+	if self.config.GetFlag("debug.show_output") {
+		fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	self.metrics.Increment("page.shared")
+	resp.Write(reply)
+}
@@ -0,0 +1,952 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("memory", OpenMemory)
+}
+
+/* In memory storage driver.
+   Useful for tests and single node demos. Nothing survives a restart.
+   The "tables" mirror the ones created by the Postgres driver.
+*/
+type MemStore struct {
+	sync.RWMutex
+	config   *util.MzConfig
+	logger   *util.HekaLogger
+	metrics  *util.Metrics
+	logCat   string
+	defExpry int64
+	lastId   int64
+	// deviceInfo
+	devices map[string]*memDevice
+	// userToDeviceMap
+	userMap []*memUserDevice
+	// commandLog, oldest first
+	commands map[string][]*Command
+	// pushOutbox
+	outbox map[int64]*PushJob
+	// position
+	positions map[string][]*memPosition
+	// userRetention, deviceRetention
+	userRetention   map[string]int64
+	deviceRetention map[string]int64
+	// geofence, geofenceEvent
+	geofences      map[string][]*Geofence
+	geofenceEvents map[string][]GeofenceEvent
+	// meta
+	meta map[string]string
+	// nonce
+	nonces     map[string]*memNonce
+	hawkNonces *NonceLRU
+	// apiToken, by hash
+	apiTokens map[string]*ApiToken
+}
+
+type memDevice struct {
+	lockable     bool
+	loggedIn     bool
+	lastExchange time.Time
+	hawkSecret   string
+	prevSecret   string
+	prevExpires  time.Time
+	pushUrl      string
+	accepts      string
+	accessToken  string
+	capabilities string
+	pushType     string
+	pushKey      string
+	pushAuth     string
+	pushGone     bool
+}
+
+type memUserDevice struct {
+	userId   string
+	deviceId string
+	name     string
+	date     time.Time
+}
+
+type memPosition struct {
+	time      time.Time
+	latitude  float64
+	longitude float64
+	altitude  float64
+	accuracy  float64
+	speed     float64
+	heading   float64
+	battery   float64
+	provider  string
+}
+
+type memNonce struct {
+	val  string
+	time time.Time
+}
+
+// There is only one in memory store per process, so that every Open
+// sees the same data.
+var (
+	memStore     *MemStore
+	memStoreOnce sync.Once
+)
+
+// Open the in memory store.
+func OpenMemory(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store Storage, err error) {
+	memStoreOnce.Do(func() {
+		memStore = newMemStore(config, logger, metrics)
+	})
+	return memStore, nil
+}
+
+func newMemStore(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) *MemStore {
+	return &MemStore{
+		config:          config,
+		logger:          logger,
+		metrics:         metrics,
+		logCat:          "storage",
+		defExpry:        defaultExpry(config),
+		devices:         make(map[string]*memDevice),
+		commands:        make(map[string][]*Command),
+		outbox:          make(map[int64]*PushJob),
+		positions:       make(map[string][]*memPosition),
+		userRetention:   make(map[string]int64),
+		deviceRetention: make(map[string]int64),
+		geofences:       make(map[string][]*Geofence),
+		geofenceEvents:  make(map[string][]GeofenceEvent),
+		meta:            make(map[string]string),
+		nonces:          make(map[string]*memNonce),
+		apiTokens:       make(map[string]*ApiToken),
+		hawkNonces: NewNonceLRU(int(configInt(config,
+			"hawk.nonce_cache_size", 100000))),
+	}
+}
+
+// There is no schema to manage, so the in memory store is always current.
+func (self *MemStore) SchemaVersion() (current, latest int, err error) {
+	return 0, 0, nil
+}
+
+// Nothing to migrate.
+func (self *MemStore) Migrate(target int) (err error) {
+	if target > 0 {
+		return ErrBadMigration
+	}
+	return nil
+}
+
+// Register a new device to a given userID.
+func (self *MemStore) RegisterDevice(userid string, dev Device) (devId string, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev.ID == "" {
+		dev.ID, _ = util.GenUUID4()
+	}
+	// Purge old registration records.
+	self.unmapDevice(dev.ID)
+	self.devices[dev.ID] = &memDevice{
+		lockable:     dev.HasPasscode,
+		loggedIn:     dev.LoggedIn,
+		lastExchange: time.Now().UTC(),
+		hawkSecret:   dev.Secret,
+		accepts:      dev.Accepts,
+		pushUrl:      dev.PushUrl,
+		capabilities: dev.Capabilities,
+		pushType:     dev.PushType,
+		pushKey:      dev.PushKey,
+		pushAuth:     dev.PushAuth,
+	}
+	self.userMap = append(self.userMap, &memUserDevice{
+		userId:   userid,
+		deviceId: dev.ID,
+		name:     dev.Name,
+		date:     time.Now().UTC(),
+	})
+	return dev.ID, nil
+}
+
+// remove the userToDeviceMap records for a device. (Lock must be held)
+func (self *MemStore) unmapDevice(devId string) {
+	var kept []*memUserDevice
+	for _, ud := range self.userMap {
+		if ud.deviceId != devId {
+			kept = append(kept, ud)
+		}
+	}
+	self.userMap = kept
+}
+
+// find the userToDeviceMap record for a device. (Lock must be held)
+func (self *MemStore) userDevice(devId string) *memUserDevice {
+	for _, ud := range self.userMap {
+		if ud.deviceId == devId {
+			return ud
+		}
+	}
+	return nil
+}
+
+// Return known info about a device.
+func (self *MemStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	dev, ok := self.devices[devId]
+	ud := self.userDevice(devId)
+	if !ok || ud == nil {
+		return nil, ErrUnknownDevice
+	}
+	reply := &Device{
+		ID:          devId,
+		User:        ud.userId,
+		Name:        ud.name,
+		Secret:      dev.hawkSecret,
+		HasPasscode: dev.lockable,
+		//If we have a pushUrl, the user is logged in.
+		LoggedIn:     dev.pushUrl != "",
+		LastExchange: int32(dev.lastExchange.Unix()),
+		PushUrl:      dev.pushUrl,
+		Accepts:      dev.accepts,
+		AccessToken:  dev.accessToken,
+		Capabilities: dev.capabilities,
+		PushType:     dev.pushType,
+		PushKey:      dev.pushKey,
+		PushAuth:     dev.pushAuth,
+		PushGone:     dev.pushGone,
+	}
+	if dev.prevSecret != "" {
+		reply.PrevSecret = dev.prevSecret
+		reply.PrevSecretExpires = dev.prevExpires.Unix()
+	}
+	return reply, nil
+}
+
+// Return the latest known position for a device.
+func (self *MemStore) GetPositions(devId string) (positions []Position, err error) {
+	return self.GetPositionHistory(devId, 0, 0, 1)
+}
+
+// Return the positions recorded for a device between since and until
+// (epoch seconds, 0 for unbounded), newest first.
+func (self *MemStore) GetPositionHistory(devId string, since, until int64, limit int) (positions []Position, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	// positions are appended, so walk backwards for newest first.
+	pos := self.positions[devId]
+	for i := len(pos) - 1; i >= 0; i-- {
+		if limit > 0 && len(positions) >= limit {
+			break
+		}
+		p := pos[i]
+		t := p.time.Unix()
+		if (since != 0 && t < since) || (until != 0 && t > until) {
+			continue
+		}
+		positions = append(positions, Position{
+			Latitude:  p.latitude,
+			Longitude: p.longitude,
+			Altitude:  p.altitude,
+			Time:      t,
+			Accuracy:  p.accuracy,
+			Speed:     p.speed,
+			Heading:   p.heading,
+			Battery:   p.battery,
+			Provider:  p.provider})
+	}
+	return positions, nil
+}
+
+// Get up to limit of the oldest undelivered commands and mark them
+// delivered. Commands past their expiry are marked expired and skipped.
+func (self *MemStore) GetPending(devId string, limit int) (commands []Command, err error) {
+	self.Lock()
+	now := time.Now().Unix()
+	for _, c := range self.commands[devId] {
+		if limit > 0 && len(commands) >= limit {
+			break
+		}
+		if c.State != CMD_QUEUED && c.State != CMD_PUSHED {
+			continue
+		}
+		if c.Expires > 0 && c.Expires < now {
+			c.State = CMD_EXPIRED
+			c.Updated = now
+			self.logger.Info(self.logCat, "Command expired",
+				util.Fields{"deviceId": devId,
+					"cmd": c.Type})
+			self.metrics.Increment("cmd.expired")
+			continue
+		}
+		self.metrics.Timer("cmd.pending", now-c.Created)
+		c.State = CMD_DELIVERED
+		c.Updated = now
+		commands = append(commands, *c)
+	}
+	self.Unlock()
+	self.Touch(devId)
+	return commands, nil
+}
+
+func (self *MemStore) GetUserFromDevice(deviceId string) (userId, name string, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	if ud := self.userDevice(deviceId); ud != nil {
+		return ud.userId, ud.name, nil
+	}
+	return "", "", ErrUnknownDevice
+}
+
+// Get all known devices for this user.
+func (self *MemStore) GetDevicesForUser(userId string) (devices []DeviceList, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	var found []*memUserDevice
+	for _, ud := range self.userMap {
+		if ud.userId == userId {
+			found = append(found, ud)
+		}
+	}
+	sort.Sort(byDate(found))
+	for _, ud := range found {
+		name := ud.name
+		if name == "" {
+			name = ud.deviceId
+		}
+		devices = append(devices, DeviceList{ID: ud.deviceId, Name: name})
+	}
+	return devices, nil
+}
+
+type byDate []*memUserDevice
+
+func (a byDate) Len() int           { return len(a) }
+func (a byDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDate) Less(i, j int) bool { return a[i].date.Before(a[j].date) }
+
+// Store a command into the list of pending commands for a device.
+func (self *MemStore) StoreCommand(devId, cmdType, command string, expires int64) (cmdId int64, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	self.logger.Debug(self.logCat, "Storing Command",
+		util.Fields{"deviceId": devId, "command": command})
+	self.lastId++
+	now := time.Now().Unix()
+	self.commands[devId] = append(self.commands[devId], &Command{
+		ID:       self.lastId,
+		DeviceID: devId,
+		Type:     cmdType,
+		Cmd:      command,
+		State:    CMD_QUEUED,
+		Created:  now,
+		Updated:  now,
+		Expires:  expires})
+	return self.lastId, nil
+}
+
+// Cancel a command that has not been delivered yet.
+func (self *MemStore) CancelCommand(devId string, cmdId int64) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	for _, c := range self.commands[devId] {
+		if c.ID != cmdId {
+			continue
+		}
+		if c.State != CMD_QUEUED && c.State != CMD_PUSHED {
+			return ErrCommandDelivered
+		}
+		c.State = CMD_CANCELLED
+		c.Updated = time.Now().Unix()
+		return nil
+	}
+	return ErrUnknownCommand
+}
+
+// Move an undelivered command to a new state, noting any detail.
+func (self *MemStore) SetCommandState(devId string, cmdId int64, state, detail string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	for _, c := range self.commands[devId] {
+		if c.ID != cmdId {
+			continue
+		}
+		if c.State == CMD_QUEUED || c.State == CMD_PUSHED {
+			c.State = state
+			c.Detail = detail
+			c.Updated = time.Now().Unix()
+		}
+		return nil
+	}
+	return nil
+}
+
+// Move the most recently delivered command of cmdType to a new state.
+func (self *MemStore) AckCommand(devId, cmdType, state, detail string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	cmds := self.commands[devId]
+	for i := len(cmds) - 1; i >= 0; i-- {
+		c := cmds[i]
+		if c.Type == cmdType && c.State == CMD_DELIVERED {
+			c.State = state
+			c.Detail = detail
+			c.Updated = time.Now().Unix()
+			return nil
+		}
+	}
+	return nil
+}
+
+// Add a failed push to the outbox to be retried.
+func (self *MemStore) QueuePush(job PushJob) (jobId int64, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	self.lastId++
+	job.ID = self.lastId
+	self.outbox[job.ID] = &job
+	return job.ID, nil
+}
+
+// find a command by id. (Lock must be held)
+func (self *MemStore) command(devId string, cmdId int64) *Command {
+	for _, c := range self.commands[devId] {
+		if c.ID == cmdId {
+			return c
+		}
+	}
+	return nil
+}
+
+// Claim the outbox entries that are due a retry.
+func (self *MemStore) ClaimPushes(limit int, lease int64) (jobs []PushJob, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	now := time.Now().Unix()
+	for _, job := range self.outbox {
+		if job.NextAttempt <= now {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Sort(byNextAttempt(jobs))
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	for i := range jobs {
+		self.outbox[jobs[i].ID].NextAttempt = now + lease
+		jobs[i].NextAttempt = now + lease
+		if c := self.command(jobs[i].DeviceID, jobs[i].CmdID); c != nil {
+			jobs[i].CmdState = c.State
+		}
+	}
+	return jobs, nil
+}
+
+type byNextAttempt []PushJob
+
+func (a byNextAttempt) Len() int           { return len(a) }
+func (a byNextAttempt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byNextAttempt) Less(i, j int) bool { return a[i].NextAttempt < a[j].NextAttempt }
+
+// Record a failed attempt and when to try again.
+func (self *MemStore) RetryPush(jobId int64, attempts int, next int64, lastError string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if job, ok := self.outbox[jobId]; ok {
+		job.Attempts = attempts
+		job.NextAttempt = next
+		job.LastError = lastError
+	}
+	return nil
+}
+
+// Remove an entry from the outbox.
+func (self *MemStore) DeletePush(jobId int64) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	delete(self.outbox, jobId)
+	return nil
+}
+
+// Return the command history for a device, newest first.
+func (self *MemStore) GetCommands(devId string, limit int) (commands []Command, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	cmds := self.commands[devId]
+	for i := len(cmds) - 1; i >= 0; i-- {
+		if limit > 0 && len(commands) >= limit {
+			break
+		}
+		commands = append(commands, *cmds[i])
+	}
+	return commands, nil
+}
+
+func (self *MemStore) SetAccessToken(devId, token string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev, ok := self.devices[devId]; ok {
+		dev.accessToken = token
+		dev.lastExchange = time.Now().UTC()
+	}
+	return nil
+}
+
+// Note that the push service no longer knows the device's endpoint.
+func (self *MemStore) SetPushGone(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev, ok := self.devices[devId]; ok {
+		dev.pushGone = true
+	}
+	return nil
+}
+
+// Replace the device's HAWK secret, keeping the old one for grace
+// seconds. (Nothing is at rest here, so secrets are kept as they are.)
+func (self *MemStore) RotateSecret(devId, secret string, grace int64) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	dev, ok := self.devices[devId]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	now := time.Now().UTC()
+	// If the device hasn't picked up the last new secret yet, it is
+	// still using the one before that.
+	if dev.prevSecret == "" || !now.Before(dev.prevExpires) {
+		dev.prevSecret = dev.hawkSecret
+	}
+	dev.prevExpires = now.Add(time.Duration(grace) * time.Second)
+	dev.hawkSecret = secret
+	return nil
+}
+
+// Forget the device's previous HAWK secret.
+func (self *MemStore) DropPrevSecret(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev, ok := self.devices[devId]; ok {
+		dev.prevSecret = ""
+		dev.prevExpires = time.Time{}
+	}
+	return nil
+}
+
+// Remove the device's HAWK secrets.
+func (self *MemStore) RevokeSecret(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	dev, ok := self.devices[devId]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	dev.hawkSecret = ""
+	dev.prevSecret = ""
+	dev.prevExpires = time.Time{}
+	return nil
+}
+
+// Shorthand function to set the lock state for a device.
+func (self *MemStore) SetDeviceLock(devId string, state bool) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev, ok := self.devices[devId]; ok {
+		dev.lockable = state
+		dev.lastExchange = time.Now().UTC()
+	}
+	return nil
+}
+
+// Add the location information to the known set for a device.
+func (self *MemStore) SetDeviceLocation(devId string, position Position) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	self.positions[devId] = append(self.positions[devId], &memPosition{
+		time:      time.Now().UTC(),
+		latitude:  position.Latitude,
+		longitude: position.Longitude,
+		altitude:  position.Altitude,
+		accuracy:  position.Accuracy,
+		speed:     position.Speed,
+		heading:   position.Heading,
+		battery:   position.Battery,
+		provider:  position.Provider})
+	return nil
+}
+
+// Remove expired postion information for a device, according to its
+// retention settings. The latest position is always kept.
+func (self *MemStore) GcPosition(devId string) (err error) {
+	_, _, expry, _ := self.GetRetention(devId)
+
+	defer self.Unlock()
+	self.Lock()
+
+	pos := self.positions[devId]
+	if len(pos) < 2 {
+		return nil
+	}
+	cutoff := time.Now().Add(-time.Duration(expry) * time.Second)
+	var kept []*memPosition
+	for _, p := range pos[:len(pos)-1] {
+		if !p.time.Before(cutoff) {
+			kept = append(kept, p)
+		}
+	}
+	self.positions[devId] = append(kept, pos[len(pos)-1])
+	// geofence events follow the same retention.
+	var events []GeofenceEvent
+	for _, e := range self.geofenceEvents[devId] {
+		if e.Time >= cutoff.Unix() {
+			events = append(events, e)
+		}
+	}
+	self.geofenceEvents[devId] = events
+	// as does the history of finished commands.
+	var cmds []*Command
+	for _, c := range self.commands[devId] {
+		if c.Updated >= cutoff.Unix() ||
+			c.State == CMD_QUEUED || c.State == CMD_PUSHED {
+			cmds = append(cmds, c)
+		}
+	}
+	self.commands[devId] = cmds
+	return nil
+}
+
+// Return the ids of every registered device.
+func (self *MemStore) GetAllDeviceIds() (devIds []string, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	for id := range self.devices {
+		devIds = append(devIds, id)
+	}
+	return devIds, nil
+}
+
+// Set how long (in seconds) to keep a user's positions. 0 clears it.
+func (self *MemStore) SetUserRetention(userId string, seconds int64) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if seconds <= 0 {
+		delete(self.userRetention, userId)
+	} else {
+		self.userRetention[userId] = seconds
+	}
+	return nil
+}
+
+// Set how long (in seconds) to keep a device's positions. 0 clears it.
+func (self *MemStore) SetDeviceRetention(devId string, seconds int64) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if seconds <= 0 {
+		delete(self.deviceRetention, devId)
+	} else {
+		self.deviceRetention[devId] = seconds
+	}
+	return nil
+}
+
+// Return the user and device retention settings (0 if unset) and the
+// effective retention for a device.
+func (self *MemStore) GetRetention(devId string) (user, device, effective int64, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	if ud := self.userDevice(devId); ud != nil {
+		user = self.userRetention[ud.userId]
+	}
+	device = self.deviceRetention[devId]
+	return user, device, effectiveRetention(user, device, self.defExpry), nil
+}
+
+// remove all tracking information for devId.
+func (self *MemStore) PurgePosition(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	delete(self.positions, devId)
+	return nil
+}
+
+// Return the geofences defined for a device.
+func (self *MemStore) GetGeofences(devId string) (fences []Geofence, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	for _, fence := range self.geofences[devId] {
+		fences = append(fences, *fence)
+	}
+	return fences, nil
+}
+
+// Create (fence.ID == "") or replace a device's geofence.
+func (self *MemStore) SetGeofence(fence Geofence) (fenceId string, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if fence.ID == "" {
+		fence.ID, _ = util.GenUUID4()
+		fence.Created = time.Now().Unix()
+		self.geofences[fence.DeviceID] = append(
+			self.geofences[fence.DeviceID], &fence)
+		return fence.ID, nil
+	}
+	for i, old := range self.geofences[fence.DeviceID] {
+		if old.ID == fence.ID {
+			// the shape may have changed, so the state starts over.
+			fence.Created = old.Created
+			fence.Inside = false
+			self.geofences[fence.DeviceID][i] = &fence
+			return fence.ID, nil
+		}
+	}
+	return "", ErrUnknownGeofence
+}
+
+func (self *MemStore) DeleteGeofence(devId, fenceId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	fences := self.geofences[devId]
+	for i, fence := range fences {
+		if fence.ID == fenceId {
+			self.geofences[devId] = append(fences[:i], fences[i+1:]...)
+			return nil
+		}
+	}
+	return ErrUnknownGeofence
+}
+
+// Record whether the device was last seen inside the geofence.
+func (self *MemStore) SetGeofenceState(devId, fenceId string, inside bool) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	for _, fence := range self.geofences[devId] {
+		if fence.ID == fenceId {
+			fence.Inside = inside
+			return nil
+		}
+	}
+	return ErrUnknownGeofence
+}
+
+// Record a geofence enter or exit.
+func (self *MemStore) AddGeofenceEvent(event GeofenceEvent) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	self.geofenceEvents[event.DeviceID] = append(
+		self.geofenceEvents[event.DeviceID], event)
+	return nil
+}
+
+// Return the geofence events for a device since the given time
+// (epoch seconds), newest first.
+func (self *MemStore) GetGeofenceEvents(devId string, since int64, limit int) (events []GeofenceEvent, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	all := self.geofenceEvents[devId]
+	for i := len(all) - 1; i >= 0; i-- {
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		if all[i].Time < since {
+			continue
+		}
+		events = append(events, all[i])
+	}
+	return events, nil
+}
+
+func (self *MemStore) Touch(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	if dev, ok := self.devices[devId]; ok {
+		dev.lastExchange = time.Now().UTC()
+	}
+	return nil
+}
+
+func (self *MemStore) DeleteDevice(devId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	delete(self.commands, devId)
+	for id, job := range self.outbox {
+		if job.DeviceID == devId {
+			delete(self.outbox, id)
+		}
+	}
+	delete(self.positions, devId)
+	delete(self.deviceRetention, devId)
+	delete(self.geofences, devId)
+	delete(self.geofenceEvents, devId)
+	self.unmapDevice(devId)
+	delete(self.devices, devId)
+	return nil
+}
+
+func (self *MemStore) getMeta(key string) (val string, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	return self.meta[key], nil
+}
+
+func (self *MemStore) setMeta(key, val string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	self.meta[key] = val
+	return nil
+}
+
+// Nothing to close. The data lives as long as the process.
+func (self *MemStore) Close() {
+	return
+}
+
+// Generate a nonce for OAuth checks
+func (self *MemStore) GetNonce() (string, error) {
+	defer self.Unlock()
+	self.Lock()
+
+	key, _ := util.GenUUID4()
+	val, _ := util.GenUUID4()
+	self.nonces[key] = &memNonce{val: val, time: time.Now()}
+	return key + "." + genSig(key, val), nil
+}
+
+// Does the user's nonce match?
+func (self *MemStore) CheckNonce(nonce string) (bool, error) {
+	defer self.Unlock()
+	self.Lock()
+
+	// gc nonces before checking.
+	cutoff := time.Now().Add(-5 * time.Minute)
+	for key, n := range self.nonces {
+		if n.time.Before(cutoff) && !strings.HasPrefix(key, "hawk:") {
+			delete(self.nonces, key)
+		}
+	}
+
+	keysig := strings.SplitN(nonce, ".", 2)
+	if len(keysig) != 2 {
+		self.logger.Warn(self.logCat,
+			"Invalid nonce",
+			util.Fields{"nonce": nonce})
+		return false, nil
+	}
+	n, ok := self.nonces[keysig[0]]
+	if !ok {
+		// Not found
+		return false, nil
+	}
+	delete(self.nonces, keysig[0])
+	return genSig(keysig[0], n.val) == keysig[1], nil
+}
+
+// Record a Hawk request nonce. Returns false if it was already used.
+// (kept in the order they were used, so expiring them is cheap)
+func (self *MemStore) UseHawkNonce(id, nonce string, window int64) (fresh bool, err error) {
+	return self.hawkNonces.Use(id, nonce, window)
+}
+
+// Store a new API token.
+func (self *MemStore) AddApiToken(token ApiToken) (tokenId string, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	token.ID, _ = util.GenUUID4()
+	token.Created = time.Now().Unix()
+	self.apiTokens[token.Hash] = &token
+	return token.ID, nil
+}
+
+// Find the API token with the given hash, noting that it was used.
+func (self *MemStore) UseApiToken(hash string) (token *ApiToken, err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	stored, ok := self.apiTokens[hash]
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+	stored.LastUsed = time.Now().Unix()
+	found := *stored
+	return &found, nil
+}
+
+// Return the user's API tokens, oldest first.
+func (self *MemStore) GetApiTokens(userId string) (tokens []ApiToken, err error) {
+	defer self.RUnlock()
+	self.RLock()
+
+	for _, token := range self.apiTokens {
+		if token.UserID == userId {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens, nil
+}
+
+func (self *MemStore) DeleteApiToken(userId, tokenId string) (err error) {
+	defer self.Unlock()
+	self.Lock()
+
+	for hash, token := range self.apiTokens {
+		if token.ID == tokenId && token.UserID == userId {
+			delete(self.apiTokens, hash)
+			return nil
+		}
+	}
+	return ErrUnknownToken
+}
+
+type byCreated []ApiToken
+
+func (a byCreated) Len() int           { return len(a) }
+func (a byCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreated) Less(i, j int) bool { return a[i].Created < a[j].Created }
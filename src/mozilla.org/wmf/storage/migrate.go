@@ -0,0 +1,123 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+/* Versioned schema updates.
+
+   Each driver keeps an ordered list of numbered migrations. The version
+   that has been applied is recorded in the meta table under
+   SCHEMA_VERSION_KEY. Migrations must never be edited once released;
+   add a new one instead.
+*/
+
+const SCHEMA_VERSION_KEY = "schema_version"
+
+var ErrSchemaBehind = errors.New("Database schema is out of date")
+var ErrBadMigration = errors.New("Invalid migration target")
+var ErrMigrationOrder = errors.New("Migrations are out of order")
+
+// A numbered schema change. Versions start at 1 and must be contiguous.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// The latest version in a list of migrations (versions are contiguous,
+// so this is also the length of the list).
+func latestVersion(migrations []Migration) int {
+	return len(migrations)
+}
+
+// Read the applied schema version. A missing meta table or record
+// means nothing has been applied yet.
+func schemaVersion(dbh *sql.DB, statement string) int {
+	var val string
+	if err := dbh.QueryRow(statement, SCHEMA_VERSION_KEY).Scan(&val); err != nil {
+		return 0
+	}
+	version, err := strconv.Atoi(val)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// Step the schema from current to target (-1 for the latest version).
+// Each migration runs in its own transaction along with the update of
+// the recorded version.
+func migrate(dbh *sql.DB, migrations []Migration, current, target int, logger *util.HekaLogger, logCat string) (err error) {
+	latest := latestVersion(migrations)
+	if target < 0 {
+		target = latest
+	}
+	if target > latest || current > latest {
+		return ErrBadMigration
+	}
+	for current != target {
+		var m Migration
+		var cmds []string
+		var next, want int
+		if current < target {
+			m = migrations[current]
+			cmds = m.Up
+			next = current + 1
+			want = next
+		} else {
+			m = migrations[current-1]
+			cmds = m.Down
+			next = current - 1
+			want = current
+		}
+		// The list is indexed by position, so a misplaced entry would
+		// apply the wrong change.
+		if m.Version != want {
+			logger.Critical(logCat, "Schema migrations are out of order",
+				util.Fields{"at": strconv.Itoa(current),
+					"found": strconv.Itoa(m.Version),
+					"name":  m.Name})
+			return ErrMigrationOrder
+		}
+		logger.Info(logCat, "Migrating schema",
+			util.Fields{"from": strconv.Itoa(current),
+				"to":   strconv.Itoa(next),
+				"name": m.Name})
+		tx, err := dbh.Begin()
+		if err != nil {
+			return err
+		}
+		// The version is a plain int, so it's safe to inline. This keeps
+		// the statement portable between placeholder styles.
+		cmds = append(cmds,
+			fmt.Sprintf("delete from meta where key = '%s';", SCHEMA_VERSION_KEY),
+			fmt.Sprintf("insert into meta (key, val) values ('%s', '%d');",
+				SCHEMA_VERSION_KEY, next))
+		for _, s := range cmds {
+			if _, err = tx.Exec(s); err != nil {
+				logger.Error(logCat, "Could not migrate db",
+					util.Fields{"cmd": s,
+						"version": strconv.Itoa(m.Version),
+						"error":   err.Error()})
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		current = next
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/* A per process Hawk nonce cache.
+   Nonces are kept in the order they were last used, so that the ones
+   that have aged out of the window can be dropped from the back without
+   looking at the rest. Once size nonces are held, the oldest is dropped
+   to make room.
+*/
+type NonceLRU struct {
+	sync.Mutex
+	size  int
+	order *list.List // most recent first
+	seen  map[string]*list.Element
+}
+
+type lruNonce struct {
+	key  string
+	time time.Time
+}
+
+func NewNonceLRU(size int) *NonceLRU {
+	if size < 1 {
+		size = 1
+	}
+	return &NonceLRU{
+		size:  size,
+		order: list.New(),
+		seen:  make(map[string]*list.Element),
+	}
+}
+
+// Record the nonce for the Hawk id. Returns false if it was already
+// used in the last window seconds.
+func (self *NonceLRU) Use(id, nonce string, window int64) (bool, error) {
+	defer self.Unlock()
+	self.Lock()
+
+	now := time.Now()
+	age := time.Duration(window) * time.Second
+	key := hawkNonceKey(id, nonce)
+	if el, ok := self.seen[key]; ok {
+		entry := el.Value.(*lruNonce)
+		if now.Sub(entry.time) < age {
+			return false, nil
+		}
+		entry.time = now
+		self.order.MoveToFront(el)
+		return true, nil
+	}
+	// Drop the nonces that have aged out, and the oldest if full.
+	for back := self.order.Back(); back != nil; back = self.order.Back() {
+		entry := back.Value.(*lruNonce)
+		if self.order.Len() < self.size && now.Sub(entry.time) < age {
+			break
+		}
+		delete(self.seen, entry.key)
+		self.order.Remove(back)
+	}
+	self.seen[key] = self.order.PushFront(&lruNonce{key: key, time: now})
+	return true, nil
+}
@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+/* Connection pool handling for the database/sql based drivers.
+   The Storage is opened once in main and shared by every handler, so
+   these settings govern all database traffic for the process.
+*/
+
+// Read an integer config value, falling back to def.
+func configInt(config *util.MzConfig, key string, def int64) int64 {
+	val, err := strconv.ParseInt(config.Get(key, strconv.FormatInt(def, 10)), 0, 64)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// Apply the db.max_open, db.max_idle and db.max_lifetime (seconds)
+// settings to the pool.
+func configurePool(db *sql.DB, config *util.MzConfig) {
+	db.SetMaxOpenConns(int(configInt(config, "db.max_open", 0)))
+	db.SetMaxIdleConns(int(configInt(config, "db.max_idle", 100)))
+	db.SetConnMaxLifetime(time.Duration(
+		configInt(config, "db.max_lifetime", 0)) * time.Second)
+}
+
+// Report the pool statistics every db.stats_interval seconds until
+// quit is closed. (0 disables reporting)
+func reportPool(db *sql.DB, config *util.MzConfig, metrics *util.Metrics, quit chan bool) {
+	interval := configInt(config, "db.stats_interval", 60)
+	if interval <= 0 || metrics == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			stats := db.Stats()
+			metrics.Gauge("db.pool.open", int64(stats.OpenConnections))
+			metrics.Gauge("db.pool.in_use", int64(stats.InUse))
+			metrics.Gauge("db.pool.idle", int64(stats.Idle))
+			metrics.Gauge("db.pool.wait_count", stats.WaitCount)
+			metrics.Gauge("db.pool.wait_ms",
+				int64(stats.WaitDuration/time.Millisecond))
+			metrics.Gauge("db.pool.closed_lifetime",
+				stats.MaxLifetimeClosed)
+		}
+	}
+}
@@ -0,0 +1,1369 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("postgres", OpenPostgres)
+}
+
+// Postgres storage driver
+type PgStore struct {
+	config   *util.MzConfig
+	logger   *util.HekaLogger
+	metrics  *util.Metrics
+	dsn      string
+	logCat   string
+	defExpry int64
+	db       *sql.DB
+	secrets  *secretBox
+	quit     chan bool
+}
+
+// Get a time string that makes psql happy.
+func dbNow() (ret string) {
+	return dbTime(time.Now())
+}
+
+func dbTime(t time.Time) (ret string) {
+	r, _ := t.UTC().MarshalText()
+	return string(r)
+}
+
+// Open the Postgres database.
+func OpenPostgres(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store Storage, err error) {
+	dsn := fmt.Sprintf("user=%s password=%s host=%s dbname=%s sslmode=%s",
+		config.Get("db.user", "user"),
+		config.Get("db.password", "password"),
+		config.Get("db.host", "localhost"),
+		config.Get("db.db", "wmf"),
+		config.Get("db.sslmode", "disable"))
+	logCat := "storage"
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		panic("Storage is unavailable: " + err.Error() + "\n")
+		return nil, err
+	}
+	configurePool(db, config)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	secrets, err := newSecretBox(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	pg := &PgStore{
+		config:   config,
+		logger:   logger,
+		logCat:   logCat,
+		defExpry: defaultExpry(config),
+		metrics:  metrics,
+		dsn:      dsn,
+		db:       db,
+		secrets:  secrets,
+		quit:     make(chan bool)}
+	if err = pg.sealSecrets(); err != nil {
+		return nil, err
+	}
+	go reportPool(db, config, metrics, pg.quit)
+	return pg, nil
+}
+
+/* Schema changes for Postgres, oldest first.
+   Version 1 matches what the old Init() created, so existing installs
+   can be brought under version control by running --migrate.
+*/
+var pgMigrations = []Migration{
+	{Version: 1,
+		Name: "initial schema",
+		Up: []string{
+			"create table if not exists userToDeviceMap (userId varchar, deviceId varchar, name varchar, date date);",
+			"create index if not exists usertodevicemap_userid_idx on userToDeviceMap (userId);",
+			"create index if not exists usertodevicemap_deviceid_idx on userToDeviceMap (deviceId);",
+			"create unique index if not exists usertodevicemap_userid_deviceid_idx on userToDeviceMap (userId, deviceId);",
+
+			"create table if not exists deviceInfo (deviceId varchar unique, lockable boolean, loggedin boolean, lastExchange timestamp, hawkSecret varchar, pushurl varchar, accepts varchar, accesstoken varchar);",
+			"create index if not exists deviceinfo_deviceid_idx on deviceInfo (deviceId);",
+
+			"create table if not exists pendingCommands (id bigserial, deviceId varchar, time timestamp, cmd varchar);",
+			"create index if not exists pendingcommands_deviceid_idx on pendingCommands (deviceId);",
+
+			"create table if not exists position (id bigserial, deviceId varchar, time  timestamp, latitude real, longitude real, altitude real);",
+			"create index if not exists position_deviceid_idx on position (deviceId);",
+			"create or replace function update_time() returns trigger as $$ begin new.lastexchange = now(); return new; end; $$ language 'plpgsql';",
+			"drop trigger if exists update_le on deviceinfo;",
+			"create trigger update_le before update on deviceinfo for each row execute procedure update_time();",
+			"create table if not exists meta (key varchar, val varchar);",
+			// Older installs created meta with a "value" column, which
+			// nothing ever read.
+			"do $$ begin if exists (select 1 from information_schema.columns where table_name='meta' and column_name='value') then alter table meta rename column value to val; end if; end $$;",
+			"create index if not exists meta_key_idx on meta (key);",
+			"create table if not exists nonce (key varchar, val varchar, time timestamp);",
+			"create index if not exists nonce_key_idx on nonce (key);",
+			"create index if not exists nonce_time_idx on nonce (time);",
+		},
+		Down: []string{
+			// meta is kept since it holds the schema version.
+			"drop table if exists nonce;",
+			"drop trigger if exists update_le on deviceinfo;",
+			"drop function if exists update_time();",
+			"drop table if exists position;",
+			"drop table if exists pendingCommands;",
+			"drop table if exists deviceInfo;",
+			"drop table if exists userToDeviceMap;",
+		},
+	},
+	// formerly sql/update_20140514.sql
+	{Version: 2,
+		Name: "device access token and map date",
+		Up: []string{
+			"alter table deviceInfo add column if not exists accesstoken varchar;",
+			"alter table userToDeviceMap add column if not exists date timestamp;",
+		},
+		// Version 1 creates both columns (this only adds them to tables
+		// that predate it), so there is nothing to undo.
+		Down: []string{},
+	},
+	{Version: 3,
+		Name: "location history retention",
+		Up: []string{
+			"create table if not exists userRetention (userId varchar unique, seconds bigint);",
+			"create table if not exists deviceRetention (deviceId varchar unique, seconds bigint);",
+			"create index if not exists position_deviceid_time_idx on position (deviceId, time);",
+		},
+		Down: []string{
+			"drop index if exists position_deviceid_time_idx;",
+			"drop table if exists deviceRetention;",
+			"drop table if exists userRetention;",
+		},
+	},
+	{Version: 4,
+		Name: "position accuracy and source",
+		Up: []string{
+			"alter table position add column if not exists accuracy real default 0;",
+			"alter table position add column if not exists speed real default 0;",
+			"alter table position add column if not exists heading real default 0;",
+			"alter table position add column if not exists battery real default 0;",
+			"alter table position add column if not exists provider varchar default '';",
+		},
+		Down: []string{
+			"alter table position drop column if exists provider;",
+			"alter table position drop column if exists battery;",
+			"alter table position drop column if exists heading;",
+			"alter table position drop column if exists speed;",
+			"alter table position drop column if exists accuracy;",
+		},
+	},
+	{Version: 5,
+		Name: "geofences",
+		Up: []string{
+			"create table if not exists geofence (id varchar unique, deviceId varchar, name varchar, kind varchar, latitude real, longitude real, radius real, points varchar, inside boolean default false, created timestamp);",
+			"create index if not exists geofence_deviceid_idx on geofence (deviceId);",
+			"create table if not exists geofenceEvent (id bigserial, deviceId varchar, fenceId varchar, name varchar, event varchar, latitude real, longitude real, time timestamp);",
+			"create index if not exists geofenceevent_deviceid_time_idx on geofenceEvent (deviceId, time);",
+		},
+		Down: []string{
+			"drop table if exists geofenceEvent;",
+			"drop table if exists geofence;",
+		},
+	},
+	{Version: 6,
+		Name: "command ledger",
+		Up: []string{
+			"create table if not exists commandLog (id bigserial, deviceId varchar, type varchar, cmd varchar, state varchar, detail varchar default '', created timestamp, updated timestamp);",
+			"create index if not exists commandlog_deviceid_state_idx on commandLog (deviceId, state);",
+			// commands are stored as {"<type>":{...}}
+			"insert into commandLog (deviceId, type, cmd, state, detail, created, updated) select deviceId, substr(cmd, 3, 1), cmd, 'queued', '', time, time from pendingCommands order by id;",
+			"drop table if exists pendingCommands;",
+		},
+		Down: []string{
+			"create table if not exists pendingCommands (id bigserial, deviceId varchar, time timestamp, cmd varchar);",
+			"create index if not exists pendingcommands_deviceid_idx on pendingCommands (deviceId);",
+			"insert into pendingCommands (deviceId, time, cmd) select deviceId, created, cmd from commandLog where state in ('queued', 'pushed') order by id;",
+			"drop table if exists commandLog;",
+		},
+	},
+	{Version: 7,
+		Name: "command expiry",
+		Up: []string{
+			"alter table commandLog add column if not exists expires timestamp;",
+		},
+		Down: []string{
+			"alter table commandLog drop column if exists expires;",
+		},
+	},
+	{Version: 8,
+		Name: "device capabilities",
+		Up: []string{
+			"alter table deviceInfo add column if not exists capabilities varchar default '';",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column if exists capabilities;",
+		},
+	},
+	{Version: 9,
+		Name: "web push",
+		Up: []string{
+			"alter table deviceInfo add column if not exists pushType varchar default 'simplepush';",
+			"alter table deviceInfo add column if not exists pushKey varchar default '';",
+			"alter table deviceInfo add column if not exists pushAuth varchar default '';",
+			"alter table deviceInfo add column if not exists pushGone boolean default false;",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column if exists pushGone;",
+			"alter table deviceInfo drop column if exists pushAuth;",
+			"alter table deviceInfo drop column if exists pushKey;",
+			"alter table deviceInfo drop column if exists pushType;",
+		},
+	},
+	{Version: 10,
+		Name: "push outbox",
+		Up: []string{
+			"create table if not exists pushOutbox (id bigserial, deviceId varchar, cmdId bigint, attempts integer default 0, nextAttempt timestamp, deadline timestamp, lastError varchar default '', created timestamp);",
+			"create index if not exists pushoutbox_nextattempt_idx on pushOutbox (nextAttempt);",
+		},
+		Down: []string{
+			"drop table if exists pushOutbox;",
+		},
+	},
+	{Version: 11,
+		Name: "hawk nonces",
+		Up: []string{
+			"delete from nonce where key like 'hawk:%';",
+			"create unique index if not exists nonce_key_uniq_idx on nonce (key);",
+		},
+		Down: []string{
+			"drop index if exists nonce_key_uniq_idx;",
+		},
+	},
+	{Version: 12,
+		Name: "secret rotation",
+		Up: []string{
+			"alter table deviceInfo add column if not exists prevSecret varchar default '';",
+			"alter table deviceInfo add column if not exists prevSecretExpires timestamp;",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column if exists prevSecretExpires;",
+			"alter table deviceInfo drop column if exists prevSecret;",
+		},
+	},
+	{Version: 13,
+		Name: "api tokens",
+		Up: []string{
+			"create table if not exists apiToken (id varchar unique, userId varchar, name varchar, hash varchar unique, scopes varchar, created timestamp, expires timestamp, lastUsed timestamp);",
+			"create index if not exists apitoken_userid_idx on apiToken (userId);",
+		},
+		Down: []string{
+			"drop table if exists apiToken;",
+		},
+	},
+}
+
+// Return the applied and latest known schema versions.
+func (self *PgStore) SchemaVersion() (current, latest int, err error) {
+	return schemaVersion(self.db, "select val from meta where key = $1;"),
+		latestVersion(pgMigrations), nil
+}
+
+// Apply (or roll back) migrations until the schema is at target.
+// (-1 for the latest version)
+func (self *PgStore) Migrate(target int) (err error) {
+	current, _, err := self.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err = migrate(self.db, pgMigrations, current, target,
+		self.logger, self.logCat); err != nil {
+		return err
+	}
+	return self.sealSecrets()
+}
+
+// Seal the device secrets stored before db.secret_key was set. (Only
+// at the latest schema; Migrate calls this again once it's there.)
+func (self *PgStore) sealSecrets() (err error) {
+	if current, latest, _ := self.SchemaVersion(); current < latest {
+		return nil
+	}
+	return sealStoredSecrets(self.db, self.secrets,
+		"select deviceId, coalesce(hawkSecret, ''), coalesce(prevSecret, '') from deviceInfo where (coalesce(hawkSecret, '') <> '' and hawkSecret not like $1) or (coalesce(prevSecret, '') <> '' and prevSecret not like $1);",
+		"update deviceInfo set hawkSecret = $1, prevSecret = $2 where deviceId = $3 and coalesce(hawkSecret, '') = $4 and coalesce(prevSecret, '') = $5;",
+		self.logger, self.logCat)
+}
+
+// Register a new device to a given userID.
+func (self *PgStore) RegisterDevice(userid string, dev Device) (devId string, err error) {
+	// value check?
+	dbh := self.db
+	statement := "insert into deviceInfo (deviceId, lockable, loggedin, lastExchange, hawkSecret, accepts, pushUrl, capabilities, pushType, pushKey, pushAuth) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
+	if dev.ID == "" {
+		dev.ID, _ = util.GenUUID4()
+	}
+	secret, err := self.secrets.seal(dev.ID, dev.Secret)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not seal device secret",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	// Purge old registration records.
+	if _, err = dbh.Exec("delete from deviceInfo where deviceId = $1;", dev.ID); err != nil {
+		self.logger.Error(self.logCat,
+			"Could not purge old deviceinfo record",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	if _, err = dbh.Exec("delete from userToDeviceMap where deviceId = $1;", dev.ID); err != nil {
+		self.logger.Error(self.logCat,
+			"Could not purge old usertodevicemap record",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	if _, err = dbh.Exec(statement,
+		string(dev.ID),
+		dev.HasPasscode,
+		dev.LoggedIn,
+		dbNow(),
+		secret,
+		dev.Accepts,
+		dev.PushUrl,
+		dev.Capabilities,
+		dev.PushType,
+		dev.PushKey,
+		dev.PushAuth); err != nil {
+		self.logger.Error(self.logCat, "Could not create device",
+			util.Fields{"error": err.Error(),
+				"device": fmt.Sprintf("%+v", dev)})
+		return "", err
+	}
+	if _, err = dbh.Exec("insert into userToDeviceMap (userId, deviceId, name, date) values ($1, $2, $3, now());", userid, dev.ID, dev.Name); err != nil {
+		switch {
+		default:
+			self.logger.Error(self.logCat,
+				"Could not map device to user",
+				util.Fields{
+					"uid":      userid,
+					"deviceId": dev.ID,
+					"name":     dev.Name,
+					"error":    err.Error()})
+			return "", err
+		}
+	}
+	return dev.ID, nil
+}
+
+// Return known info about a device.
+func (self *PgStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
+
+	// collect the data for a given device for display
+
+	var deviceId, userId, pushUrl, name, secret, lestr, accesstoken, capabilities []uint8
+	var pushType, pushKey, pushAuth, prevSecret, prevExpires []uint8
+	var lastexchange float64
+	var hasPasscode, loggedIn, pushGone bool
+	var statement, accepts string
+
+	dbh := self.db
+
+	// verify that the device belongs to the user
+	statement = "select d.deviceId, u.userId, coalesce(u.name,d.deviceId), d.lockable, d.loggedin, d.pushUrl, d.accepts, d.hawksecret, extract(epoch from d.lastexchange), d.accesstoken, d.capabilities, d.pushType, d.pushKey, d.pushAuth, coalesce(d.pushGone, false), coalesce(d.prevSecret, ''), coalesce(extract(epoch from d.prevSecretExpires), 0) from userToDeviceMap as u, deviceInfo as d where u.deviceId=$1 and u.deviceId=d.deviceId;"
+	stmt, err := dbh.Prepare(statement)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not query device info",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(devId)
+	err = row.Scan(&deviceId, &userId, &name, &hasPasscode,
+		&loggedIn, &pushUrl, &accepts, &secret, &lestr, &accesstoken,
+		&capabilities, &pushType, &pushKey, &pushAuth, &pushGone,
+		&prevSecret, &prevExpires)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUnknownDevice
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not fetch device info",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	default:
+	}
+	lastexchange, _ = strconv.ParseFloat(string(lestr), 32)
+	prevSecretExpires, _ := strconv.ParseFloat(string(prevExpires), 64)
+	hawkSecret, err := self.secrets.open(devId, string(secret))
+	var prevHawkSecret string
+	if err == nil {
+		prevHawkSecret, err = self.secrets.open(devId, string(prevSecret))
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not open device secret",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	//If we have a pushUrl, the user is logged in.
+	bloggedIn := string(pushUrl) != ""
+	reply := &Device{
+		ID:           string(deviceId),
+		User:         string(userId),
+		Name:         string(name),
+		Secret:       hawkSecret,
+		HasPasscode:  hasPasscode,
+		LoggedIn:     bloggedIn,
+		LastExchange: int32(lastexchange),
+		PushUrl:      string(pushUrl),
+		Accepts:      accepts,
+		AccessToken:  string(accesstoken),
+		Capabilities: string(capabilities),
+		PushType:     string(pushType),
+		PushKey:      string(pushKey),
+		PushAuth:     string(pushAuth),
+		PushGone:     pushGone,
+	}
+	reply.PrevSecret = prevHawkSecret
+	reply.PrevSecretExpires = int64(prevSecretExpires)
+
+	return reply, nil
+}
+
+// Return the latest known position for a device.
+func (self *PgStore) GetPositions(devId string) (positions []Position, err error) {
+	return self.GetPositionHistory(devId, 0, 0, 1)
+}
+
+// Return the positions recorded for a device between since and until
+// (epoch seconds, 0 for unbounded), newest first.
+func (self *PgStore) GetPositionHistory(devId string, since, until int64, limit int) (positions []Position, err error) {
+
+	dbh := self.db
+
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	statement := "select extract(epoch from time)::int, latitude, longitude, altitude, accuracy, speed, heading, battery, provider from position where deviceid=$1 and ($2 = 0 or time >= to_timestamp($2) at time zone 'UTC') and ($3 = 0 or time <= to_timestamp($3) at time zone 'UTC') order by time desc limit $4;"
+	rows, err := dbh.Query(statement, devId, since, until, limit)
+	if err == nil {
+		var time int32
+		var latitude float32
+		var longitude float32
+		var altitude float32
+		var accuracy float32
+		var speed float32
+		var heading float32
+		var battery float32
+		var provider string
+
+		for rows.Next() {
+			err = rows.Scan(&time, &latitude, &longitude, &altitude,
+				&accuracy, &speed, &heading, &battery, &provider)
+			if err != nil {
+				self.logger.Error(self.logCat, "Could not get positions",
+					util.Fields{"error": err.Error(),
+						"deviceId": devId})
+				break
+			}
+			positions = append(positions, Position{
+				Latitude:  float64(latitude),
+				Longitude: float64(longitude),
+				Altitude:  float64(altitude),
+				Time:      int64(time),
+				Accuracy:  float64(accuracy),
+				Speed:     float64(speed),
+				Heading:   float64(heading),
+				Battery:   float64(battery),
+				Provider:  provider})
+		}
+		// gather the positions
+		rows.Close()
+	} else {
+		self.logger.Error(self.logCat, "Could not get positions",
+			util.Fields{"error": err.Error()})
+	}
+
+	return positions, nil
+
+}
+
+// Get up to limit of the oldest undelivered commands and mark them
+// delivered. Commands past their expiry are marked expired and skipped.
+func (self *PgStore) GetPending(devId string, limit int) (commands []Command, err error) {
+	dbh := self.db
+
+	now := dbNow()
+	res, err := dbh.Exec("update commandLog set state = $1, updated = $2 where deviceId = $3 and state in ($4, $5) and expires is not null and expires < $2;",
+		CMD_EXPIRED, now, devId, CMD_QUEUED, CMD_PUSHED)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not expire commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+	} else if cnt, _ := res.RowsAffected(); cnt > 0 {
+		self.logger.Info(self.logCat, "Commands expired",
+			util.Fields{"deviceId": devId,
+				"count": strconv.FormatInt(cnt, 10)})
+		self.metrics.IncrementBy("cmd.expired", int(cnt))
+	}
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	// Claim the commands in one statement so that two polls can't both
+	// deliver the same one. The subselect skips rows another poll has
+	// locked, and the outer state check drops any that it claimed
+	// before this statement got to them. (A plain subselect isn't
+	// enough under read committed.)
+	statement := "update commandLog set state = $1, updated = $2 where id in (select id from commandLog where deviceId = $3 and state in ($4, $5) order by created, id limit $6 for update skip locked) and state in ($4, $5) returning id, type, cmd, extract(epoch from created)::bigint;"
+	rows, err := dbh.Query(statement, CMD_DELIVERED, now, devId,
+		CMD_QUEUED, CMD_PUSHED, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not read pending command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := Command{DeviceID: devId, State: CMD_DELIVERED}
+		if err = rows.Scan(&c.ID, &c.Type, &c.Cmd, &c.Created); err != nil {
+			self.logger.Error(self.logCat, "Could not read pending command",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		self.metrics.Timer("cmd.pending", time.Now().Unix()-c.Created)
+		commands = append(commands, c)
+	}
+	// returning doesn't keep the order of the subselect.
+	sort.Sort(byCommandId(commands))
+	self.Touch(devId)
+	return commands, nil
+}
+
+type byCommandId []Command
+
+func (a byCommandId) Len() int           { return len(a) }
+func (a byCommandId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCommandId) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+func (self *PgStore) GetUserFromDevice(deviceId string) (userId, name string, err error) {
+
+	dbh := self.db
+	statement := "select userId, name from userToDeviceMap where deviceId = $1 limit 1;"
+	rows, err := dbh.Query(statement, deviceId)
+	if err == nil {
+		for rows.Next() {
+			err = rows.Scan(&userId, &name)
+			if err != nil {
+				self.logger.Error(self.logCat,
+					"Could not get user for device",
+					util.Fields{"error": err.Error(),
+						"user": deviceId})
+				return "", "", err
+			}
+			return userId, name, nil
+		}
+	}
+	return "", "", ErrUnknownDevice
+}
+
+// Get all known devices for this user.
+func (self *PgStore) GetDevicesForUser(userId string) (devices []DeviceList, err error) {
+	var data []DeviceList
+
+	dbh := self.db
+	statement := "select deviceId, coalesce(name,deviceId) from userToDeviceMap where userId = $1 order by date;"
+	rows, err := dbh.Query(statement, userId)
+	if err == nil {
+		for rows.Next() {
+			var id, name string
+			err = rows.Scan(&id, &name)
+			if err != nil {
+				self.logger.Error(self.logCat,
+					"Could not get list of devices for user",
+					util.Fields{"error": err.Error(),
+						"user": userId})
+				return nil, err
+			}
+			data = append(data, DeviceList{ID: id, Name: name})
+		}
+	}
+	return data, err
+}
+
+// Store a command into the list of pending commands for a device.
+func (self *PgStore) StoreCommand(devId, cmdType, command string, expires int64) (cmdId int64, err error) {
+	statement := "insert into commandLog (deviceId, type, cmd, state, detail, created, updated, expires) values ($1, $2, $3, $4, '', $5, $5, $6) returning id;"
+	dbh := self.db
+	var expiresAt interface{}
+
+	if expires > 0 {
+		expiresAt = dbTime(time.Unix(expires, 0))
+	}
+
+	self.logger.Debug(self.logCat, "Storing Command",
+		util.Fields{"deviceId": devId, "command": command})
+
+	if err = dbh.QueryRow(statement, devId, cmdType, command, CMD_QUEUED,
+		dbNow(), expiresAt).Scan(&cmdId); err != nil {
+		self.logger.Error(self.logCat, "Could not store pending command",
+			util.Fields{"error": err.Error()})
+		return 0, err
+	}
+	return cmdId, nil
+}
+
+// Cancel a command that has not been delivered yet.
+func (self *PgStore) CancelCommand(devId string, cmdId int64) (err error) {
+	var state string
+	dbh := self.db
+
+	res, err := dbh.Exec("update commandLog set state = $1, updated = $2 where id = $3 and deviceId = $4 and state in ($5, $6);",
+		CMD_CANCELLED, dbNow(), cmdId, devId, CMD_QUEUED, CMD_PUSHED)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt > 0 {
+		return nil
+	}
+	err = dbh.QueryRow("select state from commandLog where id = $1 and deviceId = $2;",
+		cmdId, devId).Scan(&state)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrUnknownCommand
+	case err != nil:
+		return err
+	}
+	return ErrCommandDelivered
+}
+
+// Move an undelivered command to a new state, noting any detail.
+func (self *PgStore) SetCommandState(devId string, cmdId int64, state, detail string) (err error) {
+	statement := "update commandLog set state = $1, detail = $2, updated = $3 where id = $4 and deviceId = $5 and state in ($6, $7);"
+	if _, err = self.db.Exec(statement, state, detail, dbNow(),
+		cmdId, devId, CMD_QUEUED, CMD_PUSHED); err != nil {
+		self.logger.Error(self.logCat, "Could not update command state",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"state":    state})
+	}
+	return err
+}
+
+// Move the most recently delivered command of cmdType to a new state.
+func (self *PgStore) AckCommand(devId, cmdType, state, detail string) (err error) {
+	statement := "update commandLog set state = $1, detail = $2, updated = $3 where id = (select id from commandLog where deviceId = $4 and type = $5 and state = $6 order by id desc limit 1);"
+	if _, err = self.db.Exec(statement, state, detail, dbNow(),
+		devId, cmdType, CMD_DELIVERED); err != nil {
+		self.logger.Error(self.logCat, "Could not update command state",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"state":    state})
+	}
+	return err
+}
+
+// Add a failed push to the outbox to be retried.
+func (self *PgStore) QueuePush(job PushJob) (jobId int64, err error) {
+	statement := "insert into pushOutbox (deviceId, cmdId, attempts, nextAttempt, deadline, lastError, created) values ($1, $2, $3, $4, $5, $6, $7) returning id;"
+	if err = self.db.QueryRow(statement, job.DeviceID, job.CmdID,
+		job.Attempts, dbTime(time.Unix(job.NextAttempt, 0)),
+		dbTime(time.Unix(job.Deadline, 0)), job.LastError,
+		dbNow()).Scan(&jobId); err != nil {
+		self.logger.Error(self.logCat, "Could not queue push",
+			util.Fields{"error": err.Error(),
+				"deviceId": job.DeviceID})
+		return 0, err
+	}
+	return jobId, nil
+}
+
+// Claim the outbox entries that are due a retry.
+func (self *PgStore) ClaimPushes(limit int, lease int64) (jobs []PushJob, err error) {
+	now := time.Now()
+	next := now.Add(time.Duration(lease) * time.Second)
+	// Claim in one statement so that two servers can't both take a job.
+	// As in GetPending, the subselect skips locked rows and the outer
+	// check drops any that another server leased first.
+	statement := "update pushOutbox set nextAttempt = $1 where id in (select id from pushOutbox where nextAttempt <= $2 order by nextAttempt limit $3 for update skip locked) and nextAttempt <= $2 returning id, deviceId, cmdId, attempts, extract(epoch from deadline)::bigint, lastError, coalesce((select state from commandLog where commandLog.id = pushOutbox.cmdId), '');"
+	rows, err := self.db.Query(statement, dbTime(next), dbTime(now), limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not claim pushes",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		job := PushJob{NextAttempt: next.Unix()}
+		if err = rows.Scan(&job.ID, &job.DeviceID, &job.CmdID,
+			&job.Attempts, &job.Deadline, &job.LastError,
+			&job.CmdState); err != nil {
+			self.logger.Error(self.logCat, "Could not read push",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Record a failed attempt and when to try again.
+func (self *PgStore) RetryPush(jobId int64, attempts int, next int64, lastError string) (err error) {
+	statement := "update pushOutbox set attempts = $1, nextAttempt = $2, lastError = $3 where id = $4;"
+	if _, err = self.db.Exec(statement, attempts,
+		dbTime(time.Unix(next, 0)), lastError, jobId); err != nil {
+		self.logger.Error(self.logCat, "Could not reschedule push",
+			util.Fields{"error": err.Error(),
+				"jobId": strconv.FormatInt(jobId, 10)})
+	}
+	return err
+}
+
+// Remove an entry from the outbox.
+func (self *PgStore) DeletePush(jobId int64) (err error) {
+	if _, err = self.db.Exec("delete from pushOutbox where id = $1;",
+		jobId); err != nil {
+		self.logger.Error(self.logCat, "Could not remove push",
+			util.Fields{"error": err.Error(),
+				"jobId": strconv.FormatInt(jobId, 10)})
+	}
+	return err
+}
+
+// Return the command history for a device, newest first.
+func (self *PgStore) GetCommands(devId string, limit int) (commands []Command, err error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	statement := "select id, type, cmd, state, coalesce(detail, ''), extract(epoch from created)::bigint, extract(epoch from updated)::bigint, coalesce(extract(epoch from expires)::bigint, 0) from commandLog where deviceId = $1 order by id desc limit $2;"
+	rows, err := self.db.Query(statement, devId, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := Command{DeviceID: devId}
+		if err = rows.Scan(&c.ID, &c.Type, &c.Cmd, &c.State, &c.Detail,
+			&c.Created, &c.Updated, &c.Expires); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+func (self *PgStore) SetAccessToken(devId, token string) (err error) {
+	dbh := self.db
+
+	statement := "update deviceInfo set accesstoken = $1, lastexchange = now() where deviceId = $2"
+	_, err = dbh.Exec(statement, token, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not set the access token",
+			util.Fields{"error": err.Error(),
+				"device": devId,
+				"token":  token})
+		return err
+	}
+	return nil
+}
+
+// Note that the push service no longer knows the device's endpoint.
+func (self *PgStore) SetPushGone(devId string) (err error) {
+	statement := "update deviceInfo set pushGone = true where deviceId = $1"
+	if _, err = self.db.Exec(statement, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not mark push endpoint gone",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	return nil
+}
+
+// Replace the device's HAWK secret, keeping the old one for grace
+// seconds.
+func (self *PgStore) RotateSecret(devId, secret string, grace int64) (err error) {
+	sealed, err := self.secrets.seal(devId, secret)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	// If the device hasn't picked up the last new secret yet, it is
+	// still using the one before that. (prevSecretExpires is a UTC
+	// timestamp, so compare it with our UTC time rather than now().)
+	statement := "update deviceInfo set prevSecret = case when coalesce(prevSecret, '') <> '' and prevSecretExpires > $1 then prevSecret else hawkSecret end, prevSecretExpires = $2, hawkSecret = $3 where deviceId = $4"
+	res, err := self.db.Exec(statement, dbTime(now),
+		dbTime(now.Add(time.Duration(grace)*time.Second)),
+		sealed, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not rotate device secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownDevice
+	}
+	return nil
+}
+
+// Forget the device's previous HAWK secret.
+func (self *PgStore) DropPrevSecret(devId string) (err error) {
+	statement := "update deviceInfo set prevSecret = '', prevSecretExpires = null where deviceId = $1"
+	if _, err = self.db.Exec(statement, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not drop previous secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	return nil
+}
+
+// Remove the device's HAWK secrets.
+func (self *PgStore) RevokeSecret(devId string) (err error) {
+	statement := "update deviceInfo set hawkSecret = '', prevSecret = '', prevSecretExpires = null where deviceId = $1"
+	res, err := self.db.Exec(statement, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not revoke device secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownDevice
+	}
+	return nil
+}
+
+// Shorthand function to set the lock state for a device.
+func (self *PgStore) SetDeviceLock(devId string, state bool) (err error) {
+	dbh := self.db
+
+	statement := "update deviceInfo set lockable = $1, lastexchange = now()  where deviceId =$2"
+	_, err = dbh.Exec(statement, state, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not set device lock state",
+			util.Fields{"error": err.Error(),
+				"device": devId,
+				"state":  fmt.Sprintf("%t", state)})
+		return err
+	}
+	return nil
+}
+
+// Add the location information to the known set for a device.
+func (self *PgStore) SetDeviceLocation(devId string, position Position) (err error) {
+	dbh := self.db
+
+	statement := "insert into position (deviceId, time, latitude, longitude, altitude, accuracy, speed, heading, battery, provider) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);"
+	st, err := dbh.Prepare(statement)
+	if err != nil {
+		self.logger.Error(self.logCat, "Error inserting postion",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	_, err = st.Exec(
+		devId,
+		dbNow(),
+		float32(position.Latitude),
+		float32(position.Longitude),
+		float32(position.Altitude),
+		float32(position.Accuracy),
+		float32(position.Speed),
+		float32(position.Heading),
+		float32(position.Battery),
+		position.Provider)
+	st.Close()
+	if err != nil {
+		self.logger.Error(self.logCat, "Error inserting postion",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// Remove expired postion information for a device, according to its
+// retention settings. The latest position is always kept.
+func (self *PgStore) GcPosition(devId string) (err error) {
+	dbh := self.db
+
+	_, _, expry, err := self.GetRetention(devId)
+	if err != nil {
+		return err
+	}
+	cutoff := dbTime(time.Now().Add(-time.Duration(expry) * time.Second))
+	statement := "delete from position where deviceId = $1 and time < $2 and id <> (select id from position where deviceId = $1 order by time desc limit 1);"
+	if _, err = dbh.Exec(statement, devId, cutoff); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing positions",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	// geofence events follow the same retention.
+	statement = "delete from geofenceEvent where deviceId = $1 and time < $2;"
+	if _, err = dbh.Exec(statement, devId, cutoff); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing geofence events",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	// as does the history of finished commands.
+	statement = "delete from commandLog where deviceId = $1 and updated < $2 and state not in ($3, $4);"
+	if _, err = dbh.Exec(statement, devId, cutoff, CMD_QUEUED, CMD_PUSHED); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing command log",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	return nil
+}
+
+// Return the ids of every registered device.
+func (self *PgStore) GetAllDeviceIds() (devIds []string, err error) {
+	rows, err := self.db.Query("select deviceId from deviceInfo;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		devIds = append(devIds, id)
+	}
+	return devIds, nil
+}
+
+// Set how long (in seconds) to keep a user's positions. 0 clears it.
+func (self *PgStore) SetUserRetention(userId string, seconds int64) (err error) {
+	return self.setRetention("userRetention", "userId", userId, seconds)
+}
+
+// Set how long (in seconds) to keep a device's positions. 0 clears it.
+func (self *PgStore) SetDeviceRetention(devId string, seconds int64) (err error) {
+	return self.setRetention("deviceRetention", "deviceId", devId, seconds)
+}
+
+func (self *PgStore) setRetention(table, column, id string, seconds int64) (err error) {
+	dbh := self.db
+
+	// table and column are never user supplied.
+	if seconds <= 0 {
+		_, err = dbh.Exec("delete from "+table+" where "+column+" = $1;", id)
+		return err
+	}
+	res, err := dbh.Exec("update "+table+" set seconds = $2 where "+column+" = $1;", id, seconds)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not set retention",
+			util.Fields{"error": err.Error(),
+				column: id})
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		_, err = dbh.Exec("insert into "+table+" ("+column+", seconds) values ($1, $2);", id, seconds)
+	}
+	return err
+}
+
+// Return the user and device retention settings (0 if unset) and the
+// effective retention for a device.
+func (self *PgStore) GetRetention(devId string) (user, device, effective int64, err error) {
+	statement := "select coalesce((select r.seconds from userRetention as r, userToDeviceMap as u where u.deviceId = $1 and r.userId = u.userId limit 1), 0), coalesce((select seconds from deviceRetention where deviceId = $1), 0);"
+	if err = self.db.QueryRow(statement, devId).Scan(&user, &device); err != nil {
+		self.logger.Error(self.logCat, "Could not get retention",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return 0, 0, self.defExpry, err
+	}
+	return user, device, effectiveRetention(user, device, self.defExpry), nil
+}
+
+// remove all tracking information for devId.
+func (self *PgStore) PurgePosition(devId string) (err error) {
+	dbh := self.db
+
+	statement := "delete from position where deviceid = $1;"
+	if _, err = dbh.Exec(statement, devId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Return the geofences defined for a device.
+func (self *PgStore) GetGeofences(devId string) (fences []Geofence, err error) {
+	dbh := self.db
+
+	statement := "select id, name, kind, latitude, longitude, radius, coalesce(points, ''), inside, extract(epoch from created)::bigint from geofence where deviceId = $1 order by created, id;"
+	rows, err := dbh.Query(statement, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofences",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var latitude, longitude, radius float32
+		var points string
+		fence := Geofence{DeviceID: devId}
+		if err = rows.Scan(&fence.ID, &fence.Name, &fence.Kind,
+			&latitude, &longitude, &radius, &points,
+			&fence.Inside, &fence.Created); err != nil {
+			self.logger.Error(self.logCat, "Could not get geofences",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		fence.Latitude = float64(latitude)
+		fence.Longitude = float64(longitude)
+		fence.Radius = float64(radius)
+		fence.Points = decodePoints(points)
+		fences = append(fences, fence)
+	}
+	return fences, nil
+}
+
+// Create (fence.ID == "") or replace a device's geofence.
+func (self *PgStore) SetGeofence(fence Geofence) (fenceId string, err error) {
+	dbh := self.db
+
+	if fence.ID == "" {
+		fence.ID, _ = util.GenUUID4()
+		statement := "insert into geofence (id, deviceId, name, kind, latitude, longitude, radius, points, inside, created) values ($1, $2, $3, $4, $5, $6, $7, $8, false, $9);"
+		if _, err = dbh.Exec(statement, fence.ID, fence.DeviceID,
+			fence.Name, fence.Kind, float32(fence.Latitude),
+			float32(fence.Longitude), float32(fence.Radius),
+			encodePoints(fence.Points), dbNow()); err != nil {
+			self.logger.Error(self.logCat, "Could not create geofence",
+				util.Fields{"error": err.Error(),
+					"deviceId": fence.DeviceID})
+			return "", err
+		}
+		return fence.ID, nil
+	}
+	// the shape may have changed, so the state starts over.
+	statement := "update geofence set name = $1, kind = $2, latitude = $3, longitude = $4, radius = $5, points = $6, inside = false where id = $7 and deviceId = $8;"
+	res, err := dbh.Exec(statement, fence.Name, fence.Kind,
+		float32(fence.Latitude), float32(fence.Longitude),
+		float32(fence.Radius), encodePoints(fence.Points),
+		fence.ID, fence.DeviceID)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not update geofence",
+			util.Fields{"error": err.Error(),
+				"fenceId": fence.ID})
+		return "", err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return "", ErrUnknownGeofence
+	}
+	return fence.ID, nil
+}
+
+func (self *PgStore) DeleteGeofence(devId, fenceId string) (err error) {
+	res, err := self.db.Exec("delete from geofence where id = $1 and deviceId = $2;",
+		fenceId, devId)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownGeofence
+	}
+	return nil
+}
+
+// Record whether the device was last seen inside the geofence.
+func (self *PgStore) SetGeofenceState(devId, fenceId string, inside bool) (err error) {
+	_, err = self.db.Exec("update geofence set inside = $1 where id = $2 and deviceId = $3;",
+		inside, fenceId, devId)
+	return err
+}
+
+// Record a geofence enter or exit.
+func (self *PgStore) AddGeofenceEvent(event GeofenceEvent) (err error) {
+	when := time.Now()
+	if event.Time != 0 {
+		when = time.Unix(event.Time, 0)
+	}
+	statement := "insert into geofenceEvent (deviceId, fenceId, name, event, latitude, longitude, time) values ($1, $2, $3, $4, $5, $6, $7);"
+	if _, err = self.db.Exec(statement, event.DeviceID, event.FenceID,
+		event.Name, event.Event, float32(event.Latitude),
+		float32(event.Longitude), dbTime(when)); err != nil {
+		self.logger.Error(self.logCat, "Could not record geofence event",
+			util.Fields{"error": err.Error(),
+				"deviceId": event.DeviceID})
+		return err
+	}
+	return nil
+}
+
+// Return the geofence events for a device since the given time
+// (epoch seconds), newest first.
+func (self *PgStore) GetGeofenceEvents(devId string, since int64, limit int) (events []GeofenceEvent, err error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	statement := "select fenceId, name, event, latitude, longitude, extract(epoch from time)::bigint from geofenceEvent where deviceId = $1 and time >= $2 order by time desc, id desc limit $3;"
+	rows, err := self.db.Query(statement, devId,
+		dbTime(time.Unix(since, 0)), limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofence events",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var latitude, longitude float32
+		event := GeofenceEvent{DeviceID: devId}
+		if err = rows.Scan(&event.FenceID, &event.Name, &event.Event,
+			&latitude, &longitude, &event.Time); err != nil {
+			return nil, err
+		}
+		event.Latitude = float64(latitude)
+		event.Longitude = float64(longitude)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (self *PgStore) Touch(devId string) (err error) {
+	dbh := self.db
+
+	statement := "update deviceInfo set lastexchange = now() where deviceid = $1"
+	_, err = dbh.Exec(statement, devId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (self *PgStore) DeleteDevice(devId string) (err error) {
+	dbh := self.db
+
+	var tables = []string{"commandLog", "pushOutbox", "position",
+		"deviceRetention", "geofence", "geofenceEvent", "userToDeviceMap",
+		"deviceInfo"}
+
+	for _, table := range tables {
+		// BURN THE WITCH!
+		// (table names can't be parameters.)
+		_, err = dbh.Exec("delete from "+table+" where deviceid=$1;", devId)
+		if err != nil {
+			self.logger.Error(self.logCat,
+				"Could not nuke data from table",
+				util.Fields{"error": err.Error(),
+					"device": devId,
+					"table":  table})
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *PgStore) getMeta(key string) (val string, err error) {
+	var row *sql.Row
+	dbh := self.db
+
+	statement := "select val from meta where key = $1;"
+	if row = dbh.QueryRow(statement, key); row != nil {
+		row.Scan(&val)
+		return val, err
+	}
+	return "", err
+}
+
+func (self *PgStore) setMeta(key, val string) (err error) {
+	var statement string
+	dbh := self.db
+
+	// try to update or insert.
+	statement = "update meta set val = $2 where key = $1;"
+	if res, err := dbh.Exec(statement, key, val); err != nil {
+		return err
+	} else {
+		if cnt, _ := res.RowsAffected(); cnt == 0 {
+			statement = "insert into meta (key, val) values ($1, $2);"
+			if _, err = dbh.Exec(statement, key, val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *PgStore) Close() {
+	close(self.quit)
+	self.db.Close()
+}
+
+// Generate a nonce for OAuth checks
+func (self *PgStore) GetNonce() (string, error) {
+	var statement string
+	dbh := self.db
+
+	key, _ := util.GenUUID4()
+	val, _ := util.GenUUID4()
+	statement = "insert into nonce (key, val, time) values ($1, $2, current_timestamp);"
+
+	if _, err := dbh.Exec(statement, key, val); err != nil {
+		return "", err
+	}
+	ret := key + "." + genSig(key, val)
+	return ret, nil
+}
+
+// Does the user's nonce match?
+func (self *PgStore) CheckNonce(nonce string) (bool, error) {
+	var statement string
+	dbh := self.db
+
+	// gc nonces before checking.
+	statement = "delete from nonce where time < current_timestamp - interval '5 minutes' and key not like 'hawk:%';"
+	dbh.Exec(statement)
+
+	keysig := strings.SplitN(nonce, ".", 2)
+	if len(keysig) != 2 {
+		self.logger.Warn(self.logCat,
+			"Invalid nonce",
+			util.Fields{"nonce": nonce})
+		return false, nil
+	}
+	statement = "select val from nonce where key = $1 limit 1;"
+	rows, err := dbh.Query(statement, keysig[0])
+	if err == nil {
+		for rows.Next() {
+			var val string
+			err = rows.Scan(&val)
+			if err == nil {
+				dbh.Exec("delete from nonce where key = $1;", keysig[0])
+				sig := genSig(keysig[0], val)
+				return sig == keysig[1], nil
+			}
+			self.logger.Error(self.logCat,
+				"Nonce check error",
+				util.Fields{"error": err.Error()})
+			return false, err
+		}
+		// Not found
+		return false, nil
+	}
+	// An error happened.
+	self.logger.Error(self.logCat,
+		"Nonce check error",
+		util.Fields{"error": err.Error()})
+	return false, err
+}
+
+// Record a Hawk request nonce. Returns false if it was already used.
+func (self *PgStore) UseHawkNonce(id, nonce string, window int64) (fresh bool, err error) {
+	dbh := self.db
+
+	// gc nonces that have aged out of the window.
+	dbh.Exec("delete from nonce where key like 'hawk:%' and time < $1;",
+		dbTime(time.Now().Add(-time.Duration(window)*time.Second)))
+	res, err := dbh.Exec("insert into nonce (key, val, time) values ($1, '', $2) on conflict (key) do nothing;",
+		hawkNonceKey(id, nonce), dbNow())
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not record hawk nonce",
+			util.Fields{"error": err.Error(),
+				"id": id})
+		return false, err
+	}
+	cnt, err := res.RowsAffected()
+	return cnt == 1, err
+}
+
+// Store a new API token.
+func (self *PgStore) AddApiToken(token ApiToken) (tokenId string, err error) {
+	var expires interface{}
+	if token.Expires > 0 {
+		expires = dbTime(time.Unix(token.Expires, 0))
+	}
+	token.ID, _ = util.GenUUID4()
+	statement := "insert into apiToken (id, userId, name, hash, scopes, created, expires) values ($1, $2, $3, $4, $5, $6, $7);"
+	if _, err = self.db.Exec(statement, token.ID, token.UserID, token.Name,
+		token.Hash, encodeScopes(token.Scopes), dbNow(), expires); err != nil {
+		self.logger.Error(self.logCat, "Could not create API token",
+			util.Fields{"error": err.Error(),
+				"userId": token.UserID})
+		return "", err
+	}
+	return token.ID, nil
+}
+
+// Find the API token with the given hash, noting that it was used.
+func (self *PgStore) UseApiToken(hash string) (token *ApiToken, err error) {
+	var scopes string
+	token = &ApiToken{Hash: hash}
+	statement := "update apiToken set lastUsed = $1 where hash = $2 returning id, userId, name, scopes, extract(epoch from created)::bigint, coalesce(extract(epoch from expires)::bigint, 0), extract(epoch from lastUsed)::bigint;"
+	err = self.db.QueryRow(statement, dbNow(), hash).Scan(&token.ID,
+		&token.UserID, &token.Name, &scopes, &token.Created,
+		&token.Expires, &token.LastUsed)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUnknownToken
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not get API token",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	token.Scopes = decodeScopes(scopes)
+	return token, nil
+}
+
+// Return the user's API tokens, oldest first.
+func (self *PgStore) GetApiTokens(userId string) (tokens []ApiToken, err error) {
+	statement := "select id, name, scopes, extract(epoch from created)::bigint, coalesce(extract(epoch from expires)::bigint, 0), coalesce(extract(epoch from lastUsed)::bigint, 0) from apiToken where userId = $1 order by created, id;"
+	rows, err := self.db.Query(statement, userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get API tokens",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scopes string
+		token := ApiToken{UserID: userId}
+		if err = rows.Scan(&token.ID, &token.Name, &scopes,
+			&token.Created, &token.Expires, &token.LastUsed); err != nil {
+			self.logger.Error(self.logCat, "Could not get API tokens",
+				util.Fields{"error": err.Error(),
+					"userId": userId})
+			return nil, err
+		}
+		token.Scopes = decodeScopes(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (self *PgStore) DeleteApiToken(userId, tokenId string) (err error) {
+	res, err := self.db.Exec("delete from apiToken where id = $1 and userId = $2;",
+		tokenId, userId)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownToken
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/* Device secrets at rest.
+   The server needs the HAWK secrets themselves to check signatures, so
+   they can't be hashed. Instead the database drivers seal them with
+   AES-GCM under db.secret_key (16, 24 or 32 bytes, base64 encoded),
+   bound to the device id so that a sealed secret can't be copied to
+   another device's record. The key is required.
+
+   Secrets written before the key was configured are sealed when the
+   store is opened (or migrated) at the latest schema.
+*/
+
+const sealedPrefix = "gcm1:"
+
+var ErrSecretKey = errors.New("db.secret_key must be set to 16, 24 or 32 base64 encoded bytes")
+var ErrSealedSecret = errors.New("Could not open sealed secret")
+
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(config *util.MzConfig, logger *util.HekaLogger) (*secretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(
+		config.Get("db.secret_key", ""))
+	if err == nil && len(key) == 0 {
+		err = ErrSecretKey
+	}
+	var block cipher.Block
+	if err == nil {
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		logger.Error("storage", ErrSecretKey.Error(), nil)
+		return nil, ErrSecretKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+// Seal the device's secret for storage.
+func (self *secretBox) seal(devId, secret string) (string, error) {
+	if secret == "" {
+		return secret, nil
+	}
+	nonce := make([]byte, self.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := self.aead.Seal(nonce, nonce, []byte(secret), []byte(devId))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open a stored secret for the device.
+func (self *secretBox) open(devId, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil || len(sealed) < self.aead.NonceSize() {
+		return "", ErrSealedSecret
+	}
+	size := self.aead.NonceSize()
+	secret, err := self.aead.Open(nil, sealed[:size], sealed[size:],
+		[]byte(devId))
+	if err != nil {
+		return "", ErrSealedSecret
+	}
+	return string(secret), nil
+}
+
+// Seal any device secrets still stored in the clear. selectStatement
+// returns (deviceId, hawkSecret, prevSecret) for the rows to seal;
+// updateStatement takes (hawkSecret, prevSecret, deviceId, old
+// hawkSecret, old prevSecret), so a row changed since it was read is
+// left for the next pass.
+func sealStoredSecrets(dbh *sql.DB, box *secretBox, selectStatement, updateStatement string, logger *util.HekaLogger, logCat string) (err error) {
+	type plainRow struct {
+		devId, secret, prevSecret string
+	}
+	var plain []plainRow
+
+	rows, err := dbh.Query(selectStatement, sealedPrefix+"%")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var row plainRow
+		if err = rows.Scan(&row.devId, &row.secret,
+			&row.prevSecret); err != nil {
+			rows.Close()
+			return err
+		}
+		plain = append(plain, row)
+	}
+	// (SQLite has only one connection, so close before updating)
+	rows.Close()
+	for _, row := range plain {
+		secret, prevSecret := row.secret, row.prevSecret
+		if !strings.HasPrefix(secret, sealedPrefix) {
+			if secret, err = box.seal(row.devId, secret); err != nil {
+				return err
+			}
+		}
+		if !strings.HasPrefix(prevSecret, sealedPrefix) {
+			if prevSecret, err = box.seal(row.devId,
+				prevSecret); err != nil {
+				return err
+			}
+		}
+		if _, err = dbh.Exec(updateStatement, secret, prevSecret,
+			row.devId, row.secret, row.prevSecret); err != nil {
+			logger.Error(logCat, "Could not seal device secret",
+				util.Fields{"error": err.Error(),
+					"device": row.devId})
+			return err
+		}
+	}
+	if len(plain) > 0 {
+		logger.Info(logCat, "Sealed stored device secrets",
+			util.Fields{"count": strconv.Itoa(len(plain))})
+	}
+	return nil
+}
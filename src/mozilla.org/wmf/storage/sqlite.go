@@ -0,0 +1,1215 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("sqlite", OpenSqlite)
+}
+
+/* Embedded SQLite storage driver.
+   Handy for small, single binary installs. The tables match the Postgres
+   ones, except that all times are stored as unix epoch seconds.
+*/
+type SqliteStore struct {
+	config   *util.MzConfig
+	logger   *util.HekaLogger
+	metrics  *util.Metrics
+	path     string
+	logCat   string
+	defExpry int64
+	db       *sql.DB
+	secrets  *secretBox
+	quit     chan bool
+}
+
+// Open the SQLite database file (db.path)
+func OpenSqlite(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store Storage, err error) {
+	path := config.Get("db.path", "fmd.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, config)
+	// SQLite only allows one writer at a time.
+	db.SetMaxOpenConns(1)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	secrets, err := newSecretBox(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	lite := &SqliteStore{
+		config:   config,
+		logger:   logger,
+		logCat:   "storage",
+		defExpry: defaultExpry(config),
+		metrics:  metrics,
+		path:     path,
+		db:       db,
+		secrets:  secrets,
+		quit:     make(chan bool)}
+	if err = lite.sealSecrets(); err != nil {
+		return nil, err
+	}
+	go reportPool(db, config, metrics, lite.quit)
+	return lite, nil
+}
+
+// Schema changes for SQLite, oldest first.
+var sqliteMigrations = []Migration{
+	{Version: 1,
+		Name: "initial schema",
+		Up: []string{
+			"create table if not exists userToDeviceMap (userId varchar, deviceId varchar, name varchar, date integer);",
+			"create index if not exists userToDeviceMap_userId on userToDeviceMap (userId);",
+			"create index if not exists userToDeviceMap_deviceId on userToDeviceMap (deviceId);",
+			"create unique index if not exists userToDeviceMap_user_device on userToDeviceMap (userId, deviceId);",
+
+			"create table if not exists deviceInfo (deviceId varchar unique, lockable boolean, loggedin boolean, lastExchange integer, hawkSecret varchar, pushurl varchar, accepts varchar, accesstoken varchar);",
+
+			"create table if not exists pendingCommands (id integer primary key autoincrement, deviceId varchar, time integer, cmd varchar);",
+			"create index if not exists pendingCommands_deviceId on pendingCommands (deviceId);",
+
+			"create table if not exists position (id integer primary key autoincrement, deviceId varchar, time integer, latitude real, longitude real, altitude real);",
+			"create index if not exists position_deviceId on position (deviceId);",
+			// Same as the plpgsql update_time() trigger: any update to a
+			// device refreshes lastExchange. (recursive triggers are off
+			// by default, so the inner update does not refire this.)
+			"drop trigger if exists update_le;",
+			"create trigger update_le after update on deviceInfo for each row begin update deviceInfo set lastExchange = strftime('%s', 'now') where deviceId = new.deviceId; end;",
+			"create table if not exists meta (key varchar, val varchar);",
+			"create index if not exists meta_key on meta (key);",
+			"create table if not exists nonce (key varchar, val varchar, time integer);",
+			"create index if not exists nonce_key on nonce (key);",
+			"create index if not exists nonce_time on nonce (time);",
+		},
+		Down: []string{
+			// meta is kept since it holds the schema version.
+			"drop table if exists nonce;",
+			"drop trigger if exists update_le;",
+			"drop table if exists position;",
+			"drop table if exists pendingCommands;",
+			"drop table if exists deviceInfo;",
+			"drop table if exists userToDeviceMap;",
+		},
+	},
+	{Version: 2,
+		Name: "location history retention",
+		Up: []string{
+			"create table if not exists userRetention (userId varchar unique, seconds integer);",
+			"create table if not exists deviceRetention (deviceId varchar unique, seconds integer);",
+			"create index if not exists position_deviceId_time on position (deviceId, time);",
+		},
+		Down: []string{
+			"drop index if exists position_deviceId_time;",
+			"drop table if exists deviceRetention;",
+			"drop table if exists userRetention;",
+		},
+	},
+	{Version: 3,
+		Name: "position accuracy and source",
+		Up: []string{
+			"alter table position add column accuracy real default 0;",
+			"alter table position add column speed real default 0;",
+			"alter table position add column heading real default 0;",
+			"alter table position add column battery real default 0;",
+			"alter table position add column provider varchar default '';",
+		},
+		Down: []string{
+			"alter table position drop column provider;",
+			"alter table position drop column battery;",
+			"alter table position drop column heading;",
+			"alter table position drop column speed;",
+			"alter table position drop column accuracy;",
+		},
+	},
+	{Version: 4,
+		Name: "geofences",
+		Up: []string{
+			"create table if not exists geofence (id varchar unique, deviceId varchar, name varchar, kind varchar, latitude real, longitude real, radius real, points varchar, inside boolean default 0, created integer);",
+			"create index if not exists geofence_deviceId on geofence (deviceId);",
+			"create table if not exists geofenceEvent (id integer primary key autoincrement, deviceId varchar, fenceId varchar, name varchar, event varchar, latitude real, longitude real, time integer);",
+			"create index if not exists geofenceEvent_deviceId_time on geofenceEvent (deviceId, time);",
+		},
+		Down: []string{
+			"drop table if exists geofenceEvent;",
+			"drop table if exists geofence;",
+		},
+	},
+	{Version: 5,
+		Name: "command ledger",
+		Up: []string{
+			"create table if not exists commandLog (id integer primary key autoincrement, deviceId varchar, type varchar, cmd varchar, state varchar, detail varchar default '', created integer, updated integer);",
+			"create index if not exists commandLog_deviceId_state on commandLog (deviceId, state);",
+			// commands are stored as {"<type>":{...}}
+			"insert into commandLog (deviceId, type, cmd, state, detail, created, updated) select deviceId, substr(cmd, 3, 1), cmd, 'queued', '', time, time from pendingCommands order by id;",
+			"drop table if exists pendingCommands;",
+		},
+		Down: []string{
+			"create table if not exists pendingCommands (id integer primary key autoincrement, deviceId varchar, time integer, cmd varchar);",
+			"create index if not exists pendingCommands_deviceId on pendingCommands (deviceId);",
+			"insert into pendingCommands (deviceId, time, cmd) select deviceId, created, cmd from commandLog where state in ('queued', 'pushed') order by id;",
+			"drop table if exists commandLog;",
+		},
+	},
+	{Version: 6,
+		Name: "command expiry",
+		Up: []string{
+			"alter table commandLog add column expires integer default 0;",
+		},
+		Down: []string{
+			"alter table commandLog drop column expires;",
+		},
+	},
+	{Version: 7,
+		Name: "device capabilities",
+		Up: []string{
+			"alter table deviceInfo add column capabilities varchar default '';",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column capabilities;",
+		},
+	},
+	{Version: 8,
+		Name: "web push",
+		Up: []string{
+			"alter table deviceInfo add column pushType varchar default 'simplepush';",
+			"alter table deviceInfo add column pushKey varchar default '';",
+			"alter table deviceInfo add column pushAuth varchar default '';",
+			"alter table deviceInfo add column pushGone boolean default 0;",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column pushGone;",
+			"alter table deviceInfo drop column pushAuth;",
+			"alter table deviceInfo drop column pushKey;",
+			"alter table deviceInfo drop column pushType;",
+		},
+	},
+	{Version: 9,
+		Name: "push outbox",
+		Up: []string{
+			"create table if not exists pushOutbox (id integer primary key autoincrement, deviceId varchar, cmdId integer, attempts integer default 0, nextAttempt integer, deadline integer, lastError varchar default '', created integer);",
+			"create index if not exists pushOutbox_nextAttempt on pushOutbox (nextAttempt);",
+		},
+		Down: []string{
+			"drop table if exists pushOutbox;",
+		},
+	},
+	{Version: 10,
+		Name: "hawk nonces",
+		Up: []string{
+			"delete from nonce where key like 'hawk:%';",
+			"create unique index if not exists nonce_key_uniq on nonce (key);",
+		},
+		Down: []string{
+			"drop index if exists nonce_key_uniq;",
+		},
+	},
+	{Version: 11,
+		Name: "secret rotation",
+		Up: []string{
+			"alter table deviceInfo add column prevSecret varchar default '';",
+			"alter table deviceInfo add column prevSecretExpires integer default 0;",
+		},
+		Down: []string{
+			"alter table deviceInfo drop column prevSecretExpires;",
+			"alter table deviceInfo drop column prevSecret;",
+		},
+	},
+	{Version: 12,
+		Name: "api tokens",
+		Up: []string{
+			"create table if not exists apiToken (id varchar unique, userId varchar, name varchar, hash varchar unique, scopes varchar, created integer, expires integer default 0, lastUsed integer default 0);",
+			"create index if not exists apitoken_userid_idx on apiToken (userId);",
+		},
+		Down: []string{
+			"drop table if exists apiToken;",
+		},
+	},
+}
+
+// Return the applied and latest known schema versions.
+func (self *SqliteStore) SchemaVersion() (current, latest int, err error) {
+	return schemaVersion(self.db, "select val from meta where key = ?;"),
+		latestVersion(sqliteMigrations), nil
+}
+
+// Apply (or roll back) migrations until the schema is at target.
+// (-1 for the latest version)
+func (self *SqliteStore) Migrate(target int) (err error) {
+	current, _, err := self.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err = migrate(self.db, sqliteMigrations, current, target,
+		self.logger, self.logCat); err != nil {
+		return err
+	}
+	return self.sealSecrets()
+}
+
+// Seal the device secrets stored before db.secret_key was set. (Only
+// at the latest schema; Migrate calls this again once it's there.)
+func (self *SqliteStore) sealSecrets() (err error) {
+	if current, latest, _ := self.SchemaVersion(); current < latest {
+		return nil
+	}
+	return sealStoredSecrets(self.db, self.secrets,
+		"select deviceId, coalesce(hawkSecret, ''), coalesce(prevSecret, '') from deviceInfo where (coalesce(hawkSecret, '') <> '' and hawkSecret not like ?1) or (coalesce(prevSecret, '') <> '' and prevSecret not like ?1);",
+		"update deviceInfo set hawkSecret = ?, prevSecret = ? where deviceId = ? and coalesce(hawkSecret, '') = ? and coalesce(prevSecret, '') = ?;",
+		self.logger, self.logCat)
+}
+
+// Register a new device to a given userID.
+func (self *SqliteStore) RegisterDevice(userid string, dev Device) (devId string, err error) {
+	dbh := self.db
+	statement := "insert into deviceInfo (deviceId, lockable, loggedin, lastExchange, hawkSecret, accepts, pushUrl, capabilities, pushType, pushKey, pushAuth) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	if dev.ID == "" {
+		dev.ID, _ = util.GenUUID4()
+	}
+	secret, err := self.secrets.seal(dev.ID, dev.Secret)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not seal device secret",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	// Purge old registration records.
+	if _, err = dbh.Exec("delete from deviceInfo where deviceId = ?;", dev.ID); err != nil {
+		self.logger.Error(self.logCat,
+			"Could not purge old deviceinfo record",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	if _, err = dbh.Exec("delete from userToDeviceMap where deviceId = ?;", dev.ID); err != nil {
+		self.logger.Error(self.logCat,
+			"Could not purge old usertodevicemap record",
+			util.Fields{"error": err.Error(),
+				"deviceId": dev.ID})
+		return "", err
+	}
+	if _, err = dbh.Exec(statement,
+		string(dev.ID),
+		dev.HasPasscode,
+		dev.LoggedIn,
+		time.Now().Unix(),
+		secret,
+		dev.Accepts,
+		dev.PushUrl,
+		dev.Capabilities,
+		dev.PushType,
+		dev.PushKey,
+		dev.PushAuth); err != nil {
+		self.logger.Error(self.logCat, "Could not create device",
+			util.Fields{"error": err.Error(),
+				"device": fmt.Sprintf("%+v", dev)})
+		return "", err
+	}
+	if _, err = dbh.Exec("insert into userToDeviceMap (userId, deviceId, name, date) values (?, ?, ?, ?);",
+		userid, dev.ID, dev.Name, time.Now().Unix()); err != nil {
+		self.logger.Error(self.logCat,
+			"Could not map device to user",
+			util.Fields{
+				"uid":      userid,
+				"deviceId": dev.ID,
+				"name":     dev.Name,
+				"error":    err.Error()})
+		return "", err
+	}
+	return dev.ID, nil
+}
+
+// Return known info about a device.
+func (self *SqliteStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
+	var deviceId, userId, name string
+	var pushUrl, accepts, secret, accesstoken, capabilities sql.NullString
+	var pushType, pushKey, pushAuth, prevSecret sql.NullString
+	var lastexchange, prevSecretExpires sql.NullInt64
+	var hasPasscode, loggedIn, pushGone sql.NullBool
+
+	statement := "select d.deviceId, u.userId, coalesce(u.name,d.deviceId), d.lockable, d.loggedin, d.pushUrl, d.accepts, d.hawksecret, d.lastexchange, d.accesstoken, d.capabilities, d.pushType, d.pushKey, d.pushAuth, d.pushGone, d.prevSecret, d.prevSecretExpires from userToDeviceMap as u, deviceInfo as d where u.deviceId=? and u.deviceId=d.deviceId;"
+	err = self.db.QueryRow(statement, devId).Scan(&deviceId, &userId, &name,
+		&hasPasscode, &loggedIn, &pushUrl, &accepts, &secret, &lastexchange,
+		&accesstoken, &capabilities, &pushType, &pushKey, &pushAuth, &pushGone,
+		&prevSecret, &prevSecretExpires)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUnknownDevice
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not fetch device info",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	default:
+	}
+	hawkSecret, err := self.secrets.open(devId, secret.String)
+	var prevHawkSecret string
+	if err == nil {
+		prevHawkSecret, err = self.secrets.open(devId, prevSecret.String)
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not open device secret",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	reply := &Device{
+		ID:          deviceId,
+		User:        userId,
+		Name:        name,
+		Secret:      hawkSecret,
+		HasPasscode: hasPasscode.Bool,
+		//If we have a pushUrl, the user is logged in.
+		LoggedIn:     pushUrl.String != "",
+		LastExchange: int32(lastexchange.Int64),
+		PushUrl:      pushUrl.String,
+		Accepts:      accepts.String,
+		AccessToken:  accesstoken.String,
+		Capabilities: capabilities.String,
+		PushType:     pushType.String,
+		PushKey:      pushKey.String,
+		PushAuth:     pushAuth.String,
+		PushGone:     pushGone.Bool,
+	}
+	reply.PrevSecret = prevHawkSecret
+	reply.PrevSecretExpires = prevSecretExpires.Int64
+
+	return reply, nil
+}
+
+// Return the latest known position for a device.
+func (self *SqliteStore) GetPositions(devId string) (positions []Position, err error) {
+	return self.GetPositionHistory(devId, 0, 0, 1)
+}
+
+// Return the positions recorded for a device between since and until
+// (epoch seconds, 0 for unbounded), newest first.
+func (self *SqliteStore) GetPositionHistory(devId string, since, until int64, limit int) (positions []Position, err error) {
+	if limit <= 0 {
+		// sqlite treats a negative limit as "no limit"
+		limit = -1
+	}
+	statement := "select time, latitude, longitude, altitude, accuracy, speed, heading, battery, provider from position where deviceid=? and (? = 0 or time >= ?) and (? = 0 or time <= ?) order by time desc, id desc limit ?;"
+	rows, err := self.db.Query(statement, devId, since, since, until, until, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get positions",
+			util.Fields{"error": err.Error()})
+		return positions, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pos Position
+		err = rows.Scan(&pos.Time, &pos.Latitude, &pos.Longitude, &pos.Altitude,
+			&pos.Accuracy, &pos.Speed, &pos.Heading, &pos.Battery, &pos.Provider)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not get positions",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			break
+		}
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+// Get up to limit of the oldest undelivered commands and mark them
+// delivered. Commands past their expiry are marked expired and skipped.
+func (self *SqliteStore) GetPending(devId string, limit int) (commands []Command, err error) {
+	now := time.Now().Unix()
+	res, err := self.db.Exec("update commandLog set state = ?, updated = ? where deviceId = ? and state in (?, ?) and expires > 0 and expires < ?;",
+		CMD_EXPIRED, now, devId, CMD_QUEUED, CMD_PUSHED, now)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not expire commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+	} else if cnt, _ := res.RowsAffected(); cnt > 0 {
+		self.logger.Info(self.logCat, "Commands expired",
+			util.Fields{"deviceId": devId,
+				"count": strconv.FormatInt(cnt, 10)})
+		self.metrics.IncrementBy("cmd.expired", int(cnt))
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	statement := "select id, type, cmd, created from commandLog where deviceId = ? and state in (?, ?) order by created, id limit ?;"
+	rows, err := self.db.Query(statement, devId, CMD_QUEUED, CMD_PUSHED, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not read pending command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	for rows.Next() {
+		c := Command{DeviceID: devId, State: CMD_DELIVERED}
+		if err = rows.Scan(&c.ID, &c.Type, &c.Cmd, &c.Created); err != nil {
+			rows.Close()
+			self.logger.Error(self.logCat, "Could not read pending command",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	// (only one connection, so the rows must be closed before updating)
+	rows.Close()
+	// Only take the commands that are still pending, so that two polls
+	// can't both deliver the same one.
+	claimed := commands[:0]
+	for _, c := range commands {
+		res, err := self.db.Exec("update commandLog set state = ?, updated = ? where id = ? and deviceId = ? and state in (?, ?);",
+			CMD_DELIVERED, now, c.ID, devId, CMD_QUEUED, CMD_PUSHED)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not claim pending command",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		if cnt, _ := res.RowsAffected(); cnt == 0 {
+			continue
+		}
+		self.metrics.Timer("cmd.pending", now-c.Created)
+		claimed = append(claimed, c)
+	}
+	self.Touch(devId)
+	return claimed, nil
+}
+
+func (self *SqliteStore) GetUserFromDevice(deviceId string) (userId, name string, err error) {
+	var uname sql.NullString
+
+	statement := "select userId, name from userToDeviceMap where deviceId = ? limit 1;"
+	err = self.db.QueryRow(statement, deviceId).Scan(&userId, &uname)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", "", ErrUnknownDevice
+	case err != nil:
+		self.logger.Error(self.logCat,
+			"Could not get user for device",
+			util.Fields{"error": err.Error(),
+				"user": deviceId})
+		return "", "", err
+	}
+	return userId, uname.String, nil
+}
+
+// Get all known devices for this user.
+func (self *SqliteStore) GetDevicesForUser(userId string) (devices []DeviceList, err error) {
+	statement := "select deviceId, coalesce(name,deviceId) from userToDeviceMap where userId = ? order by date;"
+	rows, err := self.db.Query(statement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err = rows.Scan(&id, &name); err != nil {
+			self.logger.Error(self.logCat,
+				"Could not get list of devices for user",
+				util.Fields{"error": err.Error(),
+					"user": userId})
+			return nil, err
+		}
+		devices = append(devices, DeviceList{ID: id, Name: name})
+	}
+	return devices, nil
+}
+
+// Store a command into the list of pending commands for a device.
+func (self *SqliteStore) StoreCommand(devId, cmdType, command string, expires int64) (cmdId int64, err error) {
+	statement := "insert into commandLog (deviceId, type, cmd, state, detail, created, updated, expires) values (?, ?, ?, ?, '', ?, ?, ?);"
+
+	self.logger.Debug(self.logCat, "Storing Command",
+		util.Fields{"deviceId": devId, "command": command})
+	now := time.Now().Unix()
+	res, err := self.db.Exec(statement, devId, cmdType, command,
+		CMD_QUEUED, now, now, expires)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not store pending command",
+			util.Fields{"error": err.Error()})
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Cancel a command that has not been delivered yet.
+func (self *SqliteStore) CancelCommand(devId string, cmdId int64) (err error) {
+	var state string
+
+	res, err := self.db.Exec("update commandLog set state = ?, updated = ? where id = ? and deviceId = ? and state in (?, ?);",
+		CMD_CANCELLED, time.Now().Unix(), cmdId, devId, CMD_QUEUED, CMD_PUSHED)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt > 0 {
+		return nil
+	}
+	err = self.db.QueryRow("select state from commandLog where id = ? and deviceId = ?;",
+		cmdId, devId).Scan(&state)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrUnknownCommand
+	case err != nil:
+		return err
+	}
+	return ErrCommandDelivered
+}
+
+// Move an undelivered command to a new state, noting any detail.
+func (self *SqliteStore) SetCommandState(devId string, cmdId int64, state, detail string) (err error) {
+	statement := "update commandLog set state = ?, detail = ?, updated = ? where id = ? and deviceId = ? and state in (?, ?);"
+	if _, err = self.db.Exec(statement, state, detail, time.Now().Unix(),
+		cmdId, devId, CMD_QUEUED, CMD_PUSHED); err != nil {
+		self.logger.Error(self.logCat, "Could not update command state",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"state":    state})
+	}
+	return err
+}
+
+// Move the most recently delivered command of cmdType to a new state.
+func (self *SqliteStore) AckCommand(devId, cmdType, state, detail string) (err error) {
+	statement := "update commandLog set state = ?, detail = ?, updated = ? where id = (select id from commandLog where deviceId = ? and type = ? and state = ? order by id desc limit 1);"
+	if _, err = self.db.Exec(statement, state, detail, time.Now().Unix(),
+		devId, cmdType, CMD_DELIVERED); err != nil {
+		self.logger.Error(self.logCat, "Could not update command state",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId,
+				"state":    state})
+	}
+	return err
+}
+
+// Add a failed push to the outbox to be retried.
+func (self *SqliteStore) QueuePush(job PushJob) (jobId int64, err error) {
+	statement := "insert into pushOutbox (deviceId, cmdId, attempts, nextAttempt, deadline, lastError, created) values (?, ?, ?, ?, ?, ?, ?);"
+	res, err := self.db.Exec(statement, job.DeviceID, job.CmdID,
+		job.Attempts, job.NextAttempt, job.Deadline, job.LastError,
+		time.Now().Unix())
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not queue push",
+			util.Fields{"error": err.Error(),
+				"deviceId": job.DeviceID})
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Claim the outbox entries that are due a retry.
+func (self *SqliteStore) ClaimPushes(limit int, lease int64) (jobs []PushJob, err error) {
+	now := time.Now().Unix()
+	statement := "select p.id, p.deviceId, p.cmdId, p.attempts, p.deadline, p.lastError, coalesce(c.state, '') from pushOutbox as p left join commandLog as c on c.id = p.cmdId where p.nextAttempt <= ? order by p.nextAttempt limit ?;"
+	rows, err := self.db.Query(statement, now, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not claim pushes",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	for rows.Next() {
+		job := PushJob{NextAttempt: now + lease}
+		if err = rows.Scan(&job.ID, &job.DeviceID, &job.CmdID,
+			&job.Attempts, &job.Deadline, &job.LastError,
+			&job.CmdState); err != nil {
+			rows.Close()
+			self.logger.Error(self.logCat, "Could not read push",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	// (only one connection, so the rows must be closed before updating)
+	rows.Close()
+	// Only take the jobs that are still due, so that two workers can't
+	// both send the same push.
+	claimed := jobs[:0]
+	for _, job := range jobs {
+		res, err := self.db.Exec("update pushOutbox set nextAttempt = ? where id = ? and nextAttempt <= ?;",
+			job.NextAttempt, job.ID, now)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not claim push",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		if cnt, _ := res.RowsAffected(); cnt > 0 {
+			claimed = append(claimed, job)
+		}
+	}
+	return claimed, nil
+}
+
+// Record a failed attempt and when to try again.
+func (self *SqliteStore) RetryPush(jobId int64, attempts int, next int64, lastError string) (err error) {
+	statement := "update pushOutbox set attempts = ?, nextAttempt = ?, lastError = ? where id = ?;"
+	if _, err = self.db.Exec(statement, attempts, next, lastError,
+		jobId); err != nil {
+		self.logger.Error(self.logCat, "Could not reschedule push",
+			util.Fields{"error": err.Error(),
+				"jobId": strconv.FormatInt(jobId, 10)})
+	}
+	return err
+}
+
+// Remove an entry from the outbox.
+func (self *SqliteStore) DeletePush(jobId int64) (err error) {
+	if _, err = self.db.Exec("delete from pushOutbox where id = ?;",
+		jobId); err != nil {
+		self.logger.Error(self.logCat, "Could not remove push",
+			util.Fields{"error": err.Error(),
+				"jobId": strconv.FormatInt(jobId, 10)})
+	}
+	return err
+}
+
+// Return the command history for a device, newest first.
+func (self *SqliteStore) GetCommands(devId string, limit int) (commands []Command, err error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	statement := "select id, type, cmd, state, coalesce(detail, ''), created, updated, coalesce(expires, 0) from commandLog where deviceId = ? order by id desc limit ?;"
+	rows, err := self.db.Query(statement, devId, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get commands",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := Command{DeviceID: devId}
+		if err = rows.Scan(&c.ID, &c.Type, &c.Cmd, &c.State, &c.Detail,
+			&c.Created, &c.Updated, &c.Expires); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+func (self *SqliteStore) SetAccessToken(devId, token string) (err error) {
+	statement := "update deviceInfo set accesstoken = ? where deviceId = ?"
+	if _, err = self.db.Exec(statement, token, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not set the access token",
+			util.Fields{"error": err.Error(),
+				"device": devId,
+				"token":  token})
+		return err
+	}
+	return nil
+}
+
+// Note that the push service no longer knows the device's endpoint.
+func (self *SqliteStore) SetPushGone(devId string) (err error) {
+	statement := "update deviceInfo set pushGone = ? where deviceId = ?"
+	if _, err = self.db.Exec(statement, true, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not mark push endpoint gone",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	return nil
+}
+
+// Replace the device's HAWK secret, keeping the old one for grace
+// seconds.
+func (self *SqliteStore) RotateSecret(devId, secret string, grace int64) (err error) {
+	sealed, err := self.secrets.seal(devId, secret)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	// If the device hasn't picked up the last new secret yet, it is
+	// still using the one before that.
+	statement := "update deviceInfo set prevSecret = case when coalesce(prevSecret, '') <> '' and prevSecretExpires > ? then prevSecret else hawkSecret end, prevSecretExpires = ?, hawkSecret = ? where deviceId = ?"
+	res, err := self.db.Exec(statement, now, now+grace, sealed, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not rotate device secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownDevice
+	}
+	return nil
+}
+
+// Forget the device's previous HAWK secret.
+func (self *SqliteStore) DropPrevSecret(devId string) (err error) {
+	statement := "update deviceInfo set prevSecret = '', prevSecretExpires = 0 where deviceId = ?"
+	if _, err = self.db.Exec(statement, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not drop previous secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	return nil
+}
+
+// Remove the device's HAWK secrets.
+func (self *SqliteStore) RevokeSecret(devId string) (err error) {
+	statement := "update deviceInfo set hawkSecret = '', prevSecret = '', prevSecretExpires = 0 where deviceId = ?"
+	res, err := self.db.Exec(statement, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not revoke device secret",
+			util.Fields{"error": err.Error(),
+				"device": devId})
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownDevice
+	}
+	return nil
+}
+
+// Shorthand function to set the lock state for a device.
+func (self *SqliteStore) SetDeviceLock(devId string, state bool) (err error) {
+	statement := "update deviceInfo set lockable = ? where deviceId = ?"
+	if _, err = self.db.Exec(statement, state, devId); err != nil {
+		self.logger.Error(self.logCat, "Could not set device lock state",
+			util.Fields{"error": err.Error(),
+				"device": devId,
+				"state":  fmt.Sprintf("%t", state)})
+		return err
+	}
+	return nil
+}
+
+// Add the location information to the known set for a device.
+func (self *SqliteStore) SetDeviceLocation(devId string, position Position) (err error) {
+	statement := "insert into position (deviceId, time, latitude, longitude, altitude, accuracy, speed, heading, battery, provider) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	if _, err = self.db.Exec(statement,
+		devId,
+		time.Now().Unix(),
+		position.Latitude,
+		position.Longitude,
+		position.Altitude,
+		position.Accuracy,
+		position.Speed,
+		position.Heading,
+		position.Battery,
+		position.Provider); err != nil {
+		self.logger.Error(self.logCat, "Error inserting postion",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// Remove expired postion information for a device, according to its
+// retention settings. The latest position is always kept.
+func (self *SqliteStore) GcPosition(devId string) (err error) {
+	_, _, expry, err := self.GetRetention(devId)
+	if err != nil {
+		return err
+	}
+	statement := "delete from position where deviceId = ? and time < ? and id <> (select id from position where deviceId = ? order by time desc, id desc limit 1);"
+	if _, err = self.db.Exec(statement, devId, time.Now().Unix()-expry, devId); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing positions",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	// geofence events follow the same retention.
+	statement = "delete from geofenceEvent where deviceId = ? and time < ?;"
+	if _, err = self.db.Exec(statement, devId, time.Now().Unix()-expry); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing geofence events",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	// as does the history of finished commands.
+	statement = "delete from commandLog where deviceId = ? and updated < ? and state not in (?, ?);"
+	if _, err = self.db.Exec(statement, devId, time.Now().Unix()-expry,
+		CMD_QUEUED, CMD_PUSHED); err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing command log",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	return nil
+}
+
+// Return the ids of every registered device.
+func (self *SqliteStore) GetAllDeviceIds() (devIds []string, err error) {
+	rows, err := self.db.Query("select deviceId from deviceInfo;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		devIds = append(devIds, id)
+	}
+	return devIds, nil
+}
+
+// Set how long (in seconds) to keep a user's positions. 0 clears it.
+func (self *SqliteStore) SetUserRetention(userId string, seconds int64) (err error) {
+	return self.setRetention("userRetention", "userId", userId, seconds)
+}
+
+// Set how long (in seconds) to keep a device's positions. 0 clears it.
+func (self *SqliteStore) SetDeviceRetention(devId string, seconds int64) (err error) {
+	return self.setRetention("deviceRetention", "deviceId", devId, seconds)
+}
+
+func (self *SqliteStore) setRetention(table, column, id string, seconds int64) (err error) {
+	// table and column are never user supplied.
+	if seconds <= 0 {
+		_, err = self.db.Exec("delete from "+table+" where "+column+" = ?;", id)
+		return err
+	}
+	_, err = self.db.Exec("insert or replace into "+table+" ("+column+", seconds) values (?, ?);", id, seconds)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not set retention",
+			util.Fields{"error": err.Error(),
+				column: id})
+	}
+	return err
+}
+
+// Return the user and device retention settings (0 if unset) and the
+// effective retention for a device.
+func (self *SqliteStore) GetRetention(devId string) (user, device, effective int64, err error) {
+	statement := "select coalesce((select r.seconds from userRetention as r, userToDeviceMap as u where u.deviceId = ? and r.userId = u.userId limit 1), 0), coalesce((select seconds from deviceRetention where deviceId = ?), 0);"
+	if err = self.db.QueryRow(statement, devId, devId).Scan(&user, &device); err != nil {
+		self.logger.Error(self.logCat, "Could not get retention",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return 0, 0, self.defExpry, err
+	}
+	return user, device, effectiveRetention(user, device, self.defExpry), nil
+}
+
+// remove all tracking information for devId.
+func (self *SqliteStore) PurgePosition(devId string) (err error) {
+	_, err = self.db.Exec("delete from position where deviceid = ?;", devId)
+	return err
+}
+
+// Return the geofences defined for a device.
+func (self *SqliteStore) GetGeofences(devId string) (fences []Geofence, err error) {
+	statement := "select id, name, kind, latitude, longitude, radius, coalesce(points, ''), inside, created from geofence where deviceId = ? order by created, id;"
+	rows, err := self.db.Query(statement, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofences",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var points string
+		fence := Geofence{DeviceID: devId}
+		if err = rows.Scan(&fence.ID, &fence.Name, &fence.Kind,
+			&fence.Latitude, &fence.Longitude, &fence.Radius, &points,
+			&fence.Inside, &fence.Created); err != nil {
+			self.logger.Error(self.logCat, "Could not get geofences",
+				util.Fields{"error": err.Error(),
+					"deviceId": devId})
+			return nil, err
+		}
+		fence.Points = decodePoints(points)
+		fences = append(fences, fence)
+	}
+	return fences, nil
+}
+
+// Create (fence.ID == "") or replace a device's geofence.
+func (self *SqliteStore) SetGeofence(fence Geofence) (fenceId string, err error) {
+	if fence.ID == "" {
+		fence.ID, _ = util.GenUUID4()
+		statement := "insert into geofence (id, deviceId, name, kind, latitude, longitude, radius, points, inside, created) values (?, ?, ?, ?, ?, ?, ?, ?, 0, ?);"
+		if _, err = self.db.Exec(statement, fence.ID, fence.DeviceID,
+			fence.Name, fence.Kind, fence.Latitude, fence.Longitude,
+			fence.Radius, encodePoints(fence.Points),
+			time.Now().Unix()); err != nil {
+			self.logger.Error(self.logCat, "Could not create geofence",
+				util.Fields{"error": err.Error(),
+					"deviceId": fence.DeviceID})
+			return "", err
+		}
+		return fence.ID, nil
+	}
+	// the shape may have changed, so the state starts over.
+	statement := "update geofence set name = ?, kind = ?, latitude = ?, longitude = ?, radius = ?, points = ?, inside = 0 where id = ? and deviceId = ?;"
+	res, err := self.db.Exec(statement, fence.Name, fence.Kind,
+		fence.Latitude, fence.Longitude, fence.Radius,
+		encodePoints(fence.Points), fence.ID, fence.DeviceID)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not update geofence",
+			util.Fields{"error": err.Error(),
+				"fenceId": fence.ID})
+		return "", err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return "", ErrUnknownGeofence
+	}
+	return fence.ID, nil
+}
+
+func (self *SqliteStore) DeleteGeofence(devId, fenceId string) (err error) {
+	res, err := self.db.Exec("delete from geofence where id = ? and deviceId = ?;",
+		fenceId, devId)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownGeofence
+	}
+	return nil
+}
+
+// Record whether the device was last seen inside the geofence.
+func (self *SqliteStore) SetGeofenceState(devId, fenceId string, inside bool) (err error) {
+	_, err = self.db.Exec("update geofence set inside = ? where id = ? and deviceId = ?;",
+		inside, fenceId, devId)
+	return err
+}
+
+// Record a geofence enter or exit.
+func (self *SqliteStore) AddGeofenceEvent(event GeofenceEvent) (err error) {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	statement := "insert into geofenceEvent (deviceId, fenceId, name, event, latitude, longitude, time) values (?, ?, ?, ?, ?, ?, ?);"
+	if _, err = self.db.Exec(statement, event.DeviceID, event.FenceID,
+		event.Name, event.Event, event.Latitude, event.Longitude,
+		event.Time); err != nil {
+		self.logger.Error(self.logCat, "Could not record geofence event",
+			util.Fields{"error": err.Error(),
+				"deviceId": event.DeviceID})
+		return err
+	}
+	return nil
+}
+
+// Return the geofence events for a device since the given time
+// (epoch seconds), newest first.
+func (self *SqliteStore) GetGeofenceEvents(devId string, since int64, limit int) (events []GeofenceEvent, err error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	statement := "select fenceId, name, event, latitude, longitude, time from geofenceEvent where deviceId = ? and time >= ? order by time desc, id desc limit ?;"
+	rows, err := self.db.Query(statement, devId, since, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get geofence events",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		event := GeofenceEvent{DeviceID: devId}
+		if err = rows.Scan(&event.FenceID, &event.Name, &event.Event,
+			&event.Latitude, &event.Longitude, &event.Time); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (self *SqliteStore) Touch(devId string) (err error) {
+	statement := "update deviceInfo set lastexchange = ? where deviceid = ?"
+	_, err = self.db.Exec(statement, time.Now().Unix(), devId)
+	return err
+}
+
+func (self *SqliteStore) DeleteDevice(devId string) (err error) {
+	var tables = []string{"commandLog", "pushOutbox", "position",
+		"deviceRetention", "geofence", "geofenceEvent", "userToDeviceMap",
+		"deviceInfo"}
+
+	for _, table := range tables {
+		// table names can't be parameters.
+		_, err = self.db.Exec("delete from "+table+" where deviceid = ?;", devId)
+		if err != nil {
+			self.logger.Error(self.logCat,
+				"Could not nuke data from table",
+				util.Fields{"error": err.Error(),
+					"device": devId,
+					"table":  table})
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *SqliteStore) getMeta(key string) (val string, err error) {
+	err = self.db.QueryRow("select val from meta where key = ?;", key).Scan(&val)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return val, err
+}
+
+func (self *SqliteStore) setMeta(key, val string) (err error) {
+	res, err := self.db.Exec("update meta set val = ? where key = ?;", val, key)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		_, err = self.db.Exec("insert into meta (key, val) values (?, ?);", key, val)
+	}
+	return err
+}
+
+func (self *SqliteStore) Close() {
+	close(self.quit)
+	self.db.Close()
+}
+
+// Generate a nonce for OAuth checks
+func (self *SqliteStore) GetNonce() (string, error) {
+	key, _ := util.GenUUID4()
+	val, _ := util.GenUUID4()
+	statement := "insert into nonce (key, val, time) values (?, ?, ?);"
+	if _, err := self.db.Exec(statement, key, val, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return key + "." + genSig(key, val), nil
+}
+
+// Does the user's nonce match?
+func (self *SqliteStore) CheckNonce(nonce string) (bool, error) {
+	var val string
+
+	// gc nonces before checking.
+	self.db.Exec("delete from nonce where time < ? and key not like 'hawk:%';",
+		time.Now().Add(-5*time.Minute).Unix())
+
+	keysig := strings.SplitN(nonce, ".", 2)
+	if len(keysig) != 2 {
+		self.logger.Warn(self.logCat,
+			"Invalid nonce",
+			util.Fields{"nonce": nonce})
+		return false, nil
+	}
+	err := self.db.QueryRow("select val from nonce where key = ? limit 1;",
+		keysig[0]).Scan(&val)
+	switch {
+	case err == sql.ErrNoRows:
+		// Not found
+		return false, nil
+	case err != nil:
+		self.logger.Error(self.logCat,
+			"Nonce check error",
+			util.Fields{"error": err.Error()})
+		return false, err
+	}
+	self.db.Exec("delete from nonce where key = ?;", keysig[0])
+	return genSig(keysig[0], val) == keysig[1], nil
+}
+
+// Record a Hawk request nonce. Returns false if it was already used.
+func (self *SqliteStore) UseHawkNonce(id, nonce string, window int64) (fresh bool, err error) {
+	now := time.Now().Unix()
+	// gc nonces that have aged out of the window.
+	self.db.Exec("delete from nonce where key like 'hawk:%' and time < ?;",
+		now-window)
+	res, err := self.db.Exec("insert or ignore into nonce (key, val, time) values (?, '', ?);",
+		hawkNonceKey(id, nonce), now)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not record hawk nonce",
+			util.Fields{"error": err.Error(),
+				"id": id})
+		return false, err
+	}
+	cnt, err := res.RowsAffected()
+	return cnt == 1, err
+}
+
+// Store a new API token.
+func (self *SqliteStore) AddApiToken(token ApiToken) (tokenId string, err error) {
+	token.ID, _ = util.GenUUID4()
+	statement := "insert into apiToken (id, userId, name, hash, scopes, created, expires) values (?, ?, ?, ?, ?, ?, ?);"
+	if _, err = self.db.Exec(statement, token.ID, token.UserID, token.Name,
+		token.Hash, encodeScopes(token.Scopes), time.Now().Unix(),
+		token.Expires); err != nil {
+		self.logger.Error(self.logCat, "Could not create API token",
+			util.Fields{"error": err.Error(),
+				"userId": token.UserID})
+		return "", err
+	}
+	return token.ID, nil
+}
+
+// Find the API token with the given hash, noting that it was used.
+func (self *SqliteStore) UseApiToken(hash string) (token *ApiToken, err error) {
+	var scopes string
+	token = &ApiToken{Hash: hash}
+	statement := "select id, userId, name, scopes, created, expires from apiToken where hash = ?;"
+	err = self.db.QueryRow(statement, hash).Scan(&token.ID, &token.UserID,
+		&token.Name, &scopes, &token.Created, &token.Expires)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUnknownToken
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not get API token",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	token.LastUsed = time.Now().Unix()
+	self.db.Exec("update apiToken set lastUsed = ? where id = ?;",
+		token.LastUsed, token.ID)
+	token.Scopes = decodeScopes(scopes)
+	return token, nil
+}
+
+// Return the user's API tokens, oldest first.
+func (self *SqliteStore) GetApiTokens(userId string) (tokens []ApiToken, err error) {
+	statement := "select id, name, scopes, created, expires, lastUsed from apiToken where userId = ? order by created, id;"
+	rows, err := self.db.Query(statement, userId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not get API tokens",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scopes string
+		token := ApiToken{UserID: userId}
+		if err = rows.Scan(&token.ID, &token.Name, &scopes,
+			&token.Created, &token.Expires, &token.LastUsed); err != nil {
+			self.logger.Error(self.logCat, "Could not get API tokens",
+				util.Fields{"error": err.Error(),
+					"userId": userId})
+			return nil, err
+		}
+		token.Scopes = decodeScopes(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (self *SqliteStore) DeleteApiToken(userId, tokenId string) (err error) {
+	res, err := self.db.Exec("delete from apiToken where id = ? and userId = ?;",
+		tokenId, userId)
+	if err != nil {
+		return err
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return ErrUnknownToken
+	}
+	return nil
+}
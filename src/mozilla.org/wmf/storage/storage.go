@@ -8,29 +8,148 @@ import (
 	"mozilla.org/util"
 
 	"crypto/md5"
-	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
-	_ "github.com/lib/pq"
 	"io"
 	"strconv"
 	"strings"
-	"time"
 )
 
 var ErrDatabase = errors.New("Database Error")
 var ErrUnknownDevice = errors.New("Unknown device")
+var ErrUnknownDriver = errors.New("Unknown storage driver")
+var ErrUnknownGeofence = errors.New("Unknown geofence")
+var ErrUnknownCommand = errors.New("Unknown command")
+var ErrCommandDelivered = errors.New("Command already delivered")
+var ErrUnknownToken = errors.New("Unknown API token")
+
+// Storage abstraction. Each driver (see db.driver) provides the full set
+// of operations used by the handlers.
+type Storage interface {
+	// Return the applied and latest known schema versions.
+	SchemaVersion() (current, latest int, err error)
+	// Apply (or roll back) schema migrations to reach the target
+	// version (-1 for the latest).
+	Migrate(target int) error
+	// Register a new device to a given userID.
+	RegisterDevice(userid string, dev Device) (devId string, err error)
+	// Return known info about a device.
+	GetDeviceInfo(devId string) (devInfo *Device, err error)
+	// Return the latest known position for a device.
+	GetPositions(devId string) (positions []Position, err error)
+	// Return the positions recorded for a device between since and
+	// until (epoch seconds, 0 for unbounded), newest first.
+	// limit <= 0 returns everything.
+	GetPositionHistory(devId string, since, until int64, limit int) (positions []Position, err error)
+	// Get up to limit (<= 0 for all) of the oldest undelivered commands
+	// and mark them delivered. Commands past their expiry are marked
+	// expired and skipped.
+	GetPending(devId string, limit int) (commands []Command, err error)
+	GetUserFromDevice(deviceId string) (userId, name string, err error)
+	// Get all known devices for this user.
+	GetDevicesForUser(userId string) (devices []DeviceList, err error)
+	// Store a command into the list of pending commands for a device.
+	// The command is not delivered after expires (epoch seconds, 0 for
+	// never).
+	StoreCommand(devId, cmdType, command string, expires int64) (cmdId int64, err error)
+	// Cancel a command that has not been delivered yet.
+	CancelCommand(devId string, cmdId int64) error
+	// Move a command that is still waiting for the device (queued or
+	// pushed) to a new state (see CMD_*), noting any detail. A command
+	// that was delivered, cancelled or expired meanwhile is left alone.
+	SetCommandState(devId string, cmdId int64, state, detail string) error
+	// Move the most recently delivered command of cmdType to a new
+	// state. (Device replies don't carry the command id.)
+	AckCommand(devId, cmdType, state, detail string) error
+	// Return the command history for a device, newest first.
+	GetCommands(devId string, limit int) (commands []Command, err error)
+	// Add a failed push to the outbox to be retried.
+	QueuePush(job PushJob) (jobId int64, err error)
+	// Return up to limit outbox entries that are due a retry, pushing
+	// their next attempt back by lease seconds so that no other worker
+	// takes them meanwhile.
+	ClaimPushes(limit int, lease int64) (jobs []PushJob, err error)
+	// Record a failed attempt and when to try again.
+	RetryPush(jobId int64, attempts int, next int64, lastError string) error
+	// Remove an entry from the outbox.
+	DeletePush(jobId int64) error
+	SetAccessToken(devId, token string) error
+	// Note that the push service no longer knows the device's endpoint
+	// (it answered 404 or 410). Cleared when the device re-registers.
+	SetPushGone(devId string) error
+	// Replace the device's HAWK secret. The one it replaces keeps
+	// working for grace more seconds, unless an earlier rotation is
+	// still waiting for the device to pick up its new secret.
+	RotateSecret(devId, secret string, grace int64) error
+	// Forget the previous HAWK secret. (The device has the new one.)
+	DropPrevSecret(devId string) error
+	// Remove the device's HAWK secrets. It must register again.
+	RevokeSecret(devId string) error
+	// Shorthand function to set the lock state for a device.
+	SetDeviceLock(devId string, state bool) error
+	// Add the location information to the known set for a device.
+	SetDeviceLocation(devId string, position Position) error
+	// Remove expired postion information for a device, according to its
+	// retention settings. The latest position is always kept.
+	GcPosition(devId string) error
+	// Return the ids of every registered device.
+	GetAllDeviceIds() (devIds []string, err error)
+	// Set how long (in seconds) to keep positions for all of a user's
+	// devices, or for a single device. 0 clears the setting.
+	SetUserRetention(userId string, seconds int64) error
+	SetDeviceRetention(devId string, seconds int64) error
+	// Return the user and device retention settings (0 if unset) and the
+	// effective retention for a device.
+	GetRetention(devId string) (user, device, effective int64, err error)
+	// remove all tracking information for devId.
+	PurgePosition(devId string) error
+	// Return the geofences defined for a device.
+	GetGeofences(devId string) (fences []Geofence, err error)
+	// Create (fence.ID == "") or replace a device's geofence.
+	SetGeofence(fence Geofence) (fenceId string, err error)
+	DeleteGeofence(devId, fenceId string) error
+	// Record whether the device was last seen inside the geofence.
+	SetGeofenceState(devId, fenceId string, inside bool) error
+	// Record a geofence enter or exit.
+	AddGeofenceEvent(event GeofenceEvent) error
+	// Return the geofence events for a device since the given time
+	// (epoch seconds), newest first.
+	GetGeofenceEvents(devId string, since int64, limit int) (events []GeofenceEvent, err error)
+	Touch(devId string) error
+	DeleteDevice(devId string) error
+	// Generate a nonce for OAuth checks
+	GetNonce() (string, error)
+	// Does the user's nonce match?
+	CheckNonce(nonce string) (bool, error)
+	// Record a Hawk request nonce for the Hawk id. Returns false if the
+	// nonce was already used in the last window seconds.
+	UseHawkNonce(id, nonce string, window int64) (fresh bool, err error)
+	// Store a new API token (its hash; the token itself is never
+	// stored). Returns the token's id.
+	AddApiToken(token ApiToken) (tokenId string, err error)
+	// Find the API token with the given hash, noting that it was used.
+	UseApiToken(hash string) (token *ApiToken, err error)
+	// Return the user's API tokens.
+	GetApiTokens(userId string) (tokens []ApiToken, err error)
+	DeleteApiToken(userId, tokenId string) error
+	Close()
+}
+
+// Opener creates a new Storage for a driver.
+type Opener func(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (Storage, error)
+
+var drivers = make(map[string]Opener)
 
-// Storage abstration
-type Storage struct {
-	config   *util.MzConfig
-	logger   *util.HekaLogger
-	metrics  *util.Metrics
-	dsn      string
-	logCat   string
-	defExpry int64
-	db       *sql.DB
+// Make a storage driver available by name (see db.driver).
+func Register(name string, opener Opener) {
+	if opener == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = opener
 }
 
 // Device position
@@ -39,10 +158,16 @@ type Position struct {
 	Longitude float64
 	Altitude  float64
 	Time      int64
+	Accuracy  float64 // radius of the fix in meters (0 if unknown)
+	Speed     float64 // meters per second
+	Heading   float64 // degrees clockwise from true north
+	Battery   float64 // battery level percentage
+	Provider  string  // source of the fix (gps, network, wifi)
 	Cmd       map[string]interface{}
 }
 
-// Device information
+// Device information. The credentials are never sent to clients
+// (json:"-"); the device already has them.
 type Device struct {
 	ID                string // device Id
 	User              string // userID
@@ -50,12 +175,155 @@ type Device struct {
 	PreviousPositions []Position
 	HasPasscode       bool   // is device lockable
 	LoggedIn          bool   // is the device logged in
-	Secret            string // HAWK secret
-	PushUrl           string // SimplePush URL
+	Secret            string `json:"-"` // HAWK secret
+	PrevSecret        string `json:"-"` // HAWK secret being rotated out
+	PrevSecretExpires int64  // when PrevSecret stops working (epoch)
+	PushUrl           string `json:"-"` // push endpoint
+	PushType          string // push protocol (see PUSH_*)
+	PushKey           string // Web Push p256dh public key (base64url)
+	PushAuth          string `json:"-"` // Web Push auth secret (base64url)
+	PushGone          bool   // push service reported the endpoint gone
 	Pending           string // pending command
 	LastExchange      int32  // last time we did anything
 	Accepts           string // commands the device accepts
-	AccessToken       string // OAuth Access token
+	AccessToken       string `json:"-"` // OAuth Access token
+	Capabilities      string // optional protocol features (e.g. "batch")
+}
+
+// Push protocols a device may register with.
+const (
+	PUSH_SIMPLEPUSH = "simplepush"
+	PUSH_WEBPUSH    = "webpush"
+)
+
+// Optional protocol features a device may declare at registration.
+const (
+	// The device accepts a JSON array of commands from /cmd/
+	CAP_BATCH = "batch"
+)
+
+// Did the device declare the capability at registration?
+func (self *Device) Can(capability string) bool {
+	for _, c := range strings.Split(self.Capabilities, ",") {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// The HAWK secrets the device may sign with as of now (epoch seconds):
+// the current one, then the previous one until its grace period ends.
+// None if the device's credentials were revoked.
+func (self *Device) HawkSecrets(now int64) (secrets []string) {
+	if self.Secret != "" {
+		secrets = append(secrets, self.Secret)
+	}
+	if self.PrevSecret != "" && now < self.PrevSecretExpires {
+		secrets = append(secrets, self.PrevSecret)
+	}
+	return secrets
+}
+
+/* A command sent to a device, and what became of it.
+   queued -> pushed -> delivered -> acknowledged or failed
+   Commands that are not picked up in time become expired, and the
+   owner may cancel them before then.
+*/
+type Command struct {
+	ID       int64
+	DeviceID string
+	Type     string // command letter (l, r, t, e, ...)
+	Cmd      string // JSON sent to the device
+	State    string
+	Detail   string // error or other notes
+	Created  int64
+	Updated  int64
+	Expires  int64 // 0 for never
+}
+
+const (
+	CMD_QUEUED       = "queued"
+	CMD_PUSHED       = "pushed"
+	CMD_DELIVERED    = "delivered"
+	CMD_ACKNOWLEDGED = "acknowledged"
+	CMD_FAILED       = "failed"
+	CMD_EXPIRED      = "expired"
+	CMD_CANCELLED    = "cancelled"
+)
+
+// A device wake-up waiting in the outbox to be retried.
+type PushJob struct {
+	ID          int64
+	DeviceID    string
+	CmdID       int64 // the command the push announces
+	Attempts    int
+	NextAttempt int64 // epoch seconds
+	Deadline    int64 // give up after this (epoch seconds)
+	LastError   string
+	CmdState    string // current state of the command (read only)
+}
+
+/* A named zone for a device.
+   Circles use Latitude, Longitude and Radius (meters). Polygons use
+   Points, a list of [latitude, longitude] pairs.
+*/
+type Geofence struct {
+	ID        string
+	DeviceID  string
+	Name      string
+	Kind      string // "circle" or "polygon"
+	Latitude  float64
+	Longitude float64
+	Radius    float64
+	Points    [][2]float64
+	Inside    bool // was the device last seen inside?
+	Created   int64
+}
+
+const (
+	GEOFENCE_CIRCLE  = "circle"
+	GEOFENCE_POLYGON = "polygon"
+	GEOFENCE_ENTER   = "enter"
+	GEOFENCE_EXIT    = "exit"
+)
+
+// A device entering or leaving a geofence.
+type GeofenceEvent struct {
+	DeviceID  string
+	FenceID   string
+	Name      string
+	Event     string // "enter" or "exit"
+	Latitude  float64
+	Longitude float64
+	Time      int64
+}
+
+/* Personal API tokens.
+   A user's token for scripted access to the REST API, limited to
+   Scopes. Only Hash (of the token) is stored.
+*/
+type ApiToken struct {
+	ID       string
+	UserID   string
+	Name     string
+	Hash     string
+	Scopes   []string
+	Created  int64
+	Expires  int64 // 0 if it never expires
+	LastUsed int64
+}
+
+// Scopes are stored comma separated.
+func encodeScopes(scopes []string) string {
+	return strings.Join(scopes, ",")
+}
+
+func decodeScopes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
 }
 
 type DeviceList struct {
@@ -72,20 +340,43 @@ type Unstructured map[string]interface{}
        userId   UUID index
        deviceId UUID
 
-   table pendingCommands:
+   table commandLog:
+       id       int index
        deviceId UUID index
-       time     timeStamp
+       type     string
        cmd      string
+       state    string
+       detail   string
+       created  timeStamp
+       updated  timeStamp
+       expires  timeStamp
+
+   table pushOutbox:
+       id          int index
+       deviceId    UUID
+       cmdId       int
+       attempts    int
+       nextAttempt timeStamp index
+       deadline    timeStamp
+       lastError   string
+       created     timeStamp
 
    table deviceInfo:
        deviceId       UUID index
        name           string
        lockable       boolean
        lastExchange   time
-       hawkSecret     string
+       hawkSecret     string (sealed, see secrets.go)
+       prevSecret     string (sealed)
+       prevSecretExpires timeStamp
        pushUrl        string
        accepts        string
        accesstoken    string
+       capabilities   string
+       pushType       string
+       pushKey        string
+       pushAuth       string
+       pushGone       bool
 
    table position:
        positionId UUID index
@@ -94,11 +385,45 @@ type Unstructured map[string]interface{}
        latitude   float
        longitude  float
        altitude   float
+       accuracy   float
+       speed      float
+       heading    float
+       battery    float
+       provider   string
+
+   table geofence:
+       id         UUID index
+       deviceId   UUID index
+       name       string
+       kind       string
+       latitude   float
+       longitude  float
+       radius     float
+       points     string (JSON)
+       inside     bool
+       created    timeStamp
+
+   table geofenceEvent:
+       deviceId   UUID index
+       fenceId    UUID
+       name       string
+       event      string
+       latitude   float
+       longitude  float
+       time       timeStamp
+
+   table userRetention:
+       userId     UUID index
+       seconds    int
+
+   table deviceRetention:
+       deviceId   UUID index
+       seconds    int
 
    // misc administrivia table.
    table meta:
        key        string
-       value      string
+       val        string
 */
 /* key:
 deviceId {positions:[{lat:float, lon: float, alt: float, time:int},...],
@@ -111,497 +436,66 @@ deviceId {positions:[{lat:float, lon: float, alt: float, time:int},...],
 user [deviceId:name,...]
 */
 
-// Get a time string that makes psql happy.
-func dbNow() (ret string) {
-	r, _ := time.Now().UTC().MarshalText()
-	return string(r)
+// Open the database using the configured driver (default: postgres).
+func Open(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store Storage, err error) {
+	driver := config.Get("db.driver", "postgres")
+	opener, ok := drivers[driver]
+	if !ok {
+		logger.Error("storage", "Unknown storage driver",
+			util.Fields{"driver": driver})
+		return nil, ErrUnknownDriver
+	}
+	return opener(config, logger, metrics)
 }
 
-// Open the database.
-func Open(config *util.MzConfig, logger *util.HekaLogger, metrics *util.Metrics) (store *Storage, err error) {
-	dsn := fmt.Sprintf("user=%s password=%s host=%s dbname=%s sslmode=%s",
-		config.Get("db.user", "user"),
-		config.Get("db.password", "password"),
-		config.Get("db.host", "localhost"),
-		config.Get("db.db", "wmf"),
-		config.Get("db.sslmode", "disable"))
-	logCat := "storage"
-	// default expry is 5 days
+// default expry is 5 days
+func defaultExpry(config *util.MzConfig) int64 {
 	defExpry, err := strconv.ParseInt(config.Get("db.default_expry", "432000"), 0, 64)
 	if err != nil {
 		defExpry = 432000
 	}
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		panic("Storage is unavailable: " + err.Error() + "\n")
-		return nil, err
-	}
-	db.SetMaxIdleConns(100)
-	if err = db.Ping(); err != nil {
-		return nil, err
-	}
-	store = &Storage{
-		config:   config,
-		logger:   logger,
-		logCat:   logCat,
-		defExpry: defExpry,
-		metrics:  metrics,
-		dsn:      dsn,
-		db:       db}
-	//	if err = store.Init(); err != nil {
-	//		return nil, err
-	//	}
-	return store, nil
+	return defExpry
 }
 
-// Create the tables, indexes and other needed items.
-func (self *Storage) Init() (err error) {
-	// TODO: create a versioned db update system that contains commands
-	// to execute.
-	cmds := []string{
-		"create table if not exists userToDeviceMap (userId varchar, deviceId varchar, name varchar, date date);",
-		"create index on userToDeviceMap (userId);",
-		"create index on userToDeviceMap (deviceId);",
-		"create unique index on userToDeviceMap (userId, deviceId);",
-
-		"create table if not exists deviceInfo (deviceId varchar unique, lockable boolean, loggedin boolean, lastExchange timestamp, hawkSecret varchar, pushurl varchar, accepts varchar, accesstoken varchar);",
-		"create index on deviceInfo (deviceId);",
-
-		"create table if not exists pendingCommands (id bigserial, deviceId varchar, time timestamp, cmd varchar);",
-		"create index on pendingCommands (deviceId);",
-
-		"create table if not exists position (id bigserial, deviceId varchar, time  timestamp, latitude real, longitude real, altitude real);",
-		"create index on position (deviceId);",
-		"create or replace function update_time() returns trigger as $$ begin new.lastexchange = now(); return new; end; $$ language 'plpgsql';",
-		"drop trigger if exists update_le on deviceinfo;",
-		"create trigger update_le before update on deviceinfo for each row execute procedure update_time();",
-		"create table if not exists meta (key varchar, value varchar);",
-		"create index on meta (key);",
-		"create table if not exists nonce (key varchar, val varchar, time timestamp);",
-		"create index on nonce (key);",
-		"create index on nonce (time);",
-		"set time zone utc;",
-	}
-
-	dbh := self.db
-	for _, s := range cmds {
-		res, err := dbh.Exec(s)
-		self.logger.Debug(self.logCat, "db init",
-			util.Fields{"cmd": s, "res": fmt.Sprintf("%+v", res)})
-		if err != nil {
-			self.logger.Error(self.logCat, "Could not initialize db",
-				util.Fields{"cmd": s, "error": err.Error()})
-			return err
-		}
-	}
-
-	return nil
-}
-
-// Register a new device to a given userID.
-func (self *Storage) RegisterDevice(userid string, dev Device) (devId string, err error) {
-	// value check?
-	dbh := self.db
-	statement := "insert into deviceInfo (deviceId, lockable, loggedin, lastExchange, hawkSecret, accepts, pushUrl) values ($1, $2, $3, $4, $5, $6, $7);"
-	if dev.ID == "" {
-		dev.ID, _ = util.GenUUID4()
-	}
-	// Purge old registration records.
-	if _, err = dbh.Exec("delete from deviceInfo where deviceId = $1;", dev.ID); err != nil {
-		self.logger.Error(self.logCat,
-			"Could not purge old deviceinfo record",
-			util.Fields{"error": err.Error(),
-				"deviceId": dev.ID})
-		return "", err
-	}
-	if _, err = dbh.Exec("delete from userToDeviceMap where deviceId = $1;", dev.ID); err != nil {
-		self.logger.Error(self.logCat,
-			"Could not purge old usertodevicemap record",
-			util.Fields{"error": err.Error(),
-				"deviceId": dev.ID})
-		return "", err
-	}
-	if _, err = dbh.Exec(statement,
-		string(dev.ID),
-		dev.HasPasscode,
-		dev.LoggedIn,
-		dbNow(),
-		dev.Secret,
-		dev.Accepts,
-		dev.PushUrl); err != nil {
-		self.logger.Error(self.logCat, "Could not create device",
-			util.Fields{"error": err.Error(),
-				"device": fmt.Sprintf("%+v", dev)})
-		return "", err
-	}
-	if _, err = dbh.Exec("insert into userToDeviceMap (userId, deviceId, name, date) values ($1, $2, $3, now());", userid, dev.ID, dev.Name); err != nil {
-		switch {
-		default:
-			self.logger.Error(self.logCat,
-				"Could not map device to user",
-				util.Fields{
-					"uid":      userid,
-					"deviceId": dev.ID,
-					"name":     dev.Name,
-					"error":    err.Error()})
-			return "", err
-		}
-	}
-	return dev.ID, nil
-}
-
-// Return known info about a device.
-func (self *Storage) GetDeviceInfo(devId string) (devInfo *Device, err error) {
-
-	// collect the data for a given device for display
-
-	var deviceId, userId, pushUrl, name, secret, lestr, accesstoken []uint8
-	var lastexchange float64
-	var hasPasscode, loggedIn bool
-	var statement, accepts string
-
-	dbh := self.db
-
-	// verify that the device belongs to the user
-	statement = "select d.deviceId, u.userId, coalesce(u.name,d.deviceId), d.lockable, d.loggedin, d.pushUrl, d.accepts, d.hawksecret, extract(epoch from d.lastexchange), d.accesstoken from userToDeviceMap as u, deviceInfo as d where u.deviceId=$1 and u.deviceId=d.deviceId;"
-	stmt, err := dbh.Prepare(statement)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not query device info",
-			util.Fields{"error": err.Error()})
-		return nil, err
-	}
-	defer stmt.Close()
-	row := stmt.QueryRow(devId)
-	err = row.Scan(&deviceId, &userId, &name, &hasPasscode,
-		&loggedIn, &pushUrl, &accepts, &secret, &lestr, &accesstoken)
+// The device setting wins over the user setting, which wins over the
+// db.default_expry value.
+func effectiveRetention(user, device, def int64) int64 {
 	switch {
-	case err == sql.ErrNoRows:
-		return nil, ErrUnknownDevice
-	case err != nil:
-		self.logger.Error(self.logCat, "Could not fetch device info",
-			util.Fields{"error": err.Error(),
-				"deviceId": devId})
-		return nil, err
-	default:
-	}
-	lastexchange, _ = strconv.ParseFloat(string(lestr), 32)
-	//If we have a pushUrl, the user is logged in.
-	bloggedIn := string(pushUrl) != ""
-	reply := &Device{
-		ID:           string(deviceId),
-		User:         string(userId),
-		Name:         string(name),
-		Secret:       string(secret),
-		HasPasscode:  hasPasscode,
-		LoggedIn:     bloggedIn,
-		LastExchange: int32(lastexchange),
-		PushUrl:      string(pushUrl),
-		Accepts:      accepts,
-		AccessToken:  string(accesstoken),
-	}
-
-	return reply, nil
-}
-
-func (self *Storage) GetPositions(devId string) (positions []Position, err error) {
-
-	dbh := self.db
-
-	statement := "select extract(epoch from time)::int, latitude, longitude, altitude from position where deviceid=$1 order by time limit 1;"
-	rows, err := dbh.Query(statement, devId)
-	if err == nil {
-		var time int32
-		var latitude float32
-		var longitude float32
-		var altitude float32
-
-		for rows.Next() {
-			err = rows.Scan(&time, &latitude, &longitude, &altitude)
-			if err != nil {
-				self.logger.Error(self.logCat, "Could not get positions",
-					util.Fields{"error": err.Error(),
-						"deviceId": devId})
-				break
-			}
-			positions = append(positions, Position{
-				Latitude:  float64(latitude),
-				Longitude: float64(longitude),
-				Altitude:  float64(altitude),
-				Time:      int64(time)})
-		}
-		// gather the positions
-		rows.Close()
-	} else {
-		self.logger.Error(self.logCat, "Could not get positions",
-			util.Fields{"error": err.Error()})
-	}
-
-	return positions, nil
-
-}
-
-// Get pending commands.
-func (self *Storage) GetPending(devId string) (cmd string, err error) {
-	dbh := self.db
-	var createt = time.Time{}
-	var created int64
-
-	statement := "select id, cmd, time from pendingCommands where deviceId = $1 order by time limit 1;"
-	rows, err := dbh.Query(statement, devId)
-	if rows.Next() {
-		var id string
-		err = rows.Scan(&id, &cmd, &createt)
-		if err != nil {
-			self.logger.Error(self.logCat, "Could not read pending command",
-				util.Fields{"error": err.Error(),
-					"deviceId": devId})
-			return "", err
-		}
-		// Convert the date string to an int64
-		created = createt.Unix()
-		lifespan := time.Now().Unix() - created
-		self.metrics.Timer("cmd.pending", lifespan)
-		statement = "delete from pendingCommands where id = $1"
-		dbh.Exec(statement, id)
+	case device > 0:
+		return device
+	case user > 0:
+		return user
 	}
-	self.Touch(devId)
-	return cmd, nil
+	return def
 }
 
-func (self *Storage) GetUserFromDevice(deviceId string) (userId, name string, err error) {
-
-	dbh := self.db
-	statement := "select userId, name from userToDeviceMap where deviceId = $1 limit 1;"
-	rows, err := dbh.Query(statement, deviceId)
-	if err == nil {
-		for rows.Next() {
-			err = rows.Scan(&userId, &name)
-			if err != nil {
-				self.logger.Error(self.logCat,
-					"Could not get user for device",
-					util.Fields{"error": err.Error(),
-						"user": deviceId})
-				return "", "", err
-			}
-			return userId, name, nil
-		}
+// Polygon points are stored as JSON text.
+func encodePoints(points [][2]float64) string {
+	if len(points) == 0 {
+		return ""
 	}
-	return "", "", ErrUnknownDevice
+	js, _ := json.Marshal(points)
+	return string(js)
 }
 
-// Get all known devices for this user.
-func (self *Storage) GetDevicesForUser(userId string) (devices []DeviceList, err error) {
-	var data []DeviceList
-
-	dbh := self.db
-	statement := "select deviceId, coalesce(name,deviceId) from userToDeviceMap where userId = $1 order by date;"
-	rows, err := dbh.Query(statement, userId)
-	if err == nil {
-		for rows.Next() {
-			var id, name string
-			err = rows.Scan(&id, &name)
-			if err != nil {
-				self.logger.Error(self.logCat,
-					"Could not get list of devices for user",
-					util.Fields{"error": err.Error(),
-						"user": userId})
-				return nil, err
-			}
-			data = append(data, DeviceList{ID: id, Name: name})
-		}
+func decodePoints(js string) (points [][2]float64) {
+	if js == "" {
+		return nil
 	}
-	return data, err
-}
-
-// Store a command into the list of pending commands for a device.
-func (self *Storage) StoreCommand(devId, command string) (err error) {
-	//update device table to store command where devId = $1
-	statement := "insert into pendingCommands (deviceId, time, cmd) values ($1, $2,  $3);"
-	dbh := self.db
-
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not open db",
-			util.Fields{"error": err.Error()})
-		return err
-	}
-	self.logger.Debug(self.logCat, "Storing Command",
-		util.Fields{"deviceId": devId, "command": command})
-
-	if _, err = dbh.Exec(statement, devId, dbNow(), command); err != nil {
-		self.logger.Error(self.logCat, "Could not store pending command",
-			util.Fields{"error": err.Error()})
-		return err
-	}
-	return nil
-}
-
-func (self *Storage) SetAccessToken(devId, token string) (err error) {
-	dbh := self.db
-
-	statement := "update deviceInfo set accesstoken = $1, lastexchange = now() where deviceId = $2"
-	_, err = dbh.Exec(statement, token, devId)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not set the access token",
-			util.Fields{"error": err.Error(),
-				"device": devId,
-				"token":  token})
-		return err
-	}
-	return nil
-}
-
-// Shorthand function to set the lock state for a device.
-func (self *Storage) SetDeviceLock(devId string, state bool) (err error) {
-	dbh := self.db
-
-	statement := "update deviceInfo set lockable = $1, lastexchange = now()  where deviceId =$2"
-	_, err = dbh.Exec(statement, state, devId)
-	if err != nil {
-		self.logger.Error(self.logCat, "Could not set device lock state",
-			util.Fields{"error": err.Error(),
-				"device": devId,
-				"state":  fmt.Sprintf("%b", state)})
-		return err
-	}
-	return nil
-}
-
-// Add the location information to the known set for a device.
-func (self *Storage) SetDeviceLocation(devId string, position Position) (err error) {
-	dbh := self.db
-
-	// Only keep the latest positon (changed requirements from original design)
-	self.PurgePosition(devId)
-
-	statement := "insert into position (deviceId, time, latitude, longitude, altitude) values ($1, $2, $3, $4, $5);"
-	st, err := dbh.Prepare(statement)
-	_, err = st.Exec(
-		devId,
-		dbNow(),
-		float32(position.Latitude),
-		float32(position.Longitude),
-		float32(position.Altitude))
-	st.Close()
-	if err != nil {
-		self.logger.Error(self.logCat, "Error inserting postion",
-			util.Fields{"error": err.Error()})
-		return err
-	}
-	return nil
-}
-
-// Remove old postion information for devices.
-// This previously removed "expired" location records. We currently only
-// retain the latest record for a user.
-func (self *Storage) GcPosition(devId string) (err error) {
-	dbh := self.db
-
-	// because prepare doesn't like single quoted vars
-	// because calling dbh.Exec() causes a lock race condition.
-	// because I didn't have enough reasons to drink.
-	// Delete old records (except the latest one) so we always have
-	// at least one position record.
-	// Added bonus: The following string causes the var replacer to
-	// get confused and toss an error, so yes, currently this uses inline
-	// replacement.
-	//	statement := fmt.Sprintf("delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where time < (now() - interval '%d seconds') ) tt where RowNumber > 1);", self.defExpry)
-	statement := fmt.Sprintf("delete from position where time < (now() - interval '%d seconds');", self.defExpry)
-	st, err := dbh.Prepare(statement)
-	_, err = st.Exec()
-	st.Close()
-	if err != nil {
-		self.logger.Error(self.logCat, "Error gc'ing positions",
-			util.Fields{"error": err.Error()})
-		return err
-	}
-	return nil
-}
-
-// remove all tracking information for devId.
-func (self *Storage) PurgePosition(devId string) (err error) {
-	dbh := self.db
-
-	statement := "delete from position where deviceid = $1;"
-	if _, err = dbh.Exec(statement, devId); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (self *Storage) Touch(devId string) (err error) {
-	dbh := self.db
-
-	statement := "update deviceInfo set lastexchange = now() where deviceid = $1"
-	_, err = dbh.Exec(statement, devId)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (self *Storage) DeleteDevice(devId string) (err error) {
-	dbh := self.db
-
-	var tables = []string{"pendingcommands", "position", "usertodevice",
-		"deviceinfo"}
-
-	for t := range tables {
-		// BURN THE WITCH!
-		table := tables[t]
-		_, err = dbh.Exec("delete from $1 where deviceid=$2;", table, devId)
-		if err != nil {
-			self.logger.Error(self.logCat,
-				"Could not nuke data from table",
-				util.Fields{"error": err.Error(),
-					"device": devId,
-					"table":  table})
-			return err
-		}
-	}
-	return nil
-}
-
-func (self *Storage) getMeta(key string) (val string, err error) {
-	var row *sql.Row
-	dbh := self.db
-
-	statement := "select val from meta where key=$1;"
-	if row = dbh.QueryRow(statement, key); row != nil {
-		row.Scan(&val)
-		return val, err
-	}
-	return "", err
-}
-
-func (self *Storage) setMeta(key, val string) (err error) {
-	var statement string
-	dbh := self.db
-
-	// try to update or insert.
-	statement = "update meta set val = $2 where key = $1;"
-	if res, err := dbh.Exec(statement, key, val); err != nil {
-		return err
-	} else {
-		if cnt, _ := res.RowsAffected(); cnt == 0 {
-			statement = "insert into met (key, val) values ($1, $2);"
-			if _, err = dbh.Exec(statement, key, val); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-func (self *Storage) Close() {
-	self.db.Close()
+	json.Unmarshal([]byte(js), &points)
+	return points
 }
 
 /* Nonce handler.
    Anything that can be killed, can be overkilled.
 */
 
-func (self *Storage) genSig(key, val string) string {
+// Hawk nonces share the nonce table, under their own prefix.
+func hawkNonceKey(id, nonce string) string {
+	return "hawk:" + id + ":" + nonce
+}
+
+func genSig(key, val string) string {
 	// Yes, this is using woefully insecure MD5. That's ok.
 	// Collisions should be rare enough and this is more
 	// paranoid security than is really required.
@@ -609,61 +503,3 @@ func (self *Storage) genSig(key, val string) string {
 	io.WriteString(sig, key+"."+val)
 	return hex.EncodeToString(sig.Sum(nil))
 }
-
-// Generate a nonce for OAuth checks
-func (self *Storage) GetNonce() (string, error) {
-	var statement string
-	dbh := self.db
-
-	key, _ := util.GenUUID4()
-	val, _ := util.GenUUID4()
-	statement = "insert into nonce (key, val, time) values ($1, $2, current_timestamp);"
-
-	if _, err := dbh.Exec(statement, key, val); err != nil {
-		return "", err
-	}
-	ret := key + "." + self.genSig(key, val)
-	return ret, nil
-}
-
-// Does the user's nonce match?
-func (self *Storage) CheckNonce(nonce string) (bool, error) {
-	var statement string
-	dbh := self.db
-
-	// gc nonces before checking.
-	statement = "delete from nonce where time < current_timestamp - interval '5 minutes';"
-	dbh.Exec(statement)
-
-	keysig := strings.SplitN(nonce, ".", 2)
-	if len(keysig) != 2 {
-		self.logger.Warn(self.logCat,
-			"Invalid nonce",
-			util.Fields{"nonce": nonce})
-		return false, nil
-	}
-	statement = "select val from nonce where key = $1 limit 1;"
-	rows, err := dbh.Query(statement, keysig[0])
-	if err == nil {
-		for rows.Next() {
-			var val string
-			err = rows.Scan(&val)
-			if err == nil {
-				dbh.Exec("delete from nonce where key = $1;", keysig[0])
-				sig := self.genSig(keysig[0], val)
-				return sig == keysig[1], nil
-			}
-			self.logger.Error(self.logCat,
-				"Nonce check error",
-				util.Fields{"error": err.Error()})
-			return false, err
-		}
-		// Not found
-		return false, nil
-	}
-	// An error happened.
-	self.logger.Error(self.logCat,
-		"Nonce check error",
-		util.Fields{"error": err.Error()})
-	return false, err
-}
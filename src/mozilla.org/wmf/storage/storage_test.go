@@ -0,0 +1,626 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"mozilla.org/util"
+
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Driver conformance.
+   Every driver must behave the same way through the Storage interface,
+   so the same checks run against each of them. (Postgres needs a
+   server, so it isn't covered here.)
+*/
+
+const testSecretKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func testConfig(t *testing.T, settings string) (*util.MzConfig, *util.HekaLogger, *util.Metrics) {
+	file, err := ioutil.TempFile("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("logger.filter=0\n" + settings)
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := util.NewHekaLogger(config)
+	return config, logger, util.NewMetrics("test", logger, config)
+}
+
+// A fresh SQLite database at the latest schema, and its directory.
+func openTestSqlite(t *testing.T) (*SqliteStore, string) {
+	dir, err := ioutil.TempDir("", "fmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSqlite(testConfig(t,
+		"db.path="+filepath.Join(dir, "fmd.db")+"\n"+
+			"db.secret_key="+testSecretKey+"\n"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err = store.Migrate(-1); err != nil {
+		store.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store.(*SqliteStore), dir
+}
+
+func TestMemoryDriver(t *testing.T) {
+	testDriver(t, newMemStore(testConfig(t, "")))
+}
+
+func TestSqliteDriver(t *testing.T) {
+	store, dir := openTestSqlite(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	testDriver(t, store)
+
+	// Secrets are sealed at rest.
+	var stored string
+	devId, _ := store.RegisterDevice("user", Device{Secret: "secret"})
+	store.RotateSecret(devId, "secret2", 60)
+	store.db.QueryRow("select hawkSecret || prevSecret from deviceInfo where deviceId = ?;",
+		devId).Scan(&stored)
+	if strings.Contains(stored, "secret") ||
+		!strings.HasPrefix(stored, sealedPrefix) {
+		t.Errorf("secret stored in the clear: %q", stored)
+	}
+}
+
+// Secrets written before db.secret_key was set are sealed on open, and
+// nothing opens without the key.
+func TestSqliteSealsPlainSecrets(t *testing.T) {
+	store, dir := openTestSqlite(t)
+	defer os.RemoveAll(dir)
+	store.db.Exec("insert into deviceInfo (deviceId, hawkSecret, prevSecret) values ('plain', 'secret', 'old');")
+	store.db.Exec("insert into userToDeviceMap (userId, deviceId) values ('user', 'plain');")
+	store.Close()
+
+	path := "db.path=" + filepath.Join(dir, "fmd.db") + "\n"
+	if _, err := OpenSqlite(testConfig(t, path)); err != ErrSecretKey {
+		t.Errorf("opened without a key: %v", err)
+	}
+	reopened, err := OpenSqlite(testConfig(t,
+		path+"db.secret_key="+testSecretKey+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	var secret, prevSecret string
+	reopened.(*SqliteStore).db.QueryRow("select hawkSecret, prevSecret from deviceInfo where deviceId = 'plain';").Scan(&secret, &prevSecret)
+	if !strings.HasPrefix(secret, sealedPrefix) ||
+		!strings.HasPrefix(prevSecret, sealedPrefix) {
+		t.Errorf("not sealed: %q, %q", secret, prevSecret)
+	}
+	dev, err := reopened.GetDeviceInfo("plain")
+	if err != nil || dev.Secret != "secret" || dev.PrevSecret != "old" {
+		t.Errorf("sealed secrets read back as %+v, %v", dev, err)
+	}
+}
+
+func TestSqliteMigrations(t *testing.T) {
+	store, dir := openTestSqlite(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	current, latest, _ := store.SchemaVersion()
+	if current != latest || latest != len(sqliteMigrations) {
+		t.Fatalf("after migrating: at %d of %d", current, latest)
+	}
+	// All the way down and back up again.
+	if err := store.Migrate(0); err != nil {
+		t.Fatalf("down: %s", err)
+	}
+	if current, _, _ = store.SchemaVersion(); current != 0 {
+		t.Errorf("down: at %d", current)
+	}
+	if err := store.Migrate(-1); err != nil {
+		t.Fatalf("up again: %s", err)
+	}
+	if current, _, _ = store.SchemaVersion(); current != latest {
+		t.Errorf("up again: at %d", current)
+	}
+	if err := store.Migrate(latest + 1); err != ErrBadMigration {
+		t.Errorf("past latest: got %v", err)
+	}
+	testDriver(t, store)
+}
+
+// Rolling a migration back only undoes what it added, so the schema
+// left behind still works for the version below it. (This also covers
+// Postgres, whose migrations can't be run here.)
+func TestMigrationsUndoOnlyTheirOwn(t *testing.T) {
+	dropped := regexp.MustCompile(`(?i)drop (table|index|column|trigger|function)( if exists)? (\w+)`)
+	adds := func(statements []string, kind, name string) bool {
+		added := `(create|add)( or replace)?( unique)? ` + kind +
+			`( if not exists)? ` + name + `\b`
+		if kind == "column" {
+			// or as part of a new table
+			added += `|create table[^;]*[(,] *` + name + ` `
+		}
+		return regexp.MustCompile("(?i)" + added).MatchString(
+			strings.Join(statements, "\n"))
+	}
+	for driver, migrations := range map[string][]Migration{
+		"postgres": pgMigrations,
+		"sqlite":   sqliteMigrations,
+	} {
+		for i, m := range migrations {
+			for _, s := range m.Down {
+				for _, drop := range dropped.FindAllStringSubmatch(s, -1) {
+					kind, name := drop[1], drop[3]
+					if !adds(m.Up, kind, name) {
+						t.Errorf("%s %d: %q drops %s %s, which it did not add",
+							driver, m.Version, s, kind, name)
+					}
+					for _, earlier := range migrations[:i] {
+						if adds(earlier.Up, kind, name) && !adds(m.Down, kind, name) {
+							t.Errorf("%s %d: %q drops %s %s, which version %d added",
+								driver, m.Version, s, kind, name, earlier.Version)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Out of order lists are refused rather than misapplied.
+func TestMigrationOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbh, err := sql.Open("sqlite3", filepath.Join(dir, "order.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbh.Close()
+	dbh.Exec("create table meta (key varchar, val varchar);")
+	_, logger, _ := testConfig(t, "")
+	table := func(version int, name string) Migration {
+		return Migration{Version: version, Name: name,
+			Up:   []string{"create table " + name + " (x integer);"},
+			Down: []string{"drop table " + name + ";"}}
+	}
+	misplaced := []Migration{table(1, "a"), table(3, "c"), table(2, "b")}
+	if err = migrate(dbh, misplaced, 0, -1, logger, "test"); err != ErrMigrationOrder {
+		t.Errorf("up: got %v", err)
+	}
+	// Version 1 went in, and nothing after it.
+	if version := schemaVersion(dbh, "select val from meta where key = ?;"); version != 1 {
+		t.Errorf("up: stopped at %d", version)
+	}
+	if _, err = dbh.Exec("insert into c values (1);"); err == nil {
+		t.Error("up: misplaced migration was applied")
+	}
+	ordered := []Migration{table(1, "a"), table(2, "b"), table(3, "c")}
+	if err = migrate(dbh, ordered, 1, -1, logger, "test"); err != nil {
+		t.Fatalf("in order: %s", err)
+	}
+	if err = migrate(dbh, misplaced, 3, 0, logger, "test"); err != ErrMigrationOrder {
+		t.Errorf("down: got %v", err)
+	}
+}
+
+func testDriver(t *testing.T, store Storage) {
+	userId, _ := util.GenUUID4()
+	devId, err := store.RegisterDevice(userId, Device{
+		Name:         "phone",
+		Secret:       "secret1",
+		Accepts:      "lrte",
+		Capabilities: "batch",
+		PushUrl:      "https://push.example.com/1",
+		PushType:     PUSH_WEBPUSH,
+		PushKey:      "key",
+		PushAuth:     "auth"})
+	if err != nil {
+		t.Fatalf("RegisterDevice: %s", err)
+	}
+	t.Run("devices", func(t *testing.T) { testDevices(t, store, userId, devId) })
+	t.Run("commands", func(t *testing.T) { testCommands(t, store, devId) })
+	t.Run("expiry", func(t *testing.T) { testCommandExpiry(t, store, devId) })
+	t.Run("outbox", func(t *testing.T) { testOutbox(t, store, devId) })
+	t.Run("secrets", func(t *testing.T) { testSecrets(t, store, devId) })
+	t.Run("positions", func(t *testing.T) { testPositions(t, store, devId) })
+	t.Run("geofences", func(t *testing.T) { testGeofences(t, store, devId) })
+	t.Run("nonces", func(t *testing.T) { testNonces(t, store) })
+	t.Run("tokens", func(t *testing.T) { testApiTokens(t, store, userId) })
+
+	if err = store.DeleteDevice(devId); err != nil {
+		t.Errorf("DeleteDevice: %s", err)
+	}
+	if _, err = store.GetDeviceInfo(devId); err != ErrUnknownDevice {
+		t.Errorf("deleted device: got %v", err)
+	}
+}
+
+func testDevices(t *testing.T, store Storage, userId, devId string) {
+	dev, err := store.GetDeviceInfo(devId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.ID != devId || dev.User != userId || dev.Name != "phone" ||
+		dev.Secret != "secret1" || dev.Accepts != "lrte" ||
+		dev.PushUrl != "https://push.example.com/1" || !dev.Can("batch") ||
+		dev.PushType != PUSH_WEBPUSH || dev.PushKey != "key" ||
+		dev.PushAuth != "auth" || dev.PushGone {
+		t.Errorf("GetDeviceInfo: %+v", dev)
+	}
+	if owner, name, err := store.GetUserFromDevice(devId); err != nil ||
+		owner != userId || name != "phone" {
+		t.Errorf("GetUserFromDevice: %s, %s, %v", owner, name, err)
+	}
+	devices, err := store.GetDevicesForUser(userId)
+	if err != nil || len(devices) != 1 || devices[0].ID != devId {
+		t.Errorf("GetDevicesForUser: %+v, %v", devices, err)
+	}
+	if _, err = store.GetDeviceInfo("unknown"); err != ErrUnknownDevice {
+		t.Errorf("unknown device: got %v", err)
+	}
+	store.SetAccessToken(devId, "token")
+	store.SetPushGone(devId)
+	store.SetDeviceLock(devId, true)
+	if dev, _ = store.GetDeviceInfo(devId); dev.AccessToken != "token" ||
+		!dev.PushGone || !dev.HasPasscode {
+		t.Errorf("device updates: %+v", dev)
+	}
+}
+
+func commandStates(t *testing.T, store Storage, devId string) map[int64]string {
+	commands, err := store.GetCommands(devId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[int64]string)
+	for _, c := range commands {
+		states[c.ID] = c.State
+	}
+	return states
+}
+
+func testCommands(t *testing.T, store Storage, devId string) {
+	first, err := store.StoreCommand(devId, "l", `{"l":{}}`, 0)
+	if err != nil || first == 0 {
+		t.Fatalf("StoreCommand: %d, %v", first, err)
+	}
+	second, _ := store.StoreCommand(devId, "r", `{"r":{}}`, 0)
+	if states := commandStates(t, store, devId); states[first] != CMD_QUEUED ||
+		states[second] != CMD_QUEUED {
+		t.Errorf("stored: %v", states)
+	}
+
+	// Batches come oldest first, and each command only once.
+	pending, err := store.GetPending(devId, 1)
+	if err != nil || len(pending) != 1 || pending[0].ID != first ||
+		pending[0].Cmd != `{"l":{}}` {
+		t.Errorf("first batch: %+v, %v", pending, err)
+	}
+	pending, err = store.GetPending(devId, 0)
+	if err != nil || len(pending) != 1 || pending[0].ID != second {
+		t.Errorf("second batch: %+v, %v", pending, err)
+	}
+	if pending, _ = store.GetPending(devId, 0); len(pending) != 0 {
+		t.Errorf("delivered twice: %+v", pending)
+	}
+	if states := commandStates(t, store, devId); states[first] != CMD_DELIVERED {
+		t.Errorf("after delivery: %v", states)
+	}
+
+	// The device can check in before the push that woke it returns.
+	// The command stays delivered, rather than going out again.
+	store.SetCommandState(devId, first, CMD_PUSHED, "")
+	if pending, _ = store.GetPending(devId, 0); len(pending) != 0 {
+		t.Errorf("delivered again after push: %+v", pending)
+	}
+
+	store.AckCommand(devId, "r", CMD_ACKNOWLEDGED, "")
+	store.SetCommandState(devId, second, CMD_QUEUED, "push failed")
+	failed, _ := store.StoreCommand(devId, "e", `{"e":{}}`, 0)
+	store.SetCommandState(devId, failed, CMD_FAILED, "no")
+	commands, err := store.GetCommands(devId, 0)
+	if err != nil || len(commands) != 3 {
+		t.Fatalf("GetCommands: %+v, %v", commands, err)
+	}
+	// Newest first.
+	if c := commands[0]; c.ID != failed || c.State != CMD_FAILED ||
+		c.Detail != "no" {
+		t.Errorf("failed: %+v", c)
+	}
+	if c := commands[1]; c.ID != second || c.Type != "r" ||
+		c.State != CMD_ACKNOWLEDGED {
+		t.Errorf("acknowledged: %+v", c)
+	}
+	if c := commands[2]; c.ID != first || c.Cmd != `{"l":{}}` ||
+		c.State != CMD_DELIVERED {
+		t.Errorf("delivered: %+v", c)
+	}
+	if commands, _ = store.GetCommands(devId, 1); len(commands) != 1 {
+		t.Errorf("GetCommands limit: %+v", commands)
+	}
+}
+
+func testCommandExpiry(t *testing.T, store Storage, devId string) {
+	now := time.Now().Unix()
+	expired, _ := store.StoreCommand(devId, "r", `{"r":{}}`, now-10)
+	cancelled, _ := store.StoreCommand(devId, "t", `{"t":{}}`, now+600)
+	kept, _ := store.StoreCommand(devId, "l", `{"l":{}}`, now+600)
+	if err := store.CancelCommand(devId, cancelled); err != nil {
+		t.Errorf("CancelCommand: %s", err)
+	}
+
+	// Expired and cancelled commands are skipped, even if a push for
+	// them finishes late.
+	store.SetCommandState(devId, cancelled, CMD_PUSHED, "")
+	if pending, err := store.GetPending(devId, 0); err != nil ||
+		len(pending) != 1 || pending[0].ID != kept {
+		t.Errorf("GetPending: %+v, %v, want %d", pending, err, kept)
+	}
+	store.SetCommandState(devId, expired, CMD_QUEUED, "push failed")
+	for id, want := range map[int64]string{
+		expired:   CMD_EXPIRED,
+		cancelled: CMD_CANCELLED,
+		kept:      CMD_DELIVERED,
+	} {
+		if got := commandStates(t, store, devId)[id]; got != want {
+			t.Errorf("command %d: %s, want %s", id, got, want)
+		}
+	}
+	if err := store.CancelCommand(devId, kept); err != ErrCommandDelivered {
+		t.Errorf("cancel delivered: got %v", err)
+	}
+	if err := store.CancelCommand(devId, 99999); err != ErrUnknownCommand {
+		t.Errorf("cancel unknown: got %v", err)
+	}
+	if err := store.CancelCommand("other", expired); err != ErrUnknownCommand {
+		t.Errorf("cancel another device's command: got %v", err)
+	}
+}
+
+func testOutbox(t *testing.T, store Storage, devId string) {
+	now := time.Now().Unix()
+	cmdId, _ := store.StoreCommand(devId, "r", `{"r":{}}`, 0)
+	jobId, err := store.QueuePush(PushJob{DeviceID: devId, CmdID: cmdId,
+		Attempts: 1, NextAttempt: now - 1, Deadline: now + 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Future jobs aren't due yet.
+	store.QueuePush(PushJob{DeviceID: devId, CmdID: cmdId,
+		NextAttempt: now + 600, Deadline: now + 600})
+
+	jobs, err := store.ClaimPushes(10, 60)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != jobId ||
+		jobs[0].CmdState != CMD_QUEUED || jobs[0].Attempts != 1 ||
+		jobs[0].Deadline != now+600 {
+		t.Fatalf("ClaimPushes: %+v, %v", jobs, err)
+	}
+	// Leased, so nobody else gets it.
+	if jobs, _ = store.ClaimPushes(10, 60); len(jobs) != 0 {
+		t.Errorf("claimed twice: %+v", jobs)
+	}
+	store.RetryPush(jobId, 2, now-1, "timeout")
+	if jobs, _ = store.ClaimPushes(10, 60); len(jobs) != 1 ||
+		jobs[0].Attempts != 2 || jobs[0].LastError != "timeout" {
+		t.Errorf("after retry: %+v", jobs)
+	}
+	store.DeletePush(jobId)
+	store.RetryPush(jobId, 3, now-1, "")
+	if jobs, _ = store.ClaimPushes(10, 60); len(jobs) != 0 {
+		t.Errorf("after delete: %+v", jobs)
+	}
+}
+
+func testSecrets(t *testing.T, store Storage, devId string) {
+	now := time.Now().Unix()
+	if err := store.RotateSecret(devId, "secret2", 60); err != nil {
+		t.Fatal(err)
+	}
+	dev, _ := store.GetDeviceInfo(devId)
+	if dev.Secret != "secret2" || dev.PrevSecret != "secret1" ||
+		dev.PrevSecretExpires < now+50 ||
+		strings.Join(dev.HawkSecrets(now), ",") != "secret2,secret1" {
+		t.Errorf("rotated: %+v", dev)
+	}
+	// The device never picked up secret2, so it still has secret1.
+	store.RotateSecret(devId, "secret3", 60)
+	if dev, _ = store.GetDeviceInfo(devId); dev.Secret != "secret3" ||
+		dev.PrevSecret != "secret1" {
+		t.Errorf("rotated again: %+v", dev)
+	}
+	store.DropPrevSecret(devId)
+	if dev, _ = store.GetDeviceInfo(devId); dev.PrevSecret != "" ||
+		len(dev.HawkSecrets(now)) != 1 {
+		t.Errorf("dropped previous: %+v", dev)
+	}
+	if err := store.RotateSecret("unknown", "x", 60); err != ErrUnknownDevice {
+		t.Errorf("rotate unknown: got %v", err)
+	}
+	store.RevokeSecret(devId)
+	if dev, _ = store.GetDeviceInfo(devId); len(dev.HawkSecrets(now)) != 0 {
+		t.Errorf("revoked: %+v", dev)
+	}
+}
+
+func testPositions(t *testing.T, store Storage, devId string) {
+	for i := 1; i <= 3; i++ {
+		if err := store.SetDeviceLocation(devId, Position{
+			Latitude:  float64(i),
+			Longitude: 2,
+			Accuracy:  10,
+			Speed:     1.5,
+			Heading:   90,
+			Battery:   50,
+			Provider:  "gps"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	positions, err := store.GetPositions(devId)
+	if err != nil || len(positions) != 1 || positions[0].Latitude != 3 ||
+		positions[0].Longitude != 2 {
+		t.Errorf("GetPositions: %+v, %v", positions, err)
+	}
+	history, err := store.GetPositionHistory(devId, 0, 0, 2)
+	if err != nil || len(history) != 2 || history[0].Latitude != 3 ||
+		history[0].Accuracy != 10 || history[0].Speed != 1.5 ||
+		history[0].Heading != 90 || history[0].Battery != 50 ||
+		history[0].Provider != "gps" {
+		t.Errorf("GetPositionHistory: %+v, %v", history, err)
+	}
+	if history, _ = store.GetPositionHistory(devId, 0, 0, 0); len(history) != 3 {
+		t.Errorf("all history: %d positions", len(history))
+	}
+	future := time.Now().Unix() + 3600
+	if history, _ = store.GetPositionHistory(devId, future, 0, 0); len(history) != 0 {
+		t.Errorf("history since the future: %+v", history)
+	}
+	devIds, err := store.GetAllDeviceIds()
+	if err != nil || len(devIds) == 0 {
+		t.Errorf("GetAllDeviceIds: %v, %v", devIds, err)
+	}
+
+	store.SetUserRetention(userOf(t, store, devId), 7200)
+	store.SetDeviceRetention(devId, 3600)
+	if user, device, effective, err := store.GetRetention(devId); err != nil ||
+		user != 7200 || device != 3600 || effective != 3600 {
+		t.Errorf("GetRetention: %d, %d, %d, %v", user, device, effective, err)
+	}
+	store.SetDeviceRetention(devId, 0)
+	if _, _, effective, _ := store.GetRetention(devId); effective != 7200 {
+		t.Errorf("user retention: %d", effective)
+	}
+	// Nothing has expired, and the latest is always kept.
+	store.GcPosition(devId)
+	if history, _ = store.GetPositionHistory(devId, 0, 0, 0); len(history) != 3 {
+		t.Errorf("after gc: %d positions", len(history))
+	}
+	store.PurgePosition(devId)
+	if history, _ = store.GetPositionHistory(devId, 0, 0, 0); len(history) != 0 {
+		t.Errorf("after purge: %+v", history)
+	}
+}
+
+func userOf(t *testing.T, store Storage, devId string) string {
+	userId, _, err := store.GetUserFromDevice(devId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userId
+}
+
+func testGeofences(t *testing.T, store Storage, devId string) {
+	fenceId, err := store.SetGeofence(Geofence{DeviceID: devId,
+		Name: "home", Kind: GEOFENCE_CIRCLE,
+		Latitude: 1, Longitude: 2, Radius: 100})
+	if err != nil || fenceId == "" {
+		t.Fatalf("SetGeofence: %q, %v", fenceId, err)
+	}
+	store.SetGeofence(Geofence{DeviceID: devId, Name: "park",
+		Kind:   GEOFENCE_POLYGON,
+		Points: [][2]float64{{0, 0}, {0, 1}, {1, 1}}})
+	store.SetGeofenceState(devId, fenceId, true)
+	fences, err := store.GetGeofences(devId)
+	if err != nil || len(fences) != 2 {
+		t.Fatalf("GetGeofences: %+v, %v", fences, err)
+	}
+	for _, fence := range fences {
+		switch fence.Name {
+		case "home":
+			if fence.ID != fenceId || fence.Radius != 100 || !fence.Inside {
+				t.Errorf("circle: %+v", fence)
+			}
+		case "park":
+			if len(fence.Points) != 3 || fence.Points[2] != [2]float64{1, 1} ||
+				fence.Inside {
+				t.Errorf("polygon: %+v", fence)
+			}
+		}
+	}
+	store.AddGeofenceEvent(GeofenceEvent{DeviceID: devId, FenceID: fenceId,
+		Name: "home", Event: GEOFENCE_ENTER, Time: time.Now().Unix()})
+	events, err := store.GetGeofenceEvents(devId, 0, 10)
+	if err != nil || len(events) != 1 || events[0].Event != GEOFENCE_ENTER {
+		t.Errorf("GetGeofenceEvents: %+v, %v", events, err)
+	}
+	if err = store.DeleteGeofence(devId, fenceId); err != nil {
+		t.Errorf("DeleteGeofence: %s", err)
+	}
+	if err = store.DeleteGeofence(devId, fenceId); err != ErrUnknownGeofence {
+		t.Errorf("delete unknown geofence: got %v", err)
+	}
+}
+
+func testNonces(t *testing.T, store Storage) {
+	if fresh, err := store.UseHawkNonce("id", "n1", 60); !fresh || err != nil {
+		t.Errorf("new hawk nonce: %v, %v", fresh, err)
+	}
+	if fresh, _ := store.UseHawkNonce("id", "n1", 60); fresh {
+		t.Error("hawk nonce replayed")
+	}
+	if fresh, _ := store.UseHawkNonce("other", "n1", 60); !fresh {
+		t.Error("hawk nonces are per id")
+	}
+	nonce, err := store.GetNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.CheckNonce(nonce); !ok {
+		t.Error("nonce not accepted")
+	}
+	if ok, _ := store.CheckNonce(nonce); ok {
+		t.Error("nonce accepted twice")
+	}
+	if ok, _ := store.CheckNonce("bogus"); ok {
+		t.Error("bogus nonce accepted")
+	}
+}
+
+func testApiTokens(t *testing.T, store Storage, userId string) {
+	hash, _ := util.GenUUID4()
+	tokenId, err := store.AddApiToken(ApiToken{UserID: userId,
+		Name: "cron", Hash: hash,
+		Scopes: []string{"read-location", "send-ring"}})
+	if err != nil || tokenId == "" {
+		t.Fatalf("AddApiToken: %q, %v", tokenId, err)
+	}
+	token, err := store.UseApiToken(hash)
+	if err != nil || token.ID != tokenId || token.UserID != userId ||
+		strings.Join(token.Scopes, ",") != "read-location,send-ring" {
+		t.Errorf("UseApiToken: %+v, %v", token, err)
+	}
+	if _, err = store.UseApiToken("unknown"); err != ErrUnknownToken {
+		t.Errorf("unknown token: got %v", err)
+	}
+	tokens, err := store.GetApiTokens(userId)
+	if err != nil || len(tokens) != 1 || tokens[0].LastUsed == 0 ||
+		tokens[0].Name != "cron" {
+		t.Errorf("GetApiTokens: %+v, %v", tokens, err)
+	}
+	if err = store.DeleteApiToken("someone else", tokenId); err != ErrUnknownToken {
+		t.Errorf("delete someone else's token: got %v", err)
+	}
+	if err = store.DeleteApiToken(userId, tokenId); err != nil {
+		t.Errorf("DeleteApiToken: %s", err)
+	}
+	if _, err = store.UseApiToken(hash); err != ErrUnknownToken {
+		t.Errorf("deleted token: got %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrTokenScope = errors.New("API token does not allow this")
+
+/* Personal API tokens.
+   Signed in users can mint tokens for scripts and integrations, which
+   send them as "Authorization: Bearer <token>" to the web UI calls
+   instead of a session cookie. Each token carries the scopes it allows:
+
+       read-location  GET /1/devices/, /1/state/, /1/data/, /1/history/,
+                      /1/export/ and /1/commands/
+       send-ring      POST /1/queue/ with a ring ("r") command
+       send-lock      ... a lock ("l") command
+       send-track     ... a track ("t") command
+       send-erase     ... an erase ("e") command
+
+   /1/devices/ lists the devices without their socket URLs, which need
+   a session, as does anything else (including managing tokens). Only
+   a hash of each token is stored; the token itself is returned once,
+   when it is minted.
+
+   GET    /1/tokens/        list the user's tokens
+   POST   /1/tokens/        {"name":..., "scopes":[...], "ttl":secs}
+                            returns {"id":..., "token":..., ...}
+   DELETE /1/tokens/<id>    revoke a token
+*/
+
+const API_TOKEN_PREFIX = "fmd_"
+
+// Known scopes, and what they allow.
+var apiScopes = map[string]string{
+	"read-location": "See devices, their state and location history",
+	"send-ring":     "Make devices ring",
+	"send-lock":     "Lock devices",
+	"send-track":    "Start tracking devices",
+	"send-erase":    "Erase devices",
+}
+
+// The scopes each queued command needs.
+var commandScopes = map[string]string{
+	"r": "send-ring",
+	"l": "send-lock",
+	"t": "send-track",
+	"e": "send-erase",
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The request's Bearer token, if it has one.
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// The scopes an API token needs to make the request (nil if no token
+// may make it).
+func requestScopes(req *http.Request) (scopes []string) {
+	elements := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(elements) < 2 {
+		return nil
+	}
+	switch elements[1] {
+	case "devices", "state", "data", "history", "export", "commands":
+		if req.Method == "GET" {
+			return []string{"read-location"}
+		}
+	case "queue":
+		if req.Method != "POST" || req.Body == nil {
+			return nil
+		}
+		// Peek at the commands, leaving the body for RestQueue.
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		cmds := make(map[string]interface{})
+		if err != nil || json.Unmarshal(body, &cmds) != nil ||
+			len(cmds) == 0 {
+			return nil
+		}
+		for cmd := range cmds {
+			if cmd == "" {
+				return nil
+			}
+			scope, ok := commandScopes[strings.ToLower(cmd[:1])]
+			if !ok {
+				return nil
+			}
+			scopes = append(scopes, scope)
+		}
+		return scopes
+	}
+	return nil
+}
+
+// Get the user for a request with an API token, if the token allows
+// the request.
+func (self *Handler) getTokenUser(req *http.Request, bearer string) (userid string, err error) {
+	token, err := self.store.UseApiToken(hashApiToken(bearer))
+	if err == storage.ErrUnknownToken ||
+		(err == nil && token.Expires > 0 &&
+			token.Expires < time.Now().UTC().Unix()) {
+		self.logger.Warn(self.logCat, "Unknown or expired API token", nil)
+		self.metrics.Increment("api_token.rejected")
+		return "", ErrAuthorization
+	}
+	if err != nil {
+		return "", err
+	}
+	needs := requestScopes(req)
+	if len(needs) == 0 {
+		err = ErrTokenScope
+	}
+	for _, scope := range needs {
+		found := false
+		for _, allowed := range token.Scopes {
+			found = found || allowed == scope
+		}
+		if !found {
+			err = ErrTokenScope
+		}
+	}
+	if err != nil {
+		self.logger.Warn(self.logCat, "API token used out of scope",
+			util.Fields{"tokenId": token.ID,
+				"path":   req.URL.Path,
+				"scopes": strings.Join(token.Scopes, ",")})
+		self.metrics.Increment("api_token.denied")
+		return "", err
+	}
+	self.metrics.Increment("api_token.used")
+	return token.UserID, nil
+}
+
+// What the token list shows (never the hash).
+func tokenReply(token storage.ApiToken) replyType {
+	return replyType{
+		"id":       token.ID,
+		"name":     token.Name,
+		"scopes":   token.Scopes,
+		"created":  token.Created,
+		"expires":  token.Expires,
+		"lastused": token.LastUsed}
+}
+
+// Mint a token for the user.
+func (self *Handler) addToken(resp http.ResponseWriter, req *http.Request, userId string) {
+	args := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		TTL    int64    `json:"ttl"`
+	}{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &args)
+	}
+	if err != nil || len(args.Scopes) == 0 || args.TTL < 0 ||
+		len(args.Name) > 64 {
+		http.Error(resp, "Bad Request", 400)
+		return
+	}
+	for _, scope := range args.Scopes {
+		if _, ok := apiScopes[scope]; !ok {
+			http.Error(resp, "Unknown scope "+scope, 400)
+			return
+		}
+	}
+	tokens, err := self.store.GetApiTokens(userId)
+	if err != nil {
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	if int64(len(tokens)) >= configInt(self.config, "api.max_tokens", 20) {
+		http.Error(resp, "Too many tokens", 409)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	bearer := API_TOKEN_PREFIX + b64url(secret)
+	token := storage.ApiToken{
+		UserID: userId,
+		Name:   args.Name,
+		Hash:   hashApiToken(bearer),
+		Scopes: args.Scopes,
+	}
+	if args.TTL > 0 {
+		token.Expires = time.Now().UTC().Unix() + args.TTL
+	}
+	if token.ID, err = self.store.AddApiToken(token); err != nil {
+		self.logger.Error(self.logCat, "Could not create API token",
+			util.Fields{"error": err.Error(),
+				"userId": userId})
+		http.Error(resp, "Server Error", 500)
+		return
+	}
+	self.logger.Info(self.logCat, "API token created",
+		util.Fields{"tokenId": token.ID,
+			"userId": userId,
+			"scopes": strings.Join(token.Scopes, ",")})
+	self.metrics.Increment("api_token.created")
+	reply := tokenReply(token)
+	// The only time the token is shown.
+	reply["token"] = bearer
+	output, _ := json.Marshal(reply)
+	resp.Write(output)
+}
+
+// List, mint or revoke the user's API tokens.
+func (self *Handler) Tokens(resp http.ResponseWriter, req *http.Request) {
+	self.logCat = "handler:Tokens"
+
+	resp.Header().Set("Content-Type", "application/json")
+	// Tokens can't be used to make more tokens.
+	if bearerToken(req) != "" {
+		http.Error(resp, "Forbidden", 403)
+		return
+	}
+	userId, _, err := self.getUser(resp, req)
+	if err != nil || userId == "" {
+		http.Error(resp, "Unauthorized", 401)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		tokens, err := self.store.GetApiTokens(userId)
+		if err != nil {
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		list := []replyType{}
+		for _, token := range tokens {
+			list = append(list, tokenReply(token))
+		}
+		reply, _ := json.Marshal(replyType{"tokens": list,
+			"scopes": apiScopes})
+		if self.config.GetFlag("debug.show_output") {
+			fmt.Printf(">>>%s:%s\n", self.logCat, string(reply))
+		}
+		resp.Write(reply)
+	case "POST":
+		self.addToken(resp, req, userId)
+	case "DELETE":
+		tokenId := getDevFromUrl(req.URL)
+		err := self.store.DeleteApiToken(userId, tokenId)
+		switch {
+		case err == storage.ErrUnknownToken:
+			http.Error(resp, "Not Found", 404)
+			return
+		case err != nil:
+			http.Error(resp, "Server Error", 500)
+			return
+		}
+		self.logger.Info(self.logCat, "API token revoked",
+			util.Fields{"tokenId": tokenId,
+				"userId": userId})
+		self.metrics.Increment("api_token.revoked")
+		resp.Write([]byte("{}"))
+	default:
+		http.Error(resp, "Method Not Allowed", 405)
+	}
+}
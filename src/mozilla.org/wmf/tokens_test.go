@@ -0,0 +1,215 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A handler on the in memory store, with one device owned by the
+// returned user.
+func newTokenTestHandler(t *testing.T) (handler *Handler, userId, devId string) {
+	file, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("db.driver=memory\n" +
+		"session.secret=test-session-secret\n" +
+		"logger.filter=0\n")
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := util.NewHekaLogger(config)
+	metrics := util.NewMetrics("test", logger, config)
+	store, err := storage.Open(config, logger, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler = NewHandler(config, logger, metrics, store); handler == nil {
+		t.Fatal("Could not create handler")
+	}
+	userId, _ = util.GenUUID4()
+	devId, err = store.RegisterDevice(userId, storage.Device{
+		Name:     "phone",
+		Secret:   "device-hawk-secret",
+		PushUrl:  "https://push.example.com/device-push-endpoint",
+		PushAuth: "device-push-auth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetAccessToken(devId, "device-oauth-token")
+	return handler, userId, devId
+}
+
+// Store a token for the user, returning what the caller sends.
+func addTestToken(t *testing.T, handler *Handler, userId string, expires int64, scopes ...string) string {
+	bearer, _ := util.GenUUID4()
+	bearer = API_TOKEN_PREFIX + bearer
+	if _, err := handler.store.AddApiToken(storage.ApiToken{
+		UserID:  userId,
+		Name:    "test",
+		Hash:    hashApiToken(bearer),
+		Scopes:  scopes,
+		Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	return bearer
+}
+
+func bearerRequest(bearer, method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return req
+}
+
+func TestRequestScopes(t *testing.T) {
+	for _, test := range []struct {
+		method, path, body string
+		scopes             string
+	}{
+		{"GET", "/1/state/abc", "", "read-location"},
+		{"GET", "/1/devices/", "", "read-location"},
+		{"GET", "/1/history/abc", "", "read-location"},
+		{"DELETE", "/1/history/abc", "", ""},
+		{"POST", "/1/queue/abc", `{"r":{"d":10}}`, "send-ring"},
+		{"POST", "/1/queue/abc", `{"e":{}}`, "send-erase"},
+		{"POST", "/1/queue/abc", `{"x":{}}`, ""},
+		{"POST", "/1/queue/abc", `{"":{}}`, ""},
+		{"POST", "/1/queue/abc", `not json`, ""},
+		{"DELETE", "/1/queue/abc", "", ""},
+		{"POST", "/1/tokens/", "{}", ""},
+		{"GET", "/1/retention/abc", "", ""},
+	} {
+		req := bearerRequest("", test.method, test.path, test.body)
+		got := strings.Join(requestScopes(req), ",")
+		if got != test.scopes {
+			t.Errorf("%s %s %s: got %q, want %q", test.method, test.path,
+				test.body, got, test.scopes)
+		}
+		// The body is left for the handler.
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != test.body {
+			t.Errorf("%s %s: body was consumed", test.method, test.path)
+		}
+	}
+}
+
+func TestTokenScopeEnforcement(t *testing.T) {
+	handler, userId, devId := newTokenTestHandler(t)
+	now := time.Now().UTC().Unix()
+	reader := addTestToken(t, handler, userId, 0, "read-location")
+	ringer := addTestToken(t, handler, userId, 0, "send-ring")
+	expired := addTestToken(t, handler, userId, now-60, "read-location")
+	_, otherId, _ := newTokenTestHandler(t)
+	other := addTestToken(t, handler, otherId, 0, "read-location", "send-ring")
+
+	for _, test := range []struct {
+		name, bearer, method, path, body string
+		serve                            http.HandlerFunc
+		status                           int
+	}{
+		{"read state", reader, "GET", "/1/state/" + devId, "",
+			handler.State, 200},
+		{"list devices", reader, "GET", "/1/devices/", "",
+			handler.UserDevices, 200},
+		{"ring without scope", reader, "POST", "/1/queue/" + devId,
+			`{"r":{}}`, handler.RestQueue, 401},
+		{"ring", ringer, "POST", "/1/queue/" + devId, `{"r":{}}`,
+			handler.RestQueue, 200},
+		{"lock with ring scope", ringer, "POST", "/1/queue/" + devId,
+			`{"l":{}}`, handler.RestQueue, 401},
+		{"ring and lock with ring scope", ringer, "POST",
+			"/1/queue/" + devId, `{"r":{}, "l":{}}`,
+			handler.RestQueue, 401},
+		{"read with ring scope", ringer, "GET", "/1/state/" + devId, "",
+			handler.State, 401},
+		{"expired", expired, "GET", "/1/state/" + devId, "",
+			handler.State, 401},
+		{"unknown", API_TOKEN_PREFIX + "bogus", "GET",
+			"/1/state/" + devId, "", handler.State, 401},
+		{"other user's device", other, "GET", "/1/state/" + devId, "",
+			handler.State, 401},
+		{"ring other user's device", other, "POST", "/1/queue/" + devId,
+			`{"r":{}}`, handler.RestQueue, 401},
+		{"list tokens", reader, "GET", "/1/tokens/", "",
+			handler.Tokens, 403},
+		{"mint token", reader, "POST", "/1/tokens/",
+			`{"name":"more","scopes":["send-erase"]}`,
+			handler.Tokens, 403},
+	} {
+		resp := httptest.NewRecorder()
+		test.serve(resp, bearerRequest(test.bearer, test.method,
+			test.path, test.body))
+		if resp.Code != test.status {
+			t.Errorf("%s: got %d, want %d (%s)", test.name, resp.Code,
+				test.status, resp.Body.String())
+		}
+		if cookie := resp.Header().Get("Set-Cookie"); resp.Code == 200 &&
+			cookie != "" {
+			t.Errorf("%s: token request set a cookie: %s", test.name,
+				cookie)
+		}
+	}
+
+	// Devices are listed for tokens, without the socket URL.
+	resp := httptest.NewRecorder()
+	handler.UserDevices(resp, bearerRequest(reader, "GET", "/1/devices/", ""))
+	if body := resp.Body.String(); !strings.Contains(body, devId) ||
+		strings.Contains(body, "/ws/") {
+		t.Errorf("device list: %s", body)
+	}
+}
+
+// No reply about a device may carry its credentials.
+func TestStateRedactsSecrets(t *testing.T) {
+	handler, userId, devId := newTokenTestHandler(t)
+	reader := addTestToken(t, handler, userId, 0, "read-location")
+
+	// As an API token holder...
+	resp := httptest.NewRecorder()
+	handler.State(resp, bearerRequest(reader, "GET", "/1/state/"+devId, ""))
+	replies := map[string]string{"bearer": resp.Body.String()}
+
+	// ... and signed in.
+	req := bearerRequest("", "GET", "/1/state/"+devId, "")
+	session, _ := sessionStore.Get(req, SESSION_NAME)
+	session.Values[SESSION_USERID] = userId
+	login := httptest.NewRecorder()
+	session.Save(req, login)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp = httptest.NewRecorder()
+	handler.State(resp, req)
+	replies["session"] = resp.Body.String()
+
+	for who, body := range replies {
+		if !strings.Contains(body, devId) {
+			t.Errorf("%s: no device in reply: %s", who, body)
+			continue
+		}
+		for _, secret := range []string{"device-hawk-secret",
+			"device-push-endpoint", "device-push-auth",
+			"device-oauth-token", `"Secret"`, `"PrevSecret"`,
+			`"PushUrl"`, `"PushAuth"`, `"AccessToken"`} {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s: reply contains %s: %s", who, secret, body)
+			}
+		}
+	}
+}
@@ -91,6 +91,15 @@ func minInt(x, y int) int {
 	return y
 }
 
+// Read a numeric config value, using def if it's unset or not a number.
+func configInt(config *util.MzConfig, key string, def int64) int64 {
+	val, err := strconv.ParseInt(config.Get(key, strconv.FormatInt(def, 10)), 10, 64)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 //filter
 // get the device id from the URL path
 func getDevFromUrl(u *url.URL) (devId string) {
@@ -104,3 +113,17 @@ func getDevFromUrl(u *url.URL) (devId string) {
 	}
 	return devId
 }
+
+// get the device id and the trailing item id from a URL path like
+// /1/queue/<deviceid>/<itemid>
+func getDevItemFromUrl(u *url.URL) (devId, itemId string) {
+	elements := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(elements) < 4 {
+		return "", ""
+	}
+	devId = strings.Map(deviceIdFilter, elements[len(elements)-2])
+	if len(devId) > 32 {
+		devId = devId[:32]
+	}
+	return devId, elements[len(elements)-1]
+}
@@ -0,0 +1,130 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Wake transports other than HTTP push, picked by the scheme of the
+   device's push URL (see wakeTransports in push.go). Only hosts listed
+   in push.udp.hosts or push.webhook.hosts are reached.
+
+   udp://<host>:<port>/<token>
+       Sends a single datagram holding <token> (or the device id, if
+       there is no token). Fire and forget.
+
+   webhook+https://<host>/<path>
+       POSTs {"deviceid":..., "time":..., "payload":...} to
+       https://<host>/<path>, signed with the secret shared with that
+       host (push.webhook.<host>.secret). Hosts without one get nothing.
+           X-Wake-Timestamp: <epoch seconds>
+           X-Wake-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+*/
+
+var ErrNoWebhookSecret = errors.New("No webhook secret configured")
+
+type udpWake struct {
+	timeout time.Duration
+}
+
+func newUdpWake(config *util.MzConfig, client *PushClient) (PushProvider, error) {
+	return &udpWake{
+		timeout: time.Duration(configInt(config, "push.connect_timeout",
+			5)) * time.Second,
+	}, nil
+}
+
+func (self *udpWake) Send(devRec *storage.Device, payload []byte) error {
+	u, err := url.Parse(devRec.PushUrl)
+	if err != nil {
+		return ErrInvalidPushUrl
+	}
+	token := strings.TrimPrefix(u.Path, "/")
+	if token == "" {
+		token = devRec.ID
+	}
+	conn, err := net.DialTimeout("udp", u.Host, self.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(self.timeout))
+	_, err = conn.Write([]byte(token))
+	return err
+}
+
+type webhookWake struct {
+	client *PushClient
+	config *util.MzConfig
+}
+
+func newWebhookWake(config *util.MzConfig, client *PushClient) (PushProvider, error) {
+	return &webhookWake{client: client, config: config}, nil
+}
+
+// Sign the body as of the given time.
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *webhookWake) Send(devRec *storage.Device, payload []byte) error {
+	u, err := url.Parse(devRec.PushUrl)
+	if err != nil {
+		return ErrInvalidPushUrl
+	}
+	// webhook+https://... => https://...
+	u.Scheme = strings.TrimPrefix(strings.ToLower(u.Scheme), "webhook+")
+	secret := self.config.Get("push.webhook."+strings.ToLower(u.Host)+".secret",
+		"")
+	if secret == "" {
+		return ErrNoWebhookSecret
+	}
+
+	now := time.Now().Unix()
+	msg := replyType{
+		"deviceid": devRec.ID,
+		"time":     now,
+		"payload":  nil,
+	}
+	if payload != nil {
+		msg["payload"] = json.RawMessage(payload)
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wake-Timestamp", strconv.FormatInt(now, 10))
+	req.Header.Set("X-Wake-Signature", webhookSignature(secret, now, body))
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return pushStatus(resp, http.StatusOK, http.StatusAccepted,
+		http.StatusNoContent)
+}
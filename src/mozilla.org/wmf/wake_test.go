@@ -0,0 +1,82 @@
+package wmf
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+import (
+	"mozilla.org/util"
+	"mozilla.org/wmf/storage"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Wake transports only reach listed hosts, and webhooks only go to
+// hosts with their own secret.
+func TestWakeHosts(t *testing.T) {
+	var signature string
+	signed := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			ts, _ := strconv.ParseInt(req.Header.Get("X-Wake-Timestamp"), 10, 64)
+			if req.Header.Get("X-Wake-Signature") == webhookSignature("s3cret", ts, body) {
+				signature = "ok"
+			}
+			resp.WriteHeader(http.StatusNoContent)
+		}))
+	defer signed.Close()
+	unsigned := testPushServer(http.StatusNoContent)
+	defer unsigned.Close()
+	signedHost, _ := url.Parse(signed.URL)
+	unsignedHost, _ := url.Parse(unsigned.URL)
+
+	file, err := ioutil.TempFile("", "wake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("push.udp.hosts=wake.carrier.example:9999\n" +
+		"push.webhook.hosts=" + signedHost.Host + "," + unsignedHost.Host + "\n" +
+		"push.webhook." + signedHost.Host + ".secret=s3cret\n" +
+		"logger.filter=0\n")
+	file.Close()
+	config, err := util.ReadMzConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pushUrl, want := range map[string]error{
+		"https://updates.push.example/abc":       nil,
+		"udp://wake.carrier.example:9999/abc":    nil,
+		"udp://169.254.169.254:53/abc":           ErrWakeHostNotAllowed,
+		"webhook+http://" + signedHost.Host:      nil,
+		"webhook+https://internal.example/admin": ErrWakeHostNotAllowed,
+	} {
+		if err := checkPushUrl(config, pushUrl, storage.PUSH_SIMPLEPUSH); err != want {
+			t.Errorf("%s: got %v, want %v", pushUrl, err, want)
+		}
+	}
+
+	send := func(pushUrl string) error {
+		return SendPush(&storage.Device{ID: "dev", PushUrl: pushUrl},
+			config, nil)
+	}
+	if err := send("webhook+http://internal.example/admin"); err != ErrWakeHostNotAllowed {
+		t.Errorf("Unlisted webhook host: got %v", err)
+	}
+	if err := send("webhook+http://" + unsignedHost.Host + "/wake"); err != ErrNoWebhookSecret {
+		t.Errorf("Webhook host without a secret: got %v", err)
+	}
+	if err := send("webhook+http://" + signedHost.Host + "/wake"); err != nil {
+		t.Fatal(err)
+	}
+	if signature != "ok" {
+		t.Error("Webhook was not signed with the host's secret")
+	}
+}
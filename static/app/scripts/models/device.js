@@ -26,6 +26,11 @@ define([
     onWebSocketUpdate: function (message) {
       var data = JSON.parse(message.data);
 
+      if (data && data.Geofence) {
+        this.parseGeofence(data.Geofence);
+        return;
+      }
+
       if (data) {
         var updatedAttributes = {};
 
@@ -37,12 +42,21 @@ define([
           updatedAttributes.latitude = data.Latitude;
           updatedAttributes.longitude = data.Longitude;
           updatedAttributes.altitude = data.Altitude;
+          // Radius in meters; a large value is a rough (e.g. cell tower) fix
+          updatedAttributes.accuracy = data.Accuracy;
+          updatedAttributes.speed = data.Speed;
+          updatedAttributes.heading = data.Heading;
+          updatedAttributes.provider = data.Provider;
           updatedAttributes.located = true;
 
           // Lose location after 60 seconds of no location updates
           this.locationTimeout = setTimeout(_.bind(this.locationTimedout, this), this.LOCATION_TIMEOUT);
         }
 
+        if (data.Battery > 0) {
+          updatedAttributes.battery = data.Battery;
+        }
+
         if (data.Time > 0) {
           updatedAttributes.time = new Date(data.Time);
         }
@@ -79,13 +93,40 @@ define([
       }
     },
 
+    parseGeofence: function (event) {
+      var verb = event.Event === 'enter' ? 'entered' : 'left';
+
+      this.trigger('geofence', event);
+      Notifier.notify('Your device ' + verb + ' ' + event.Name + '.');
+    },
+
     listenForUpdates: function () {
-      this.socket = new WebSocket(this.get('url'));
-      this.socket.onmessage = this.onWebSocketUpdate.bind(this);
+      this.listening = true;
+
+      // Socket URLs carry a short lived token, so get a fresh one.
+      $.getJSON('/1/devices/').done(function (data) {
+        var device = _.findWhere(data.devices, { ID: this.id });
+
+        if (!this.listening) {
+          return;
+        }
+
+        if (device) {
+          this.set('url', device.URL);
+        }
+
+        this.socket = new WebSocket(this.get('url'));
+        this.socket.onmessage = this.onWebSocketUpdate.bind(this);
+      }.bind(this));
     },
 
     stopListening: function () {
-      this.socket.close();
+      this.listening = false;
+
+      if (this.socket) {
+        this.socket.close();
+        this.socket = null;
+      }
     },
 
     sendCommand: function (command) {
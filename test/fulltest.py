@@ -51,7 +51,7 @@ def genHash(body, ctype="application/json"):
         return ""
     marshalStr = "%s\n%s\n%s\n" % (
         "hawk.1.payload",
-        ctype,
+        ctype.split(";")[0].strip().lower(),
         body)
     bhash = base64.b64encode(hashlib.sha256(marshalStr).digest())
     #print("Hash:<<%s>>\nBHash:<<%s>>\n" % (marshalStr, bhash))
@@ -59,7 +59,8 @@ def genHash(body, ctype="application/json"):
 
 
 def genHawkSignature(method, urlStr, bodyHash, extra, secret,
-                     now=None, nonce=None, ctype="application/json"):
+                     now=None, nonce=None, ctype="application/json",
+                     kind="header"):
     """ Generate a HAWK signature from the content to be sent
     """
     url = urlparse.urlparse(urlStr)
@@ -71,7 +72,7 @@ def genHawkSignature(method, urlStr, bodyHash, extra, secret,
     if now is None:
         now = int(time.time())
     marshalStr = "%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n" % (
-        "hawk.1.header",
+        "hawk.1." + kind,
         now,
         nonce,
         method.upper(),
@@ -103,19 +104,22 @@ def parseHawkHeader(header):
 
 
 def checkHawk(response, secret):
-    """ Validate the HAWK header against the body
+    """ Validate the HAWK Server-Authorization header against the body
     """
-    hawk = parseHawkHeader(response.headers.get("authorization"))
+    hawk = parseHawkHeader(response.headers.get("server-authorization"))
+    # the response is signed with the request's ts and nonce
+    reqHawk = parseHawkHeader(response.request.headers.get("authorization"))
     ct = response.headers.get('content-type')
     bodyhash = genHash(response.text, ct)
     _, _, mac = genHawkSignature(response.request.method,
                                  response.request.url,
                                  bodyhash,
-                                 hawk.get("ext"),
+                                 hawk.get("ext", ""),
                                  secret,
-                                 hawk["ts"],
-                                 hawk["nonce"],
-                                 ct)
+                                 reqHawk["ts"],
+                                 reqHawk["nonce"],
+                                 ct,
+                                 "response")
     # remove "white space
     return mac.replace('=', '') == hawk["mac"].replace('=', '')
 
@@ -135,21 +139,20 @@ def fakeLocation():
     return {"t": {"la": lat, "lo": lon, "ti": utc, "ha": True}}
 
 
+# The server's dev.users (run it with --dev to sign in as these)
+DEV_USERS = ["user1@example.com", "user2@example.com"]
+
+
 def fakeUser():
-    return "FakeUser_" + ("%012x" % rval()) + "@example.com"
+    return random.choice(DEV_USERS)
 
 
 def fakeAssertion(email=None):
+    """ With --dev, the assertion is just the fake user's email
+    """
     if email is None:
         email = fakeUser()
-    return "%s.%s.%s" % (
-        base64.b64encode(json.dumps({"alg": "fake"})),
-        base64.b64encode(json.dumps({"public-key": {"algorithm": "None"},
-                                     "iat": int(time.time()),
-                                     "exp": int(time.time()) + 300,
-                                     "principal": {"email": email},
-                                     "iss": "login.example.org"})),
-        "InvalidKey")
+    return email
 
 
 def getConfig(argv):
@@ -235,7 +238,7 @@ def send(urlStr, cred, data, method="POST", user=None):
         print("Response Not OK")
         requests.Response.raise_for_status()
     print("Response %s\n" % response.status_code)
-    if response.headers.get("Authorization") is not None:
+    if response.headers.get("Server-Authorization") is not None:
         if checkHawk(response, cred.get("secret")) is False:
             pdb.set_trace()
             print("HAWK Header failed")
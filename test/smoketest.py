@@ -54,7 +54,7 @@ def genHash(body, ctype="application/json"):
         return ""
     marshalStr = "%s\n%s\n%s\n" % (
         "hawk.1.payload",
-        ctype,
+        ctype.split(";")[0].strip().lower(),
         body)
     bhash = base64.b64encode(hashlib.sha256(marshalStr).digest())
     #print "Hash:<<%s>>\nBHash:<<%s>>\n" % (marshalStr, bhash)
@@ -62,7 +62,8 @@ def genHash(body, ctype="application/json"):
 
 
 def genHawkSignature(method, urlStr, bodyHash, extra, secret,
-                     now=None, nonce=None, ctype="application/json"):
+                     now=None, nonce=None, ctype="application/json",
+                     kind="header"):
     """ Generate a HAWK signature from the content to be sent
     """
     url = urlparse.urlparse(urlStr)
@@ -76,7 +77,7 @@ def genHawkSignature(method, urlStr, bodyHash, extra, secret,
     if now is None:
         now = int(time.time())
     marshalStr = "%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n" % (
-        "hawk.1.header",
+        "hawk.1." + kind,
         now,
         nonce,
         method.upper(),
@@ -108,19 +109,22 @@ def parseHawkHeader(header):
 
 
 def checkHawk(response, secret):
-    """ Validate the HAWK header against the body
+    """ Validate the HAWK Server-Authorization header against the body
     """
-    hawk = parseHawkHeader(response.headers.get("authorization"))
+    hawk = parseHawkHeader(response.headers.get("server-authorization"))
+    # the response is signed with the request's ts and nonce
+    reqHawk = parseHawkHeader(response.request.headers.get("authorization"))
     ct = response.headers.get('content-type')
     bodyhash = genHash(response.text, ct)
     _, _, mac = genHawkSignature(response.request.method,
                                  response.request.url,
                                  bodyhash,
-                                 hawk.get("ext"),
+                                 hawk.get("ext", ""),
                                  secret,
-                                 hawk["ts"],
-                                 hawk["nonce"],
-                                 ct)
+                                 reqHawk["ts"],
+                                 reqHawk["nonce"],
+                                 ct,
+                                 "response")
     # remove "white space
     pdb.set_trace();
     return mac.replace('=', '') == hawk["mac"].replace('=', '')
@@ -221,7 +225,7 @@ def send(urlStr, data, cred, method="POST"):
         pdb.set_trace()
         print "Response Not OK"
         requests.Response.raise_for_status()
-    if response.headers.get("Authorization") is not None:
+    if response.headers.get("Server-Authorization") is not None:
         if checkHawk(response, cred.get("secret")) is False:
             pdb.set_trace()
             print "HAWK Header failed"